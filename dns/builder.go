@@ -0,0 +1,70 @@
+package dns
+
+// QueryBuilder builds a query step by step:
+//
+//	req := NewQueryBuilder().RecursionDesired(true).Question("example.com", A).EDNS(4096).Build()
+type QueryBuilder struct {
+	packet *DnsPacket
+}
+
+// NewQueryBuilder starts a query with a random ID and no flags set.
+func NewQueryBuilder() *QueryBuilder {
+	packet := NewDnsPacket()
+	packet.Header.ID = newQueryID()
+	return &QueryBuilder{packet: packet}
+}
+
+func (qb *QueryBuilder) ID(id uint16) *QueryBuilder {
+	qb.packet.Header.ID = id
+	return qb
+}
+
+func (qb *QueryBuilder) Opcode(opcode Opcode) *QueryBuilder {
+	qb.packet.Header.Opcode = opcode
+	return qb
+}
+
+func (qb *QueryBuilder) RecursionDesired(rd bool) *QueryBuilder {
+	qb.packet.Header.RecursionDesired = rd
+	return qb
+}
+
+func (qb *QueryBuilder) CheckingDisabled(cd bool) *QueryBuilder {
+	qb.packet.Header.CheckingDisabled = cd
+	return qb
+}
+
+// Question adds a question for name, which can be called more than once.
+func (qb *QueryBuilder) Question(name string, qtype RecordType, opts ...QuestionOption) *QueryBuilder {
+	qb.packet.AddQuestion(NewDnsQuestion(name, qtype, opts...))
+	return qb
+}
+
+// EDNS adds an OPT record advertising payloadSize.
+func (qb *QueryBuilder) EDNS(payloadSize uint16) *QueryBuilder {
+	return qb.With(WithEDNS(payloadSize))
+}
+
+// DNSSEC sets the DO bit, adding an OPT record if needed.
+func (qb *QueryBuilder) DNSSEC() *QueryBuilder {
+	return qb.With(WithDNSSEC())
+}
+
+// NSID asks the server for its NSID, adding an OPT record if needed.
+func (qb *QueryBuilder) NSID() *QueryBuilder {
+	return qb.With(WithNSID())
+}
+
+// With applies options as accepted by NewQuery.
+func (qb *QueryBuilder) With(opts ...QueryOption) *QueryBuilder {
+	for _, opt := range opts {
+		opt(qb.packet)
+	}
+	return qb
+}
+
+// Build returns the query. The builder keeps no reference to it, so it can
+// be used to build further queries from the same settings.
+func (qb *QueryBuilder) Build() *DnsPacket {
+	return qb.packet.Clone()
+}
@@ -0,0 +1,52 @@
+package dns
+
+import "testing"
+
+func TestQueryBuilder(t *testing.T) {
+	qb := NewQueryBuilder().
+		ID(0x1234).
+		RecursionDesired(true).
+		CheckingDisabled(true).
+		Question("example.com", A).
+		Question("example.org", AAAA).
+		EDNS(4096).
+		DNSSEC().
+		NSID()
+	req := qb.Build()
+
+	h := req.Header
+	if h.ID != 0x1234 || h.Response || h.Opcode != OpcodeQuery || h.FlagsString() != "rd cd" {
+		t.Errorf("built header %+v", h)
+	}
+	if len(req.Questions) != 2 ||
+		req.Questions[0].Name != "example.com" || req.Questions[0].Type != A ||
+		req.Questions[1].Name != "example.org" || req.Questions[1].Type != AAAA {
+		t.Errorf("built questions %v", req.Questions)
+	}
+
+	opt := req.OPT()
+	if opt == nil || len(req.Resources) != 1 {
+		t.Fatalf("built additional records %v, want one OPT", req.Resources)
+	}
+	if opt.PayloadSize != 4096 || opt.TTL&doBit == 0 {
+		t.Errorf("OPT has payload %d and flags %#x", opt.PayloadSize, opt.TTL)
+	}
+	if _, ok := req.option(EDNSOptionNSID); !ok {
+		t.Errorf("OPT has no NSID option: %v", opt.Options)
+	}
+
+	msg, err := req.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Unpack(msg); err != nil {
+		t.Errorf("built query doesn't parse: %v", err)
+	}
+
+	// Building again starts from the same settings, unaffected by
+	// changes to the first query.
+	req.Questions[0].Name = "changed.example.com"
+	if again := qb.Build(); !again.Equal(qb.Build()) || again.Questions[0].Name != "example.com" {
+		t.Errorf("second build got\n%v", again)
+	}
+}
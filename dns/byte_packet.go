@@ -3,16 +3,136 @@ package dns
 import (
 	"errors"
 	"fmt"
+	"io"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 )
 
+// ErrBufferOverflow is returned when moving the position past the end of the
+// buffer.
+var ErrBufferOverflow = errors.New("buffer overflow")
+
+// ErrInvalidPointer is returned by ReadQName for a compression pointer to
+// an offset no name can be at.
+var ErrInvalidPointer = errors.New("invalid compression pointer")
+
+// ErrInvalidLabel is returned by ReadQName for a label of one of the
+// extended or reserved types, whose length byte starts with the bits 01 or
+// 10.
+var ErrInvalidLabel = errors.New("invalid label type")
+
+// ErrNonHostLabel is returned by ReadQName in StrictMode for a label that
+// doesn't belong in a host name.
+var ErrNonHostLabel = errors.New("label not allowed in host name")
+
+// maxMessageSize is the largest message that can be addressed by the
+// 16 bit positions of a buffer.
+const maxMessageSize = 65535
+
 type BytePacketBuffer struct {
-	Buf [512]byte
+	Buf []byte
 	Pos uint16
+
+	// PreserveCase keeps the original case of names read by ReadQName
+	// instead of lowercasing them.
+	PreserveCase bool
+
+	// AllowHeaderPointers makes ReadQName follow compression pointers into
+	// the header, reading whatever is there as labels. Such pointers are
+	// rejected with ErrInvalidPointer by default.
+	AllowHeaderPointers bool
+
+	// StrictMode makes ReadQName reject names that aren't host names:
+	// labels may only hold letters, digits and hyphens, apart from a
+	// leading underscore as in "_tcp" or "_dmarc" and the wildcard label
+	// "*". Such names fail with ErrNonHostLabel.
+	StrictMode bool
+
+	// Compress makes WriteQName replace the end of a name with a pointer
+	// if the same labels were written before. It is set by the
+	// constructors; without it every name is written in full.
+	Compress bool
+
+	// Names optionally holds names known to be written often, so that
+	// WriteQName doesn't have to parse them over and over, nor remember
+	// the suffixes of the question name for compression.
+	Names *NameTable
+
+	// names maps the wire form of every name suffix written so far to its
+	// offset, for compression.
+	names map[string]uint16
+
+	// scratch is reused by ReadQName to assemble names, and lastName is
+	// the name it read last, returned again instead of a new copy when
+	// the next name is the same, as owner names in a response often are.
+	scratch  []byte
+	lastName string
 }
 
+// NewBytePacketBuffer returns a buffer of 512 bytes, the largest message
+// allowed over UDP without EDNS.
 func NewBytePacketBuffer() *BytePacketBuffer {
-	return &BytePacketBuffer{}
+	return NewBytePacketBufferSize(512)
+}
+
+// NewBytePacketBufferSize returns a buffer of size bytes, which is capped at
+// the largest possible message size.
+func NewBytePacketBufferSize(size int) *BytePacketBuffer {
+	size = min(size, maxMessageSize)
+	return &BytePacketBuffer{Buf: make([]byte, size), Compress: true}
+}
+
+// NewBytePacketBufferFromReader reads exactly n bytes from r into a new
+// buffer of that size, positioned at its start. A short read fails with
+// io.ErrUnexpectedEOF.
+func NewBytePacketBufferFromReader(r io.Reader, n int) (*BytePacketBuffer, error) {
+	if n < 0 || n > maxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes exceeds buffer size", n)
+	}
+	b := NewBytePacketBufferSize(n)
+
+	if _, err := io.ReadFull(r, b.Buf[:n]); err != nil {
+		if errors.Is(err, io.EOF) && n > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// bufferPool holds buffers of 512 bytes for GetBuffer.
+var bufferPool = sync.Pool{
+	New: func() any {
+		return NewBytePacketBuffer()
+	},
+}
+
+// GetBuffer returns a buffer of 512 bytes like NewBytePacketBuffer, but
+// reuses one handed back by PutBuffer if possible. It is safe for
+// concurrent use.
+func GetBuffer() *BytePacketBuffer {
+	return bufferPool.Get().(*BytePacketBuffer)
+}
+
+// PutBuffer resets b and hands it back for reuse by GetBuffer. Neither b
+// nor its Buf may be used after the call. Buffers of any size other than
+// 512 bytes are left to the garbage collector.
+func PutBuffer(b *BytePacketBuffer) {
+	if len(b.Buf) != 512 {
+		return
+	}
+	b.Reset()
+	bufferPool.Put(b)
+}
+
+// Reset zeroes the contents of the buffer and returns it to the state the
+// constructors leave it in, with the position at the start, the options at
+// their defaults and no names remembered for compression.
+func (b *BytePacketBuffer) Reset() {
+	clear(b.Buf)
+	*b = BytePacketBuffer{Buf: b.Buf, Compress: true}
 }
 
 func (b *BytePacketBuffer) SetBuffer(buf []byte) {
@@ -29,6 +149,9 @@ func (b *BytePacketBuffer) Set2Bytes(pos uint16, val uint16) {
 }
 
 func (b *BytePacketBuffer) Step(steps uint16) error {
+	if int(b.Pos)+int(steps) > len(b.Buf) {
+		return ErrBufferOverflow
+	}
 	b.Pos += steps
 	return nil
 }
@@ -39,7 +162,7 @@ func (b *BytePacketBuffer) Seek(pos uint16) error {
 }
 
 func (b *BytePacketBuffer) Read() (byte, error) {
-	if b.Pos >= 512 {
+	if int(b.Pos) >= len(b.Buf) {
 		return 0, errors.New("end of buffer")
 	}
 
@@ -49,18 +172,32 @@ func (b *BytePacketBuffer) Read() (byte, error) {
 }
 
 func (b *BytePacketBuffer) Get(pos uint16) (byte, error) {
-	if pos >= 512 {
+	if int(pos) >= len(b.Buf) {
 		return 0, errors.New("end of buffer")
 	}
 	return b.Buf[pos], nil
 }
 
-func (b *BytePacketBuffer) GetRange(start, len uint16) ([]byte, error) {
-	if start+len >= 512 {
+// GetRange returns length bytes starting at start. The returned slice
+// aliases the buffer, so it changes whenever the buffer is written to or
+// reused; use GetRangeCopy to keep the bytes around.
+func (b *BytePacketBuffer) GetRange(start, length uint16) ([]byte, error) {
+	// Computed as int so that a huge length can't wrap around.
+	if int(start)+int(length) > len(b.Buf) {
 		return nil, errors.New("end of buffer")
 	}
 
-	return b.Buf[start : start+len], nil
+	return b.Buf[start : start+length], nil
+}
+
+// GetRangeCopy is like GetRange, but returns a copy of the bytes that is
+// safe to retain.
+func (b *BytePacketBuffer) GetRangeCopy(start, len uint16) ([]byte, error) {
+	bs, err := b.GetRange(start, len)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), bs...), nil
 }
 
 func (b *BytePacketBuffer) Read2Bytes() (uint16, error) {
@@ -100,8 +237,20 @@ func (b *BytePacketBuffer) Read4Bytes() (uint32, error) {
 //	The tricky part: Reading domain names, taking labels into consideration.
 //	Will take something like [3]www[6]google[3]com[0] and append
 //	www.google.com.
+//
+//	Names are lowercased unless PreserveCase is set. Dots, backslashes and
+//	non-printable bytes within labels are escaped as WriteQName expects.
 func (b *BytePacketBuffer) ReadQName() (string, error) {
-	var sb strings.Builder
+	name, _, err := b.ReadQNameN()
+	return name, err
+}
+
+// ReadQNameN is like ReadQName, but also returns the number of bytes the
+// name occupies at the current position. Bytes reached through compression
+// pointers are not counted, a pointer itself counts as 2 bytes.
+func (b *BytePacketBuffer) ReadQNameN() (string, uint16, error) {
+	name := b.scratch[:0]
+	start := b.Pos
 	pos := b.Pos
 
 	jumped := false
@@ -112,12 +261,12 @@ func (b *BytePacketBuffer) ReadQName() (string, error) {
 
 	for {
 		if jumpsPerformed > maxJums {
-			return "", fmt.Errorf("limit of %d jums exceeded", maxJums)
+			return "", 0, fmt.Errorf("limit of %d jums exceeded", maxJums)
 		}
 
 		lenByte, err := b.Get(pos)
 		if err != nil {
-			return "", err
+			return "", 0, err
 		}
 
 		// If len has the two most significant bit are set, it represents a
@@ -125,21 +274,32 @@ func (b *BytePacketBuffer) ReadQName() (string, error) {
 		if (lenByte & 0xC0) == 0xC0 {
 			if !jumped {
 				if err := b.Seek(pos + 2); err != nil {
-					return "", err
+					return "", 0, err
 				}
 			}
 
 			b2, err := b.Get(pos + 1)
 			if err != nil {
-				return "", err
+				return "", 0, err
 			}
 
 			offset := (((uint16(lenByte) ^ 0xC0) << 8) | uint16(b2))
+			if offset < headerLen && !b.AllowHeaderPointers {
+				return "", 0, fmt.Errorf("%w: offset %d is in the header", ErrInvalidPointer, offset)
+			}
+			// Names are only ever compressed to names written before
+			// them, so a pointer to itself or beyond is malformed, like a
+			// question pointing forward into the records.
+			if offset >= pos {
+				return "", 0, fmt.Errorf("%w: offset %d is not before %d", ErrInvalidPointer, offset, pos)
+			}
 			pos = offset
 
 			jumped = true
 			jumpsPerformed++
 			continue
+		} else if lenByte&0xC0 != 0 {
+			return "", 0, fmt.Errorf("%w: length byte 0x%02x", ErrInvalidLabel, lenByte)
 		} else {
 			pos += 1
 
@@ -149,14 +309,20 @@ func (b *BytePacketBuffer) ReadQName() (string, error) {
 				break
 			}
 
-			sb.WriteString(delim)
+			name = append(name, delim...)
 
 			bs, err := b.GetRange(pos, uint16(lenByte))
 			if err != nil {
-				return "", err
+				return "", 0, err
+			}
+
+			if b.StrictMode {
+				if err := checkHostLabel(bs); err != nil {
+					return "", 0, err
+				}
 			}
 
-			sb.WriteString(strings.ToLower(string(bs)))
+			name = appendLabel(name, bs, !b.PreserveCase)
 
 			delim = "."
 
@@ -166,15 +332,54 @@ func (b *BytePacketBuffer) ReadQName() (string, error) {
 
 	if !jumped {
 		if err := b.Seek(pos); err != nil {
-			return "", err
+			return "", 0, err
+		}
+	}
+
+	b.scratch = name
+	if string(name) != b.lastName {
+		b.lastName = string(name)
+	}
+	return b.lastName, b.Pos - start, nil
+}
+
+// checkHostLabel checks that label is allowed in StrictMode.
+func checkHostLabel(label []byte) error {
+	if string(label) == "*" {
+		return nil
+	}
+	for i, c := range label {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-':
+		case c == '_' && i == 0:
+		default:
+			return fmt.Errorf("%w: byte 0x%02x in label %q", ErrNonHostLabel, c, label)
 		}
 	}
+	return nil
+}
+
+// ReadCharacterString reads a <character-string>: a single length byte
+// followed by that many bytes of data.
+func (b *BytePacketBuffer) ReadCharacterString() (string, error) {
+	n, err := b.Read()
+	if err != nil {
+		return "", err
+	}
+
+	bs, err := b.GetRange(b.Pos, uint16(n))
+	if err != nil {
+		return "", err
+	}
 
-	return sb.String(), nil
+	if err := b.Step(uint16(n)); err != nil {
+		return "", err
+	}
+	return string(bs), nil
 }
 
 func (b *BytePacketBuffer) write(val byte) error {
-	if b.Pos >= 512 {
+	if int(b.Pos) >= len(b.Buf) {
 		return errors.New("end of buffer")
 	}
 	b.Buf[b.Pos] = val
@@ -212,27 +417,274 @@ func (b *BytePacketBuffer) Write4Byte(val uint32) error {
 	return b.write(uint8(val & 0xFF))
 }
 
+// WriteQName writes qname as a sequence of labels. Within a label, "\."
+// stands for a literal dot, "\\" for a backslash and "\DDD" for the byte
+// with the decimal value DDD, as in master files. With Compress set, the
+// longest suffix of qname already in the buffer is replaced by a pointer.
 func (b *BytePacketBuffer) WriteQName(qname string) error {
-	var err error
-	for _, label := range strings.Split(qname, ".") {
+	labels, suffixes, err := b.Names.split(qname)
+	if err != nil {
+		return err
+	}
+	return b.writeLabels(labels, suffixes)
+}
+
+// WriteLabels writes a name that is already split into labels, like
+// []string{"www", "example", "com"}. The labels are taken as raw bytes, so
+// dots and backslashes within them need no escaping. An empty slice is the
+// root. Compression works as for WriteQName.
+func (b *BytePacketBuffer) WriteLabels(labels []string) error {
+	raw := make([][]byte, len(labels))
+	wireLen := 1
+	for i, label := range labels {
+		if label == "" || len(label) > 0x3f {
+			return fmt.Errorf("label at index %d has %d bytes, not 1 to 63", i, len(label))
+		}
+		raw[i] = []byte(label)
+		wireLen += 1 + len(label)
+	}
+	if wireLen > 255 {
+		return fmt.Errorf("name of %d bytes exceeds 255 bytes", wireLen)
+	}
+	return b.writeLabels(raw, nil)
+}
+
+// writeLabels writes labels followed by the root. suffixes holds the
+// suffix keys of the labels if they are known already, and is nil
+// otherwise.
+func (b *BytePacketBuffer) writeLabels(labels [][]byte, suffixes []string) error {
+	// A name of the table written right after the header, as the question
+	// of a message is, is found through the offsets the table keeps for
+	// it, so its suffixes don't need to be remembered.
+	seeded := suffixes != nil && b.Pos == headerLen && len(b.names) == 0
+
+	for i, label := range labels {
+		if b.Compress {
+			var suffix string
+			if suffixes != nil {
+				suffix = suffixes[i]
+			} else {
+				suffix = suffixKey(labels[i:])
+			}
+			if offset, ok := b.names[suffix]; ok {
+				return b.Write2Byte(0xC000 | offset)
+			}
+			if offset, ok := b.Names.offset(b, suffix); ok {
+				return b.Write2Byte(0xC000 | offset)
+			}
+
+			// Pointers only have 14 bits for the offset.
+			if !seeded && b.Pos <= 0x3FFF {
+				if b.names == nil {
+					b.names = map[string]uint16{}
+				}
+				b.names[suffix] = b.Pos
+			}
+		}
+
 		n := len(label)
 		if n > 0x3f {
 			return errors.New("signle label exceeds 63 characters of length")
 		}
 
-		err = b.Write1Byte(byte(n))
+		err := b.Write1Byte(byte(n))
 		if err != nil {
 			return err
 		}
 
-		for _, b1 := range []byte(label) {
+		for _, b1 := range label {
 			err = b.Write1Byte(b1)
 			if err != nil {
 				return err
 			}
 		}
+	}
+
+	return b.Write1Byte(byte(0))
+}
+
+// NameTable holds names parsed ahead of time, together with the keys of
+// their suffixes for compression and the offsets the suffixes end up at
+// when the name is the question of a message. A server answering for a
+// zone can keep one with the names of the zone and set it on every buffer
+// it writes responses to. Names in the answer then compress against the
+// question through those offsets, without every suffix of the question
+// being remembered for each message. It is never modified once created,
+// so it may be shared between goroutines.
+type NameTable struct {
+	names map[string]tableName
+	// offsets maps a suffix key to where it is written when a name of
+	// the table that ends with it follows the header.
+	offsets map[string][]uint16
+}
+
+type tableName struct {
+	labels   [][]byte
+	suffixes []string
+}
+
+// NewNameTable parses names into a new table. Names are looked up exactly
+// as given, so "example.com" and "example.com." are separate entries.
+func NewNameTable(names ...string) (*NameTable, error) {
+	t := &NameTable{
+		names:   make(map[string]tableName, len(names)),
+		offsets: map[string][]uint16{},
+	}
+	for _, name := range names {
+		labels, err := splitLabels(name)
+		if err != nil {
+			return nil, err
+		}
+
+		suffixes := make([]string, len(labels))
+		offset := uint16(headerLen)
+		for i, label := range labels {
+			suffixes[i] = suffixKey(labels[i:])
+			if !slices.Contains(t.offsets[suffixes[i]], offset) {
+				t.offsets[suffixes[i]] = append(t.offsets[suffixes[i]], offset)
+			}
+			offset += 1 + uint16(len(label))
+		}
+		t.names[name] = tableName{labels, suffixes}
+	}
+	return t, nil
+}
+
+// offset returns where the suffix with the given key was written to b, if
+// it was written as part of a name of the table right after the header.
+// The bytes at the offset are checked, as b may hold any other name there.
+func (t *NameTable) offset(b *BytePacketBuffer, key string) (uint16, bool) {
+	if t == nil {
+		return 0, false
+	}
+	for _, offset := range t.offsets[key] {
+		end := int(offset) + len(key)
+		if end < int(b.Pos) && b.Buf[end] == 0 && string(b.Buf[offset:end]) == key {
+			return offset, true
+		}
+	}
+	return 0, false
+}
+
+// split returns the labels of name, and their suffix keys if name is in
+// the table. A nil table parses every name.
+func (t *NameTable) split(name string) ([][]byte, []string, error) {
+	if t != nil {
+		if n, ok := t.names[name]; ok {
+			return n.labels, n.suffixes, nil
+		}
+	}
+
+	labels, err := splitLabels(name)
+	return labels, nil, err
+}
+
+// splitLabels splits name at its unescaped dots and resolves the escapes
+// within each label. A single trailing dot marks a fully qualified name.
+// Both "" and "." are the root, which has no labels. Any other empty label
+// is an error, as are names longer than 255 bytes on the wire.
+func splitLabels(name string) ([][]byte, error) {
+	if name == "" || name == "." {
+		return nil, nil
+	}
+
+	var labels [][]byte
+	label := []byte{}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c == '.':
+			// An empty label would end the name early on the wire.
+			if len(label) == 0 {
+				return nil, fmt.Errorf("empty label in %q", name)
+			}
+			labels = append(labels, label)
+			label = []byte{}
+		case c != '\\':
+			label = append(label, c)
+		case i+3 < len(name) && isDigits(name[i+1:i+4]):
+			n, _ := strconv.Atoi(name[i+1 : i+4])
+			if n > 0xFF {
+				return nil, fmt.Errorf("invalid escape \\%s in %q", name[i+1:i+4], name)
+			}
+			label = append(label, byte(n))
+			i += 3
+		case i+1 < len(name):
+			label = append(label, name[i+1])
+			i++
+		default:
+			return nil, fmt.Errorf("trailing backslash in %q", name)
+		}
+	}
+
+	// The last label is only empty if name ended with an unescaped dot.
+	if len(label) > 0 {
+		labels = append(labels, label)
+	}
+
+	wireLen := 1
+	for _, label := range labels {
+		wireLen += 1 + len(label)
+	}
+	if wireLen > 255 {
+		return nil, fmt.Errorf("name %q exceeds 255 bytes", name)
+	}
+	return labels, nil
+}
+
+// suffixKey returns the wire form of labels, which identifies a name suffix
+// for compression. Case matters, so names are always written as given.
+func suffixKey(labels [][]byte) string {
+	var sb strings.Builder
+	for _, label := range labels {
+		sb.WriteByte(byte(len(label)))
+		sb.Write(label)
+	}
+	return sb.String()
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// appendLabel appends the presentation form of a label read from the wire.
+// Dots and backslashes are escaped with a backslash, and bytes that are not
+// printable ASCII become "\DDD". Letters are lowercased if lower is set.
+func appendLabel(dst []byte, label []byte, lower bool) []byte {
+	for _, c := range label {
+		switch {
+		case c == '.' || c == '\\':
+			dst = append(dst, '\\', c)
+		case c <= ' ' || c >= 0x7F:
+			dst = append(dst, '\\', '0'+c/100, '0'+c/10%10, '0'+c%10)
+		case lower && 'A' <= c && c <= 'Z':
+			dst = append(dst, c+'a'-'A')
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return dst
+}
+
+// WriteCharacterString writes s as a <character-string>, which is limited to
+// 255 bytes of data.
+func (b *BytePacketBuffer) WriteCharacterString(s string) error {
+	if len(s) > 0xFF {
+		return errors.New("character string exceeds 255 characters of length")
+	}
+
+	err := b.Write1Byte(byte(len(s)))
+	if err != nil {
+		return err
+	}
 
-		err = b.Write1Byte(byte(0))
+	for _, b1 := range []byte(s) {
+		err = b.Write1Byte(b1)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,620 @@
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// zoneResponse returns a response to a query for www.example.com with 20
+// records of the zone, and a table with the names of the zone.
+func zoneResponse(t testing.TB) (*DnsPacket, *NameTable) {
+	t.Helper()
+	names := []string{"www.example.com", "example.com"}
+	p := NewDnsPacket()
+	p.Header.Response = true
+	p.AddQuestion(NewDnsQuestion("www.example.com", A))
+	for i := range 20 {
+		var rec *DnsRecord
+		switch i % 4 {
+		case 0:
+			rec = NewADnsRecord("www.example.com", net.IPv4(192, 0, 2, byte(i)), 300)
+		case 1:
+			rec = NewCNameDnsRecord("www.example.com", fmt.Sprintf("host%d.example.com", i), 300)
+		case 2:
+			rec = NewNSDnsRecord("example.com", fmt.Sprintf("ns%d.example.com", i), 300)
+		default:
+			rec = NewMXDnsRecord("example.com", fmt.Sprintf("mail%d.example.com", i), uint16(i), 300)
+		}
+		names = append(names, rec.Host)
+		p.Answers = append(p.Answers, rec)
+	}
+
+	table, err := NewNameTable(names...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, table
+}
+
+func TestNameTableCompression(t *testing.T) {
+	p, table := zoneResponse(t)
+
+	plain := NewBytePacketBufferSize(maxMessageSize)
+	if _, err := p.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	seeded := NewBytePacketBufferSize(maxMessageSize)
+	seeded.Names = table
+	if _, err := p.Write(seeded); err != nil {
+		t.Fatal(err)
+	}
+
+	want, got := plain.Buf[:plain.Pos], seeded.Buf[:seeded.Pos]
+	if !bytes.Equal(got, want) {
+		t.Fatalf("seeded table wrote\n%x\nwant\n%x", got, want)
+	}
+	if len(seeded.names) >= len(plain.names) {
+		t.Errorf("seeded buffer remembered %d suffixes, plain one %d", len(seeded.names), len(plain.names))
+	}
+
+	parsed, err := Unpack(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Equal(p) {
+		t.Errorf("parsed\n%v\nwant\n%v", parsed, p)
+	}
+}
+
+func TestNameTableOtherQuestion(t *testing.T) {
+	// A question that is not in the table must not be pointed to through
+	// the offsets of the table.
+	table, err := NewNameTable("www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewDnsPacket()
+	p.AddQuestion(NewDnsQuestion("www.example.org", A))
+	p.Answers = append(p.Answers, NewADnsRecord("www.example.com", net.IPv4(192, 0, 2, 1), 300))
+
+	buffer := NewBytePacketBuffer()
+	buffer.Names = table
+	if _, err := p.Write(buffer); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := Unpack(buffer.Buf[:buffer.Pos])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Equal(p) {
+		t.Errorf("parsed\n%v\nwant\n%v", parsed, p)
+	}
+}
+
+func benchmarkZoneResponse(b *testing.B, seeded bool) {
+	p, table := zoneResponse(b)
+	buffer := NewBytePacketBuffer()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		buffer.Reset()
+		if seeded {
+			buffer.Names = table
+		}
+		if _, err := p.Write(buffer); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteZoneResponse(b *testing.B) {
+	b.Run("plain", func(b *testing.B) { benchmarkZoneResponse(b, false) })
+	b.Run("table", func(b *testing.B) { benchmarkZoneResponse(b, true) })
+}
+
+// nameBuffer returns a buffer positioned at the start of name written
+// without compression.
+func nameBuffer(t *testing.T, name string) *BytePacketBuffer {
+	t.Helper()
+	buffer := NewBytePacketBuffer()
+	if err := buffer.WriteQName(name); err != nil {
+		t.Fatal(err)
+	}
+	buffer.Buf = buffer.Buf[:buffer.Pos]
+	buffer.Pos = 0
+	return buffer
+}
+
+func TestReadQNamePreserveCase(t *testing.T) {
+	for _, tt := range []struct {
+		preserve bool
+		want     string
+	}{
+		{false, "www.example.com"},
+		{true, "WwW.ExAmple.COM"},
+	} {
+		buffer := nameBuffer(t, "WwW.ExAmple.COM")
+		buffer.PreserveCase = tt.preserve
+		got, err := buffer.ReadQName()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("ReadQName with PreserveCase %v = %q, want %q", tt.preserve, got, tt.want)
+		}
+	}
+}
+
+// writtenName returns the wire form of name as written by WriteQName
+// without compression.
+func writtenName(t *testing.T, name string) []byte {
+	t.Helper()
+	buffer := NewBytePacketBuffer()
+	buffer.Compress = false
+	if err := buffer.WriteQName(name); err != nil {
+		t.Fatalf("WriteQName(%q): %v", name, err)
+	}
+	return buffer.Buf[:buffer.Pos]
+}
+
+func TestWriteQNameRootAndTrailingDot(t *testing.T) {
+	root := []byte{0}
+	for _, name := range []string{"", "."} {
+		if got := writtenName(t, name); !bytes.Equal(got, root) {
+			t.Errorf("WriteQName(%q) wrote %x, want %x", name, got, root)
+		}
+	}
+
+	want := []byte("\x07example\x03com\x00")
+	for _, name := range []string{"example.com", "example.com."} {
+		if got := writtenName(t, name); !bytes.Equal(got, want) {
+			t.Errorf("WriteQName(%q) wrote %x, want %x", name, got, want)
+		}
+	}
+
+	for _, name := range []string{"example.com..", ".example.com", "example..com"} {
+		if err := NewBytePacketBuffer().WriteQName(name); err == nil {
+			t.Errorf("WriteQName(%q) accepted an empty label", name)
+		}
+	}
+}
+
+func TestGetRangeCopy(t *testing.T) {
+	b := NewBytePacketBuffer()
+	copy(b.Buf, "abcdef")
+
+	view, err := b.GetRange(1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp, err := b.GetRangeCopy(1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(b.Buf, "uvwxyz")
+
+	if string(cp) != "bcd" {
+		t.Errorf("copy changed to %q after writing the buffer", cp)
+	}
+	if string(view) != "vwx" {
+		t.Errorf("GetRange returned %q, which should alias the buffer", view)
+	}
+	if _, err := b.GetRangeCopy(510, 3); err == nil {
+		t.Error("range past the end of the buffer was copied")
+	}
+}
+
+func TestNewBytePacketBufferFromReader(t *testing.T) {
+	msg := readFixture(t, "../query_packet.txt")
+	r := bytes.NewReader(append(msg, 0xFF))
+
+	b, err := NewBytePacketBufferFromReader(r, len(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Pos != 0 || !bytes.Equal(b.Buf, msg) {
+		t.Errorf("read buffer at %d with %x, want %x", b.Pos, b.Buf, msg)
+	}
+	if r.Len() != 1 {
+		t.Errorf("%d bytes left in the reader, want 1", r.Len())
+	}
+	if _, err := FromBuffer2DnsPacket(b); err != nil {
+		t.Errorf("read message doesn't parse: %v", err)
+	}
+
+	_, err = NewBytePacketBufferFromReader(bytes.NewReader(msg[:5]), len(msg))
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("short read returned %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	_, err = NewBytePacketBufferFromReader(bytes.NewReader(nil), len(msg))
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("empty read returned %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestQNameEscapes(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		wire string
+		read string
+	}{
+		{`a\.b.example.com`, "\x03a.b\x07example\x03com\x00", `a\.b.example.com`},
+		{`a\046b.example.com`, "\x03a.b\x07example\x03com\x00", `a\.b.example.com`},
+		{`tab\009x.example.com`, "\x05tab\tx\x07example\x03com\x00", `tab\009x.example.com`},
+		{`nul\000.example.com`, "\x04nul\x00\x07example\x03com\x00", `nul\000.example.com`},
+		{`back\\slash.com`, "\x0aback\\slash\x03com\x00", `back\\slash.com`},
+	} {
+		if got := writtenName(t, tt.name); string(got) != tt.wire {
+			t.Errorf("WriteQName(%q) wrote %q, want %q", tt.name, got, tt.wire)
+		}
+		got, err := nameBuffer(t, tt.name).ReadQName()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.read {
+			t.Errorf("ReadQName of %q = %q, want %q", tt.name, got, tt.read)
+		}
+	}
+
+	for _, name := range []string{`bad\256.com`, `trailing\`} {
+		if err := NewBytePacketBuffer().WriteQName(name); err == nil {
+			t.Errorf("WriteQName(%q) accepted an invalid escape", name)
+		}
+	}
+}
+
+func TestWriteWithoutCompression(t *testing.T) {
+	p := NewDnsPacket()
+	p.Header.Response = true
+	p.AddQuestion(NewDnsQuestion("www.example.com", A))
+	p.Answers = append(p.Answers,
+		NewCNameDnsRecord("www.example.com", "web.example.com", 300),
+		NewADnsRecord("web.example.com", net.IPv4(10, 0, 0, 1), 300),
+		NewADnsRecord("web.example.com", net.IPv4(10, 0, 0, 2), 300),
+	)
+	p.Authorities = append(p.Authorities, NewNSDnsRecord("example.com", "ns1.example.com", 300))
+
+	written := func(compress bool) []byte {
+		buffer := NewBytePacketBuffer()
+		buffer.Compress = compress
+		n, err := p.Write(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buffer.Buf[:n]
+	}
+	compressed, expanded := written(true), written(false)
+
+	if !bytes.Contains(compressed, []byte{0xC0}) {
+		t.Errorf("compressed message has no pointers: %x", compressed)
+	}
+	if bytes.Contains(expanded, []byte{0xC0}) {
+		t.Errorf("uncompressed message has pointers: %x", expanded)
+	}
+	if len(expanded) <= len(compressed) {
+		t.Errorf("uncompressed message has %d bytes, compressed %d", len(expanded), len(compressed))
+	}
+
+	for _, msg := range [][]byte{compressed, expanded} {
+		parsed, err := Unpack(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !parsed.Equal(p) {
+			t.Errorf("message %x doesn't parse back to the packet", msg)
+		}
+	}
+}
+
+func TestWriteQNameEmptyLabels(t *testing.T) {
+	for _, name := range []string{"a..b", ".example.com", "..", "example.com..", "www..example.com."} {
+		buffer := NewBytePacketBuffer()
+		err := buffer.WriteQName(name)
+		if err == nil || !strings.Contains(err.Error(), "empty label") {
+			t.Errorf("WriteQName(%q) returned %v, want an empty label error", name, err)
+		}
+		if buffer.Pos != 0 {
+			t.Errorf("WriteQName(%q) wrote %d bytes before failing", name, buffer.Pos)
+		}
+	}
+
+	for name, want := range map[string]string{
+		"example.com": "\x07example\x03com\x00",
+		`a\..b`:       "\x02a.\x01b\x00",
+		`\..b`:        "\x01.\x01b\x00",
+	} {
+		if got := writtenName(t, name); string(got) != want {
+			t.Errorf("WriteQName(%q) wrote %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestReadQNameHeaderPointer(t *testing.T) {
+	// The question count bytes of the header happen to read as the
+	// label "a".
+	header := []byte{0, 0, 0, 0, 1, 'a', 0, 0, 0, 0, 0, 0}
+	msg := append(header, "\x07example\x03com\x00\x03www\xc0\x0c\xc0\x04\xc0\x21"...)
+	read := func(pos uint16, allow bool) (string, error) {
+		buffer := NewBytePacketBufferSize(len(msg))
+		buffer.SetBuffer(msg)
+		buffer.Pos = pos
+		buffer.AllowHeaderPointers = allow
+		return buffer.ReadQName()
+	}
+
+	if name, err := read(25, false); err != nil || name != "www.example.com" {
+		t.Errorf("pointer to a later name read as %q, %v", name, err)
+	}
+	if name, err := read(31, false); !errors.Is(err, ErrInvalidPointer) {
+		t.Errorf("pointer into the header read as %q, %v, want %v", name, err, ErrInvalidPointer)
+	}
+	if name, err := read(31, true); err != nil || name != "a" {
+		t.Errorf("allowed pointer into the header read as %q, %v", name, err)
+	}
+	if name, err := read(33, true); !errors.Is(err, ErrInvalidPointer) {
+		t.Errorf("pointer to itself read as %q, %v, want %v", name, err, ErrInvalidPointer)
+	}
+}
+
+func TestReadQNameN(t *testing.T) {
+	msg := []byte("\x07example\x03com\x00\x03www\xc0\x00\xc0\x0d")
+	for _, tt := range []struct {
+		pos  uint16
+		name string
+		n    uint16
+	}{
+		{0, "example.com", 13},
+		{13, "www.example.com", 6},
+		{19, "www.example.com", 2},
+	} {
+		buffer := NewBytePacketBufferSize(len(msg))
+		buffer.SetBuffer(msg)
+		buffer.Pos = tt.pos
+		buffer.AllowHeaderPointers = true
+
+		name, n, err := buffer.ReadQNameN()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != tt.name || n != tt.n || buffer.Pos != tt.pos+tt.n {
+			t.Errorf("ReadQNameN at %d = %q, %d and moved to %d, want %q, %d", tt.pos, name, n, buffer.Pos, tt.name, tt.n)
+		}
+	}
+}
+
+// writtenPacket writes p to buffer and returns the bytes written.
+func writtenPacket(t testing.TB, p *DnsPacket, buffer *BytePacketBuffer) []byte {
+	t.Helper()
+	n, err := p.Write(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Buf[:n]
+}
+
+func TestBufferPool(t *testing.T) {
+	p := equalTestPacket(net.IPv4(192, 0, 2, 1))
+	want := append([]byte(nil), writtenPacket(t, p, NewBytePacketBuffer())...)
+
+	for range 10 {
+		b := GetBuffer()
+		if b.Pos != 0 || !b.Compress || b.PreserveCase || b.StrictMode || b.names != nil ||
+			len(b.Buf) != 512 || !bytes.Equal(b.Buf, make([]byte, 512)) {
+			t.Fatalf("GetBuffer returned a buffer in use: %+v", b)
+		}
+		if got := writtenPacket(t, p, b); !bytes.Equal(got, want) {
+			t.Fatalf("reused buffer wrote %x, want %x", got, want)
+		}
+		b.PreserveCase, b.StrictMode = true, true
+		PutBuffer(b)
+	}
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := equalTestPacket(hostAddr(i))
+			want := writtenPacket(t, p, NewBytePacketBuffer())
+			for range 50 {
+				b := GetBuffer()
+				if got := writtenPacket(t, p, b); !bytes.Equal(got, want) {
+					t.Errorf("pooled buffer wrote %x, want %x", got, want)
+				}
+				PutBuffer(b)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func BenchmarkWriteResponse(b *testing.B) {
+	p := equalTestPacket(net.IPv4(192, 0, 2, 1))
+	b.Run("new", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				writtenPacket(b, p, NewBytePacketBuffer())
+			}
+		})
+	})
+	b.Run("pool", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				buffer := GetBuffer()
+				writtenPacket(b, p, buffer)
+				PutBuffer(buffer)
+			}
+		})
+	})
+}
+
+func TestReadQNameInvalidLabelType(t *testing.T) {
+	for _, msg := range [][]byte{
+		[]byte("\x41abc\x00"),
+		[]byte("\x80abc\x00"),
+		[]byte("\x03www\xbf\x00"),
+	} {
+		buffer := NewBytePacketBufferSize(len(msg))
+		buffer.SetBuffer(msg)
+		if name, err := buffer.ReadQName(); !errors.Is(err, ErrInvalidLabel) {
+			t.Errorf("ReadQName of %x = %q, %v, want %v", msg, name, err, ErrInvalidLabel)
+		}
+	}
+
+	// The largest literal label is still fine.
+	msg := append([]byte{63}, bytes.Repeat([]byte("a"), 63)...)
+	msg = append(msg, 0)
+	buffer := NewBytePacketBufferSize(len(msg))
+	buffer.SetBuffer(msg)
+	if name, err := buffer.ReadQName(); err != nil || len(name) != 63 {
+		t.Errorf("ReadQName of a 63 byte label = %q, %v", name, err)
+	}
+}
+
+func TestQuestionForwardPointer(t *testing.T) {
+	// The question name points past itself at the label "a" after the
+	// question's type and class.
+	header := []byte{0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	msg := append(header, "\xc0\x12\x00\x01\x00\x01\x01a\x00"...)
+	if p, err := Unpack(msg); !errors.Is(err, ErrInvalidPointer) {
+		t.Errorf("Unpack returned\n%v\nerror %v, want %v", p, err, ErrInvalidPointer)
+	}
+}
+
+func TestReadQNameStrictMode(t *testing.T) {
+	for _, tt := range []struct {
+		wire   string
+		read   string
+		strict bool
+	}{
+		{"\x03www\x07example\x03com\x00", "www.example.com", true},
+		{"\x04_tcp\x07example\x03com\x00", "_tcp.example.com", true},
+		{"\x01*\x07example\x03com\x00", "*.example.com", true},
+		{"\x03a b\x07example\x03com\x00", `a\032b.example.com`, false},
+		{"\x04a_ok\x07example\x03com\x00", "a_ok.example.com", false},
+		{"\x02**\x07example\x03com\x00", "**.example.com", false},
+	} {
+		for _, strict := range []bool{false, true} {
+			buffer := NewBytePacketBufferSize(len(tt.wire))
+			buffer.SetBuffer([]byte(tt.wire))
+			buffer.StrictMode = strict
+			name, err := buffer.ReadQName()
+			if strict && !tt.strict {
+				if !errors.Is(err, ErrNonHostLabel) {
+					t.Errorf("strict ReadQName of %q = %q, %v, want %v", tt.wire, name, err, ErrNonHostLabel)
+				}
+				continue
+			}
+			if err != nil || name != tt.read {
+				t.Errorf("ReadQName of %q (strict %v) = %q, %v, want %q", tt.wire, strict, name, err, tt.read)
+			}
+		}
+	}
+}
+
+// thirtyRecordResponse returns the wire format of a response with 30 A
+// records for the same name, and the records themselves.
+func thirtyRecordResponse(t testing.TB) ([]byte, []*DnsRecord) {
+	t.Helper()
+	p := ErrorResponse(NewQuery("www.example.com", A), NOERROR)
+	for i := range 30 {
+		p.Answers = append(p.Answers, NewADnsRecord("www.example.com", net.IPv4(192, 0, 2, byte(i)), 300))
+	}
+	p.Header.Answers = uint16(len(p.Answers))
+	msg, err := p.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg, p.Answers
+}
+
+func TestReadQNameScratch(t *testing.T) {
+	msg, want := thirtyRecordResponse(t)
+	p, err := Unpack(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Answers) != len(want) {
+		t.Fatalf("read %d answers, want %d", len(p.Answers), len(want))
+	}
+	for i, rec := range p.Answers {
+		if !rec.Equal(want[i]) {
+			t.Errorf("answer %d read as %v, want %v", i, rec, want[i])
+		}
+	}
+
+	// Reading the same name again reuses both the scratch and the string.
+	buffer := NewBytePacketBufferSize(len(msg))
+	buffer.SetBuffer(msg)
+	allocs := testing.AllocsPerRun(100, func() {
+		buffer.Pos = headerLen
+		if name, err := buffer.ReadQName(); err != nil || name != "www.example.com" {
+			t.Fatalf("ReadQName returned %q, %v", name, err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("reading a repeated name allocated %v times, want 0", allocs)
+	}
+}
+
+func BenchmarkUnpackResponse(b *testing.B) {
+	msg, _ := thirtyRecordResponse(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		if _, err := Unpack(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestWriteLabels(t *testing.T) {
+	for _, tt := range []struct {
+		labels []string
+		name   string
+	}{
+		{[]string{"www", "example", "com"}, "www.example.com"},
+		{[]string{"a.b", "example", "com"}, `a\.b.example.com`},
+		{[]string{`back\slash`, "com"}, `back\\slash.com`},
+		{nil, "."},
+	} {
+		buffer := NewBytePacketBuffer()
+		buffer.Compress = false
+		if err := buffer.WriteLabels(tt.labels); err != nil {
+			t.Fatalf("WriteLabels(%q): %v", tt.labels, err)
+		}
+		if got, want := buffer.Buf[:buffer.Pos], writtenName(t, tt.name); !bytes.Equal(got, want) {
+			t.Errorf("WriteLabels(%q) wrote %q, want %q", tt.labels, got, want)
+		}
+	}
+
+	// Compression works across both ways of writing a name.
+	buffer := NewBytePacketBuffer()
+	if err := buffer.WriteQName("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := buffer.WriteLabels([]string{"www", "example", "com"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buffer.Buf[:buffer.Pos]), "\x07example\x03com\x00\x03www\xc0\x00"; got != want {
+		t.Errorf("compressed names wrote %q, want %q", got, want)
+	}
+
+	for _, labels := range [][]string{
+		{"www", "", "com"},
+		{strings.Repeat("x", 64), "com"},
+		{strings.Repeat("x", 63), strings.Repeat("x", 63), strings.Repeat("x", 63), strings.Repeat("x", 63)},
+	} {
+		if err := NewBytePacketBuffer().WriteLabels(labels); err == nil {
+			t.Errorf("WriteLabels(%q) succeeded", labels)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package dns
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// staleAnswerTTL is the TTL given to records served from an expired entry,
+// as recommended by RFC 8767.
+const staleAnswerTTL = 30
+
+// cacheKey identifies the responses to a query. Besides the question, it
+// holds the CD bit and the DO bit of the OPT record, as the response to a
+// query with CD set may hold data that failed to validate, and the one to a
+// query with DO set carries DNSSEC records.
+type cacheKey struct {
+	name  string
+	qtype RecordType
+	cd    bool
+	do    bool
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	packet  *DnsPacket
+	stored  time.Time
+	expires time.Time
+}
+
+// Cache stores responses keyed by the question and the CD and DO bits of
+// their query until the lowest TTL of the records expires. The zero value
+// is an empty cache without a bound, ready to use. It is safe for
+// concurrent use.
+type Cache struct {
+	// StaleTTL is how long an expired entry is kept around so that it can
+	// still be served by GetAllowStale while upstream is unreachable
+	// (RFC 8767). Zero disables serving stale answers.
+	StaleTTL time.Duration
+
+	// MaxEntries bounds the number of cached responses. Once it is
+	// reached, Put evicts the least recently used entry. Zero means no
+	// bound.
+	MaxEntries int
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	// lru orders the entries from the most to the least recently used.
+	lru *list.List
+}
+
+func NewCache(staleTTL time.Duration) *Cache {
+	return &Cache{StaleTTL: staleTTL}
+}
+
+// Len returns the number of cached responses, including expired ones not
+// evicted yet.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lru == nil {
+		return 0
+	}
+	return c.lru.Len()
+}
+
+// Put stores a copy of packet, the response to req, under the first
+// question of req. Queries without a valid question and responses without
+// any records to take a TTL from are not cached.
+func (c *Cache) Put(req, packet *DnsPacket) {
+	key, ok := newCacheKey(req)
+	if !ok {
+		return
+	}
+
+	ttl, ok := minTTL(packet)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	entry := &cacheEntry{
+		key:     key,
+		packet:  packet.Clone(),
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = map[cacheKey]*list.Element{}
+		c.lru = list.New()
+	}
+	if elem, ok := c.entries[entry.key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.MaxEntries > 0 && c.lru.Len() > c.MaxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Get returns a copy of the cached response to req, if there is one that
+// has not expired yet. The TTLs of its records are reduced by the time the
+// response has spent in the cache.
+func (c *Cache) Get(req *DnsPacket) (*DnsPacket, bool) {
+	packet, stale, ok := c.get(req)
+	if !ok || stale {
+		return nil, false
+	}
+	return packet, true
+}
+
+// GetAllowStale is like Get, but also returns expired entries that are still
+// within the StaleTTL window. It should only be used once upstream has
+// failed to answer. stale reports whether the entry had expired, in which
+// case all record TTLs are set to 30 seconds.
+func (c *Cache) GetAllowStale(req *DnsPacket) (packet *DnsPacket, stale bool, ok bool) {
+	return c.get(req)
+}
+
+func (c *Cache) get(req *DnsPacket) (*DnsPacket, bool, bool) {
+	key, ok := newCacheKey(req)
+	if !ok {
+		return nil, false, false
+	}
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false, false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if now.After(entry.expires.Add(c.StaleTTL)) {
+		c.remove(elem)
+		return nil, false, false
+	}
+	c.lru.MoveToFront(elem)
+
+	packet := entry.packet.Clone()
+	stale := now.After(entry.expires)
+	if stale {
+		setTTL(packet, staleAnswerTTL)
+	} else {
+		age := uint32(now.Sub(entry.stored) / time.Second)
+		forEachTTL(packet, func(ttl *uint32) {
+			*ttl -= min(*ttl, age)
+		})
+	}
+	return packet, stale, true
+}
+
+func (c *Cache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
+
+// newCacheKey returns the key for the responses to req. It reports false if
+// req has no question or its name is not valid, as such a name could
+// collide with another one.
+func newCacheKey(req *DnsPacket) (cacheKey, bool) {
+	if len(req.Questions) == 0 {
+		return cacheKey{}, false
+	}
+	q := req.Questions[0]
+	name, ok := canonicalName(q.Name)
+	if !ok {
+		return cacheKey{}, false
+	}
+
+	key := cacheKey{name: name, qtype: q.Type, cd: req.Header.CheckingDisabled}
+	if opt := req.OPT(); opt != nil {
+		key.do = opt.TTL&doBit != 0
+	}
+	return key, true
+}
+
+func minTTL(packet *DnsPacket) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, records := range [][]*DnsRecord{packet.Answers, packet.Authorities} {
+		for _, rec := range records {
+			if !found || rec.TTL < ttl {
+				ttl = rec.TTL
+				found = true
+			}
+		}
+	}
+	return ttl, found
+}
+
+func setTTL(packet *DnsPacket, ttl uint32) {
+	forEachTTL(packet, func(t *uint32) {
+		*t = ttl
+	})
+}
+
+// forEachTTL calls f with the TTL of every record of packet. The TTL field
+// of an OPT record holds flags instead, so it is left out.
+func forEachTTL(packet *DnsPacket, f func(ttl *uint32)) {
+	for _, records := range [][]*DnsRecord{packet.Answers, packet.Authorities, packet.Resources} {
+		for _, rec := range records {
+			if rec.Type != OPT {
+				f(&rec.TTL)
+			}
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// cachedResponse returns a response for name with a single A record.
+func cachedResponse(name string) *DnsPacket {
+	p := NewDnsPacket()
+	p.Header.Response = true
+	p.AddQuestion(NewDnsQuestion(name, A))
+	p.Answers = append(p.Answers, NewADnsRecord(name, net.IPv4(192, 0, 2, 1), 300))
+	return p
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := &Cache{MaxEntries: 3}
+	for i := range 3 {
+		name := fmt.Sprintf("host%d.example.com", i)
+		c.Put(NewQuery(name, A), cachedResponse(name))
+	}
+
+	// host0 is the oldest entry, but being read makes host1 the least
+	// recently used one.
+	if _, ok := c.Get(NewQuery("host0.example.com", A)); !ok {
+		t.Fatal("host0 is not cached")
+	}
+	c.Put(NewQuery("host3.example.com", A), cachedResponse("host3.example.com"))
+
+	if n := c.Len(); n != 3 {
+		t.Errorf("cache holds %d entries, want 3", n)
+	}
+	if _, ok := c.Get(NewQuery("host1.example.com", A)); ok {
+		t.Error("host1 was not evicted")
+	}
+	for _, name := range []string{"host0.example.com", "host2.example.com", "host3.example.com"} {
+		if _, ok := c.Get(NewQuery(name, A)); !ok {
+			t.Errorf("%s was evicted", name)
+		}
+	}
+}
+
+func TestCacheZeroValue(t *testing.T) {
+	var c Cache
+	if n := c.Len(); n != 0 {
+		t.Errorf("empty cache holds %d entries", n)
+	}
+	if _, ok := c.Get(NewQuery("www.example.com", A)); ok {
+		t.Error("empty cache returned a response")
+	}
+	c.Put(NewQuery("www.example.com", A), cachedResponse("www.example.com"))
+	if _, ok := c.Get(NewQuery("WWW.Example.com.", A)); !ok {
+		t.Error("response was not cached")
+	}
+}
+
+// age moves the entry for name back in time by d, as if it had been stored
+// d earlier.
+func age(t *testing.T, c *Cache, name string, d time.Duration) {
+	t.Helper()
+	key, _ := newCacheKey(NewQuery(name, A))
+	elem, ok := c.entries[key]
+	if !ok {
+		t.Fatalf("%s is not cached", name)
+	}
+	entry := elem.Value.(*cacheEntry)
+	entry.stored = entry.stored.Add(-d)
+	entry.expires = entry.expires.Add(-d)
+}
+
+func TestCacheServeStale(t *testing.T) {
+	c := NewCache(time.Hour)
+	c.Put(NewQuery("www.example.com", A), cachedResponse("www.example.com"))
+
+	// A fresh entry is served with the TTLs reduced by its age.
+	age(t, c, "www.example.com", 100*time.Second)
+	resp, stale, ok := c.GetAllowStale(NewQuery("www.example.com", A))
+	if !ok || stale {
+		t.Fatalf("fresh entry: ok %v, stale %v", ok, stale)
+	}
+	if ttl := resp.Answers[0].TTL; ttl != 200 {
+		t.Errorf("fresh entry has TTL %d, want 200", ttl)
+	}
+
+	// An expired entry is only served as stale, with a TTL of 30 seconds.
+	age(t, c, "www.example.com", 30*time.Minute)
+	if _, ok := c.Get(NewQuery("www.example.com", A)); ok {
+		t.Error("Get returned an expired entry")
+	}
+	resp, stale, ok = c.GetAllowStale(NewQuery("www.example.com", A))
+	if !ok || !stale {
+		t.Fatalf("stale entry: ok %v, stale %v", ok, stale)
+	}
+	if ttl := resp.Answers[0].TTL; ttl != staleAnswerTTL {
+		t.Errorf("stale entry has TTL %d, want %d", ttl, staleAnswerTTL)
+	}
+
+	// Past the stale window the entry is evicted.
+	age(t, c, "www.example.com", time.Hour)
+	if _, _, ok := c.GetAllowStale(NewQuery("www.example.com", A)); ok {
+		t.Error("entry past the stale window was served")
+	}
+	if n := c.Len(); n != 0 {
+		t.Errorf("cache holds %d entries, want 0", n)
+	}
+}
+
+func TestCacheKeysOnCheckingDisabled(t *testing.T) {
+	var c Cache
+	cd := NewQuery("www.example.com", A)
+	cd.Header.CheckingDisabled = true
+	c.Put(cd, cachedResponse("www.example.com"))
+
+	// The response to a query with CD set may not have been validated,
+	// so it must not answer a query that wants validated data.
+	if _, ok := c.Get(NewQuery("www.example.com", A)); ok {
+		t.Error("response to a query with CD set answered one without")
+	}
+	if _, ok := c.Get(cd); !ok {
+		t.Error("response to a query with CD set was not cached")
+	}
+}
+
+func TestCacheKeysOnDNSSECOK(t *testing.T) {
+	var c Cache
+	c.Put(NewQuery("www.example.com", A), cachedResponse("www.example.com"))
+
+	// The response to a query without DO lacks the DNSSEC records a
+	// query with DO asks for.
+	if _, ok := c.Get(NewQuery("www.example.com", A, WithDNSSEC())); ok {
+		t.Error("response to a query without DO answered one with DO")
+	}
+	if _, ok := c.Get(NewQuery("www.example.com", A, WithEDNS(4096))); !ok {
+		t.Error("response to a query without DO did not answer one with EDNS but without DO")
+	}
+}
@@ -0,0 +1,252 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Client sends queries over shared UDP sockets, one per server. Replies are
+// routed back to the waiting Query call by their ID, and dropped unless they
+// match its query as checked by MatchesQuery. A Client is safe to use from
+// many goroutines at once.
+type Client struct {
+	// Timeout is how long Query waits for a reply. If it is not positive,
+	// as in a Client literal, 5 seconds are used.
+	Timeout time.Duration
+	// Upstreams, if set, picks the server for every query instead of the
+	// one passed to NewClient.
+	Upstreams *UpstreamSet
+
+	server string
+
+	mu     sync.Mutex
+	conns  map[string]*clientConn
+	closed bool
+}
+
+// NewClient opens a UDP socket to server. Close has to be called once the
+// client is no longer needed.
+func NewClient(server string) (*Client, error) {
+	c := newClient()
+	c.server = server
+	if _, err := c.conn(server); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewUpstreamClient creates a client spreading its queries over upstreams.
+// Sockets are opened as servers are picked. Close has to be called once the
+// client is no longer needed.
+func NewUpstreamClient(upstreams *UpstreamSet) *Client {
+	c := newClient()
+	c.Upstreams = upstreams
+	return c
+}
+
+func newClient() *Client {
+	return &Client{
+		Timeout: defaultTimeout,
+		conns:   map[string]*clientConn{},
+	}
+}
+
+// Close closes all sockets. Queries still waiting for a reply fail.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	var errs []error
+	for _, cc := range c.conns {
+		errs = append(errs, cc.conn.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Query sends a recursive query for qname and waits for the reply. When
+// the server is picked from Upstreams, it is marked unhealthy if it times
+// out or answers with SERVFAIL.
+func (c *Client) Query(qname string, qtype RecordType) (*DnsPacket, error) {
+	server := c.server
+	if c.Upstreams != nil {
+		var err error
+		server, err = c.Upstreams.Next()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cc, err := c.conn(server)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	resp, err := cc.query(NewQuery(qname, qtype), timeout)
+	if c.Upstreams != nil {
+		if errors.Is(err, errTimeout) || (err == nil && resp.Header.Rescode == SERVFAIL) {
+			c.Upstreams.MarkUnhealthy(server)
+		}
+	}
+	return resp, err
+}
+
+// conn returns the socket for server, opening it if needed. A socket that
+// failed is replaced by a new one.
+func (c *Client) conn(server string) (*clientConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, net.ErrClosed
+	}
+	if cc, ok := c.conns[server]; ok && cc.usable() {
+		return cc, nil
+	}
+
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		return nil, err
+	}
+
+	cc := &clientConn{
+		conn:    conn,
+		pending: map[uint16]*pendingQuery{},
+	}
+	go cc.readLoop()
+
+	if c.conns == nil {
+		c.conns = map[string]*clientConn{}
+	}
+	c.conns[server] = cc
+	return cc, nil
+}
+
+var errTimeout = errors.New("timeout waiting for reply")
+
+// clientConn is a UDP socket to a single server, shared by all queries to
+// that server.
+type clientConn struct {
+	conn net.Conn
+
+	mu      sync.Mutex
+	pending map[uint16]*pendingQuery
+	// err is the error that stopped the read loop. Once it is set, every
+	// query fails with it.
+	err error
+}
+
+// pendingQuery is a query waiting for its reply on ch.
+type pendingQuery struct {
+	req *DnsPacket
+	ch  chan *DnsPacket
+}
+
+func (cc *clientConn) query(req *DnsPacket, timeout time.Duration) (*DnsPacket, error) {
+	ch := make(chan *DnsPacket, 1)
+
+	cc.mu.Lock()
+	if cc.err != nil {
+		err := cc.err
+		cc.mu.Unlock()
+		return nil, err
+	}
+	// IDs have to be unique among the outstanding queries.
+	for cc.pending[req.Header.ID] != nil {
+		req.Header.ID = newQueryID()
+	}
+	cc.pending[req.Header.ID] = &pendingQuery{req: req, ch: ch}
+	cc.mu.Unlock()
+
+	defer func() {
+		cc.mu.Lock()
+		delete(cc.pending, req.Header.ID)
+		cc.mu.Unlock()
+	}()
+
+	if err := writeUDP(cc.conn, req); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			cc.mu.Lock()
+			defer cc.mu.Unlock()
+			return nil, cc.err
+		}
+		return resp, nil
+	case <-timer.C:
+		return nil, errTimeout
+	}
+}
+
+// usable reports whether queries can still be sent on the socket.
+func (cc *clientConn) usable() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.err == nil
+}
+
+// readLoop hands every reply to the query waiting for its ID until the
+// socket is closed or fails. Replies nobody is waiting for, or that don't
+// match the query, are dropped. Once the loop stops, the queries still
+// waiting fail with the error that stopped it.
+func (cc *clientConn) readLoop() {
+	var readErr error
+	for {
+		buffer := NewBytePacketBufferSize(defaultEDNSPayload)
+		n, err := cc.conn.Read(buffer.Buf)
+		if err != nil {
+			if isTemporary(err) {
+				continue
+			}
+			readErr = err
+			break
+		}
+		buffer.Buf = buffer.Buf[:n]
+
+		resp, err := FromBuffer2DnsPacket(buffer)
+		if err != nil {
+			continue
+		}
+
+		cc.mu.Lock()
+		if p, ok := cc.pending[resp.Header.ID]; ok && MatchesQuery(p.req, resp) == nil {
+			select {
+			case p.ch <- resp:
+			default:
+			}
+		}
+		cc.mu.Unlock()
+	}
+
+	// A socket that failed is of no further use.
+	cc.conn.Close()
+
+	cc.mu.Lock()
+	cc.err = readErr
+	for id, p := range cc.pending {
+		close(p.ch)
+		delete(cc.pending, id)
+	}
+	cc.mu.Unlock()
+}
+
+// isTemporary reports whether a read error leaves the socket usable. That
+// is the case for a timeout and for a refused datagram, which reports the
+// ICMP error of an earlier query rather than a broken socket.
+func isTemporary(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, syscall.ECONNREFUSED) || (errors.As(err, &netErr) && netErr.Timeout())
+}
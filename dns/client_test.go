@@ -0,0 +1,169 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// hostAddr returns the address the test servers answer for hostN.
+func hostAddr(n int) net.IP {
+	return net.IPv4(10, 0, byte(n>>8), byte(n))
+}
+
+// hostServer answers queries for hostN.example.com with hostAddr(n), after
+// a random delay so that replies arrive out of order.
+func hostServer(t *testing.T) string {
+	return serveUDP(t, func(req *DnsPacket) *DnsPacket {
+		var n int
+		if _, err := fmt.Sscanf(req.Questions[0].Name, "host%d.example.com", &n); err != nil {
+			return ErrorResponse(req, NXDOMAIN)
+		}
+		time.Sleep(rand.N(20 * time.Millisecond))
+		return answerA(req, hostAddr(n))
+	})
+}
+
+func TestClientConcurrentQueries(t *testing.T) {
+	c, err := NewClient(hostServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := fmt.Sprintf("host%d.example.com", i)
+			resp, err := c.Query(name, A)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if len(resp.Answers) != 1 || resp.Questions[0].Name != name || !resp.Answers[0].Addr.Equal(hostAddr(i)) {
+				t.Errorf("query for %s got\n%v", name, resp)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestClientZeroTimeout(t *testing.T) {
+	slow := serveUDP(t, func(req *DnsPacket) *DnsPacket {
+		time.Sleep(100 * time.Millisecond)
+		return answerA(req, net.IPv4(192, 0, 2, 1))
+	})
+
+	// A literal leaves Timeout at 0, which waits the default time rather
+	// than not at all.
+	c := &Client{Upstreams: NewUpstreamSet(RoundRobin, Upstream{Addr: slow})}
+	defer c.Close()
+	resp, err := c.Query("www.example.com", A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answers) != 1 {
+		t.Errorf("query got\n%v", resp)
+	}
+}
+
+func TestClientClosed(t *testing.T) {
+	c, err := NewClient(hostServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if _, err := c.Query("host1.example.com", A); err == nil {
+		t.Error("Query on a closed client succeeded")
+	}
+}
+
+func TestClientDropsMismatchedReplies(t *testing.T) {
+	server := listenUDP(t)
+	go func() {
+		buf := make([]byte, maxMessageSize)
+		n, addr, err := server.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req, err := Unpack(buf[:n])
+		if err != nil {
+			return
+		}
+
+		// A reply with the right ID but for another question comes first.
+		spoofed := answerA(req, net.IPv4(203, 0, 113, 1))
+		spoofed.Questions[0].Name = "example.org"
+		msg, _ := spoofed.Pack()
+		server.WriteTo(msg, addr)
+
+		msg, _ = answerA(req, net.IPv4(192, 0, 2, 1)).Pack()
+		server.WriteTo(msg, addr)
+	}()
+
+	c, err := NewClient(server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	resp, err := c.Query("example.com", A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answers) != 1 || !resp.Answers[0].Addr.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("Query returned\n%v", resp)
+	}
+}
+
+// failingConn is a socket whose reads all fail with err.
+type failingConn struct {
+	net.Conn
+	err   error
+	reads atomic.Int32
+}
+
+func (c *failingConn) Read([]byte) (int, error) {
+	c.reads.Add(1)
+	return 0, c.err
+}
+
+func (c *failingConn) Close() error {
+	return nil
+}
+
+func TestClientConnReadError(t *testing.T) {
+	readErr := errors.New("network is down")
+	conn := &failingConn{err: readErr}
+	cc := &clientConn{conn: conn, pending: map[uint16]*pendingQuery{}}
+	ch := make(chan *DnsPacket, 1)
+	cc.pending[1] = &pendingQuery{req: NewQuery("example.com", A), ch: ch}
+
+	done := make(chan struct{})
+	go func() {
+		cc.readLoop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("read loop still running after %d failed reads", conn.reads.Load())
+	}
+
+	if n := conn.reads.Load(); n != 1 {
+		t.Errorf("read loop read %d times after a read error, want once", n)
+	}
+	if _, ok := <-ch; ok {
+		t.Error("pending query got a reply")
+	}
+	if _, err := cc.query(NewQuery("example.com", A), time.Second); !errors.Is(err, readErr) {
+		t.Errorf("query on a failed socket returned %v, want %v", err, readErr)
+	}
+}
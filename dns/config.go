@@ -0,0 +1,82 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ResolverConfig collects the settings of a lookup in one place.
+type ResolverConfig struct {
+	// Timeout bounds the whole lookup, including all retries. Zero or
+	// less uses the default of 5 seconds.
+	Timeout time.Duration
+
+	// Retries is the number of times an unanswered UDP query is sent
+	// again, see LookupRetry.
+	Retries int
+
+	// EDNSPayload is the UDP payload size advertised in an OPT record.
+	// Zero sends no OPT record.
+	EDNSPayload uint16
+
+	// PreferTCP sends queries over TCP instead of UDP.
+	PreferTCP bool
+
+	// Network restricts the queries to "udp4" or "udp6", so they travel
+	// over IPv4 or IPv6 only, whatever the type queried. Together with
+	// PreferTCP, TCP is restricted the same way. Empty or "udp" uses
+	// whatever the server address is.
+	Network string
+}
+
+// DefaultResolverConfig returns the configuration used when nothing else is
+// asked for: a 5 second timeout, 2 retries and EDNS with a payload of 1232
+// bytes over UDP.
+func DefaultResolverConfig() ResolverConfig {
+	return ResolverConfig{
+		Timeout:     defaultTimeout,
+		Retries:     2,
+		EDNSPayload: defaultEDNSPayload,
+	}
+}
+
+// Lookup sends a recursive query for qname to server as configured by c.
+func (c ResolverConfig) Lookup(ctx context.Context, server, qname string, qtype RecordType) (*DnsPacket, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var opts []QueryOption
+	if c.EDNSPayload > 0 {
+		opts = append(opts, WithEDNS(c.EDNSPayload))
+	}
+
+	network, err := c.network()
+	if err != nil {
+		return nil, err
+	}
+
+	req := NewQuery(qname, qtype, opts...)
+	if c.PreferTCP {
+		return exchangeTCP(ctx, "tcp"+network, server, req)
+	}
+	return exchangeRetry(ctx, "udp"+network, server, req, 1+max(c.Retries, 0))
+}
+
+// network returns the IP version suffix of Network, like "6" for "udp6".
+func (c ResolverConfig) network() (string, error) {
+	switch c.Network {
+	case "", "udp":
+		return "", nil
+	case "udp4":
+		return "4", nil
+	case "udp6":
+		return "6", nil
+	default:
+		return "", fmt.Errorf("unsupported network %q", c.Network)
+	}
+}
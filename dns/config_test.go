@@ -0,0 +1,161 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDefaultResolverConfig(t *testing.T) {
+	c := DefaultResolverConfig()
+	want := ResolverConfig{Timeout: 5 * time.Second, Retries: 2, EDNSPayload: 1232}
+	if c != want {
+		t.Errorf("DefaultResolverConfig() = %+v, want %+v", c, want)
+	}
+}
+
+// countingServer answers A queries after dropping the first drop of them,
+// and records the queries it got.
+type countingServer struct {
+	drop int
+
+	mu   sync.Mutex
+	reqs []*DnsPacket
+}
+
+func (s *countingServer) handle(req *DnsPacket) *DnsPacket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reqs = append(s.reqs, req)
+	if len(s.reqs) <= s.drop {
+		return nil
+	}
+	return answerA(req, net.IPv4(192, 0, 2, 1))
+}
+
+func (s *countingServer) queries() []*DnsPacket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reqs
+}
+
+func TestResolverConfigLookup(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		name    string
+		config  ResolverConfig
+		drop    int
+		fail    bool
+		queries int
+		payload uint16
+	}{
+		{name: "default", config: DefaultResolverConfig(), drop: 2, queries: 3, payload: 1232},
+		// A zero timeout is replaced by the default, not an instant failure.
+		{name: "zero", config: ResolverConfig{}, queries: 1},
+		{name: "no retries", config: ResolverConfig{Timeout: 300 * time.Millisecond}, drop: 1, fail: true, queries: 1},
+		{name: "negative retries", config: ResolverConfig{Timeout: 300 * time.Millisecond, Retries: -1}, drop: 1, fail: true, queries: 1},
+		{name: "one retry", config: ResolverConfig{Retries: 1, EDNSPayload: 4096}, drop: 1, queries: 2, payload: 4096},
+	} {
+		s := &countingServer{drop: tt.drop}
+		resp, err := tt.config.Lookup(ctx, serveUDP(t, s.handle), "example.com", A)
+		if tt.fail != (err != nil) {
+			t.Errorf("%s: Lookup returned %v, %v", tt.name, resp, err)
+		}
+
+		reqs := s.queries()
+		if len(reqs) != tt.queries {
+			t.Errorf("%s: server got %d queries, want %d", tt.name, len(reqs), tt.queries)
+			continue
+		}
+		var payload uint16
+		if opt := reqs[0].OPT(); opt != nil {
+			payload = opt.PayloadSize
+		}
+		if payload != tt.payload {
+			t.Errorf("%s: query advertised payload %d, want %d", tt.name, payload, tt.payload)
+		}
+	}
+}
+
+func TestResolverConfigSlowServer(t *testing.T) {
+	// The answer takes longer than all the retry backoffs together, but
+	// still arrives within the timeout.
+	server := serveUDP(t, func(req *DnsPacket) *DnsPacket {
+		time.Sleep(time.Second)
+		return answerA(req, net.IPv4(192, 0, 2, 1))
+	})
+
+	resp, err := DefaultResolverConfig().Lookup(context.Background(), server, "www.example.com", A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answers) != 1 {
+		t.Errorf("got response\n%v", resp)
+	}
+}
+
+func TestResolverConfigPreferTCP(t *testing.T) {
+	server := serveTCP(t, func(conn net.Conn) {
+		req, err := ReadTCP(conn)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		WriteTCP(conn, answerA(req, net.IPv4(192, 0, 2, 1)))
+	})
+
+	c := DefaultResolverConfig()
+	c.PreferTCP = true
+	resp, err := c.Lookup(context.Background(), server, "example.com", A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answers) != 1 {
+		t.Errorf("lookup over TCP got\n%v", resp)
+	}
+
+	c.Network = "tcp"
+	if _, err := c.Lookup(context.Background(), server, "example.com", A); err == nil {
+		t.Error("lookup with an unsupported network succeeded")
+	}
+}
+
+func TestResolverConfigNetwork(t *testing.T) {
+	conn, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	var upstream countingServer
+	server6 := serveConn(t, conn, upstream.handle)
+	server4 := serveUDP(t, upstream.handle)
+
+	for _, tt := range []struct {
+		network string
+		server  string
+		fail    bool
+	}{
+		{network: "udp6", server: server6},
+		{network: "udp6", server: server4, fail: true},
+		{network: "udp4", server: server4},
+		{network: "udp4", server: server6, fail: true},
+		{network: "udp", server: server6},
+		{network: "", server: server4},
+	} {
+		c := DefaultResolverConfig()
+		c.Timeout = time.Second
+		c.Network = tt.network
+		resp, err := c.Lookup(context.Background(), tt.server, "example.com", A)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("lookup over %q to %s succeeded", tt.network, tt.server)
+			}
+			continue
+		}
+		if err != nil || len(resp.Answers) != 1 {
+			t.Errorf("lookup over %q to %s returned\n%v\nerror %v", tt.network, tt.server, resp, err)
+		}
+	}
+}
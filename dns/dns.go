@@ -1,14 +1,23 @@
 package dns
 
 import (
-	"encoding/binary"
+	"bytes"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"math"
+	"math/rand/v2"
 	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type ResultCode int
 type RecordType int
+type Opcode uint8
+type Class uint16
 
 const (
 	NOERROR ResultCode = iota
@@ -17,8 +26,67 @@ const (
 	NXDOMAIN
 	NOTIMP
 	REFUSED
+	YXDOMAIN
+	YXRRSET
+	NXRRSET
+	NOTAUTH
+	NOTZONE
 )
 
+// Extended rcodes, which need the upper bits stored in the OPT record.
+const (
+	BADVERS   ResultCode = 16
+	BADCOOKIE ResultCode = 23
+)
+
+const (
+	OpcodeQuery  Opcode = 0
+	OpcodeIQuery Opcode = 1
+	OpcodeStatus Opcode = 2
+	OpcodeNotify Opcode = 4
+	OpcodeUpdate Opcode = 5
+)
+
+func (o Opcode) String() string {
+	switch o {
+	case OpcodeQuery:
+		return "QUERY"
+	case OpcodeIQuery:
+		return "IQUERY"
+	case OpcodeStatus:
+		return "STATUS"
+	case OpcodeNotify:
+		return "NOTIFY"
+	case OpcodeUpdate:
+		return "UPDATE"
+	default:
+		return fmt.Sprintf("OPCODE%d", uint8(o))
+	}
+}
+
+// NONE and ANY are only used by dynamic updates, to delete records.
+const (
+	ClassIN   Class = 1
+	ClassCH   Class = 3
+	ClassNONE Class = 254
+	ClassANY  Class = 255
+)
+
+func (c Class) String() string {
+	switch c {
+	case ClassIN:
+		return "IN"
+	case ClassCH:
+		return "CH"
+	case ClassNONE:
+		return "NONE"
+	case ClassANY:
+		return "ANY"
+	default:
+		return fmt.Sprintf("CLASS%d", uint16(c))
+	}
+}
+
 const (
 	UNKNOWN RecordType = iota
 	A
@@ -26,6 +94,18 @@ const (
 	CNAME
 	MX
 	AAAA
+	HINFO
+	SOA
+	TXT
+	OPT
+	DS
+	RRSIG
+	AXFR // Only valid in questions
+	TSIG
+	ANY // Only valid in questions
+	DNAME
+	SVCB
+	HTTPS
 )
 
 type DnsHeader struct {
@@ -33,7 +113,7 @@ type DnsHeader struct {
 	RecursionDesired     bool       // 1 bit
 	TruncatedMessage     bool       // 1 bit
 	AuthoritativeAnswer  bool       // 1 bit
-	Opcode               uint8      // 4 bits
+	Opcode               Opcode     // 4 bits
 	Response             bool       // 1 bit
 	Rescode              ResultCode // 4 bits
 	CheckingDisabled     bool       // 1 bit
@@ -52,7 +132,97 @@ func NewDnsHeader() *DnsHeader {
 	}
 }
 
+// HeaderFlag is one of the single bit flags of a DnsHeader.
+type HeaderFlag uint8
+
+const (
+	FlagQR HeaderFlag = iota // Response
+	FlagAA                   // AuthoritativeAnswer
+	FlagTC                   // TruncatedMessage
+	FlagRD                   // RecursionDesired
+	FlagRA                   // RecursionAvailable
+	FlagAD                   // AuthedData
+	FlagCD                   // CheckingDisabled
+)
+
+// headerFlagNames holds the names of the flags in the order dig prints them.
+var headerFlagNames = []string{"qr", "aa", "tc", "rd", "ra", "ad", "cd"}
+
+func (f HeaderFlag) String() string {
+	if int(f) < len(headerFlagNames) {
+		return headerFlagNames[f]
+	}
+	return fmt.Sprintf("FLAG%d", f)
+}
+
+func (h *DnsHeader) flag(f HeaderFlag) *bool {
+	switch f {
+	case FlagQR:
+		return &h.Response
+	case FlagAA:
+		return &h.AuthoritativeAnswer
+	case FlagTC:
+		return &h.TruncatedMessage
+	case FlagRD:
+		return &h.RecursionDesired
+	case FlagRA:
+		return &h.RecursionAvailable
+	case FlagAD:
+		return &h.AuthedData
+	case FlagCD:
+		return &h.CheckingDisabled
+	default:
+		return nil
+	}
+}
+
+// Flag reports whether f is set.
+func (h *DnsHeader) Flag(f HeaderFlag) bool {
+	if p := h.flag(f); p != nil {
+		return *p
+	}
+	return false
+}
+
+// SetFlag sets f to on. Unknown flags are ignored.
+func (h *DnsHeader) SetFlag(f HeaderFlag, on bool) {
+	if p := h.flag(f); p != nil {
+		*p = on
+	}
+}
+
+// SetResponseFlags marks the header as the response of a server offering
+// recursion.
+func (h *DnsHeader) SetResponseFlags() {
+	h.Response = true
+	h.RecursionAvailable = true
+}
+
+// FlagsString returns the names of the set flags separated by spaces, like
+// dig prints them: "qr rd ra" for a typical recursive response.
+func (h *DnsHeader) FlagsString() string {
+	var flags []string
+	for f := range HeaderFlag(len(headerFlagNames)) {
+		if h.Flag(f) {
+			flags = append(flags, f.String())
+		}
+	}
+	return strings.Join(flags, " ")
+}
+
+// SummaryLine returns the header line dig starts its output with, like
+// ";; ->>HEADER<<- opcode: QUERY, status: NOERROR, id: 6666".
+func (h *DnsHeader) SummaryLine() string {
+	return fmt.Sprintf(";; ->>HEADER<<- opcode: %s, status: %s, id: %d", h.Opcode, h.Rescode, h.ID)
+}
+
 func (h *DnsHeader) Write(buffer *BytePacketBuffer) error {
+	// The opcode only has 4 bits on the wire, anything larger would spill
+	// into the neighbouring flags.
+	if h.Opcode > 15 {
+		return fmt.Errorf("invalid opcode %d", h.Opcode)
+	}
+
 	err := buffer.Write2Byte(h.ID)
 	if err != nil {
 		return err
@@ -71,7 +241,7 @@ func (h *DnsHeader) Write(buffer *BytePacketBuffer) error {
 		flag |= (1 << 2)
 	}
 
-	flag |= (h.Opcode << 3)
+	flag |= (uint8(h.Opcode) << 3)
 
 	if h.Response {
 		flag |= (1 << 7)
@@ -82,8 +252,10 @@ func (h *DnsHeader) Write(buffer *BytePacketBuffer) error {
 		return err
 	}
 
+	// Only the lower 4 bits of an extended rcode fit in the header, the
+	// rest goes into the OPT record.
 	flag = uint8(0)
-	flag |= uint8(h.Rescode)
+	flag |= uint8(h.Rescode) & 0x0F
 
 	if h.CheckingDisabled {
 		flag |= (1 << 4)
@@ -101,6 +273,11 @@ func (h *DnsHeader) Write(buffer *BytePacketBuffer) error {
 		flag |= (1 << 7)
 	}
 
+	err = buffer.Write1Byte(flag)
+	if err != nil {
+		return err
+	}
+
 	err = buffer.Write2Byte(h.Questions)
 	if err != nil {
 		return err
@@ -120,6 +297,10 @@ func (h *DnsHeader) Write(buffer *BytePacketBuffer) error {
 
 // Read parses a BytePacketBuffer and populates the DnsHeader fields
 func (h *DnsHeader) Read(buffer *BytePacketBuffer) error {
+	if len(buffer.Buf)-int(buffer.Pos) < headerLen {
+		return ErrShortHeader
+	}
+
 	var err error
 
 	h.ID, err = buffer.Read2Bytes()
@@ -147,7 +328,7 @@ func (h *DnsHeader) Read(buffer *BytePacketBuffer) error {
 	h.RecursionDesired = (a & (1 << 0)) > 0
 	h.TruncatedMessage = (a & (1 << 1)) > 0
 	h.AuthoritativeAnswer = (a & (1 << 2)) > 0
-	h.Opcode = (a >> 3) & 0x0F
+	h.Opcode = Opcode((a >> 3) & 0x0F)
 	h.Response = (a & (1 << 7)) > 0
 
 	h.Rescode = FromNum2ResultCode(b & 0x0F)
@@ -196,60 +377,484 @@ func NewDnsPacket() *DnsPacket {
 	}
 }
 
-func (d *DnsPacket) Write(buffer *BytePacketBuffer) error {
+// AddQuestion appends q to the question section and keeps the header count
+// in sync.
+func (d *DnsPacket) AddQuestion(q *DnsQuestion) {
+	d.Questions = append(d.Questions, q)
+	d.Header.Questions = uint16(len(d.Questions))
+}
+
+// AddGlue appends the address ip of the name server nsHost to the
+// additional section, as an A or AAAA record depending on its family, and
+// keeps the header count in sync. The record gets the TTL of the NS record
+// naming nsHost in the answer or authority section, if there is one.
+func (d *DnsPacket) AddGlue(nsHost string, ip net.IP) {
+	var ttl uint32
+	for _, records := range [][]*DnsRecord{d.Answers, d.Authorities} {
+		for _, rec := range records {
+			if rec.Type == NS && sameName(rec.Host, nsHost) {
+				ttl = rec.TTL
+			}
+		}
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		d.Resources = append(d.Resources, NewADnsRecord(nsHost, ip4, ttl))
+	} else {
+		d.Resources = append(d.Resources, NewAAAADnsRecord(nsHost, ip, ttl))
+	}
+	d.Header.ResourceEntries = uint16(len(d.Resources))
+}
+
+// Question returns the i-th question, and false if there is none, as in
+// packets read from malformed or truncated input.
+func (d *DnsPacket) Question(i int) (*DnsQuestion, bool) {
+	if i < 0 || i >= len(d.Questions) {
+		return nil, false
+	}
+	return d.Questions[i], true
+}
+
+// Answer returns the i-th record of the answer section, and false if there
+// is none.
+func (d *DnsPacket) Answer(i int) (*DnsRecord, bool) {
+	if i < 0 || i >= len(d.Answers) {
+		return nil, false
+	}
+	return d.Answers[i], true
+}
+
+// Addresses returns the addresses of all A and AAAA records in the answer
+// section, in order. The records are taken as they are, whatever their
+// owner name, so CNAMEs leading to them don't need to be followed.
+func (d *DnsPacket) Addresses() []net.IP {
+	var addrs []net.IP
+	for _, rec := range d.Answers {
+		if rec.Type == A || rec.Type == AAAA {
+			addrs = append(addrs, rec.Addr)
+		}
+	}
+	return addrs
+}
+
+// Write serializes the packet into buffer and returns the number of bytes
+// written. A packet that doesn't fit fails with ErrPacketTooLarge before
+// anything is written.
+func (d *DnsPacket) Write(buffer *BytePacketBuffer) (int, error) {
 	d.Header.Questions = uint16(len(d.Questions))
 	d.Header.Answers = uint16(len(d.Answers))
 	d.Header.AuthoritativeEntries = uint16(len(d.Authorities))
 	d.Header.ResourceEntries = uint16(len(d.Resources))
 
-	err := d.Header.Write(buffer)
+	wireLen, err := d.wireLen(buffer.Compress)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if int(buffer.Pos)+wireLen > len(buffer.Buf) {
+		return 0, fmt.Errorf("%w: %d bytes exceed the %d left", ErrPacketTooLarge, wireLen, len(buffer.Buf)-int(buffer.Pos))
+	}
+
+	startPos := buffer.Pos
+	err = d.Header.Write(buffer)
+	if err != nil {
+		return 0, err
 	}
 
 	for _, q := range d.Questions {
 		err = q.Write(buffer)
 		if err != nil {
-			return err
+			return 0, err
 		}
 	}
+	size := int(buffer.Pos - startPos)
 
-	for _, a := range d.Answers {
-		_, err = a.Write(buffer)
-		if err != nil {
-			return err
+	for _, records := range [][]*DnsRecord{d.Answers, d.Authorities, d.Resources} {
+		for _, rec := range records {
+			n, err := rec.Write(buffer)
+			if err != nil {
+				return 0, err
+			}
+			size += int(n)
 		}
 	}
 
-	for _, a := range d.Authorities {
-		_, err = a.Write(buffer)
-		if err != nil {
-			return err
+	return size, nil
+}
+
+// Pack returns the wire format of the packet. Unlike writing to a buffer
+// of its own, it isn't limited to 512 bytes, but to the largest possible
+// message.
+func (d *DnsPacket) Pack() ([]byte, error) {
+	size, err := d.WireLen()
+	if err != nil {
+		return nil, err
+	}
+	buffer := NewBytePacketBufferSize(size)
+	n, err := d.Write(buffer)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), buffer.Buf[:n]...), nil
+}
+
+// WriteTruncated is like Write, but writes at most maxSize bytes, the UDP
+// payload size a client accepts. If the packet is larger, a copy with the
+// TruncatedMessage flag set is written instead. It keeps as many complete
+// records as fit, in section order, and drops the rest. The OPT record is
+// always kept. Sizes are measured with the compression setting of buffer.
+// The packet itself is not modified.
+func (d *DnsPacket) WriteTruncated(buffer *BytePacketBuffer, maxSize int) (int, error) {
+	size, err := d.wireLen(buffer.Compress)
+	if err != nil {
+		return 0, err
+	}
+	if size <= maxSize {
+		return d.Write(buffer)
+	}
+
+	truncated, err := d.truncate(maxSize, buffer.Compress)
+	if err != nil {
+		return 0, err
+	}
+	return truncated.Write(buffer)
+}
+
+// truncate returns a copy of d with the records that fit into maxSize bytes
+// when written by a buffer compressing names only if compress is set. The
+// records themselves are shared with d.
+func (d *DnsPacket) truncate(maxSize int, compress bool) (*DnsPacket, error) {
+	header := *d.Header
+	header.TruncatedMessage = true
+	truncated := &DnsPacket{
+		Header:      &header,
+		Questions:   d.Questions,
+		Answers:     []*DnsRecord{},
+		Authorities: []*DnsRecord{},
+		Resources:   []*DnsRecord{},
+	}
+
+	c := &wireCounter{pos: 12, names: map[string]bool{}, compress: compress}
+	for _, q := range d.Questions {
+		if err := c.name(q.Name); err != nil {
+			return nil, err
 		}
+		c.pos += 4
 	}
 
-	for _, r := range d.Resources {
-		_, err = r.Write(buffer)
-		if err != nil {
-			return err
+	// The OPT record goes last and is written without compression, so its
+	// size is known up front.
+	opt := d.OPT()
+	if opt != nil {
+		maxSize -= 11 + len(opt.rawData())
+	}
+
+	sections := []*[]*DnsRecord{&truncated.Answers, &truncated.Authorities, &truncated.Resources}
+fill:
+	for i, records := range [][]*DnsRecord{d.Answers, d.Authorities, d.Resources} {
+		kept := sections[i]
+		for _, rec := range records {
+			if rec.Type == OPT {
+				continue
+			}
+			if err := rec.wireLen(c); err != nil {
+				return nil, err
+			}
+			if c.pos > maxSize {
+				break fill
+			}
+			*kept = append(*kept, rec)
+		}
+	}
+
+	if opt != nil {
+		truncated.Resources = append(truncated.Resources, opt)
+	}
+	return truncated, nil
+}
+
+// HexDump returns the wire format of the packet as a hex string, to be read
+// back with FromHex. It is empty if the packet can't be packed.
+func (d *DnsPacket) HexDump() string {
+	data, err := d.Pack()
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(data)
+}
+
+// FromHex parses a packet from the hex string of its wire format. White
+// space is ignored, so long dumps can be split over several lines.
+func FromHex(s string) (*DnsPacket, error) {
+	s = strings.Join(strings.Fields(s), "")
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return Unpack(data)
+}
+
+// WireLen returns the number of bytes Write would produce for the packet
+// in a new buffer, without writing it anywhere. Name compression is taken
+// into account, so the result is exact.
+func (d *DnsPacket) WireLen() (int, error) {
+	return d.wireLen(true)
+}
+
+// wireLen is like WireLen, for a buffer compressing names only if compress
+// is set.
+func (d *DnsPacket) wireLen(compress bool) (int, error) {
+	c := &wireCounter{pos: 12, names: map[string]bool{}, compress: compress}
+
+	for _, q := range d.Questions {
+		if err := c.name(q.Name); err != nil {
+			return 0, err
+		}
+		c.pos += 4
+	}
+
+	for _, records := range [][]*DnsRecord{d.Answers, d.Authorities, d.Resources} {
+		for _, rec := range records {
+			if err := rec.wireLen(c); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return c.pos, nil
+}
+
+// wireCounter follows the position of a simulated Write, remembering the
+// name suffixes that later names can be compressed to.
+type wireCounter struct {
+	pos      int
+	names    map[string]bool
+	compress bool
+
+	// scratch is where the data of registered types is written to learn
+	// its length.
+	scratch *BytePacketBuffer
+}
+
+// name advances the position past name as written by WriteQName.
+func (c *wireCounter) name(name string) error {
+	labels, err := splitLabels(name)
+	if err != nil {
+		return err
+	}
+
+	for i, label := range labels {
+		if len(label) > 0x3f {
+			return errors.New("signle label exceeds 63 characters of length")
+		}
+
+		if c.compress {
+			suffix := suffixKey(labels[i:])
+			if c.names[suffix] {
+				c.pos += 2
+				return nil
+			}
+			if c.pos <= 0x3FFF {
+				c.names[suffix] = true
+			}
 		}
+		c.pos += 1 + len(label)
 	}
 
+	c.pos++
 	return nil
 }
 
+// uncompressedName is like name, for names that are never compressed.
+func (c *wireCounter) uncompressedName(name string) error {
+	compress := c.compress
+	c.compress = false
+	err := c.name(name)
+	c.compress = compress
+	return err
+}
+
+// String renders the packet similar to the output of dig.
+func (d *DnsPacket) String() string {
+	var sb strings.Builder
+
+	fmt.Fprintln(&sb, d.Header.SummaryLine())
+	fmt.Fprintf(&sb, ";; flags: %s\n", d.Header.FlagsString())
+
+	sb.WriteString("\n;; QUESTION SECTION:\n")
+	for _, q := range d.Questions {
+		fmt.Fprintf(&sb, ";%v\n", q)
+	}
+
+	sections := []struct {
+		name    string
+		records []*DnsRecord
+	}{
+		{"ANSWER", d.Answers},
+		{"AUTHORITY", d.Authorities},
+		{"ADDITIONAL", d.Resources},
+	}
+	for _, section := range sections {
+		if len(section.records) == 0 {
+			continue
+		}
+		fmt.Fprintf(&sb, "\n;; %s SECTION:\n", section.name)
+		for _, rec := range section.records {
+			fmt.Fprintf(&sb, "%v\n", rec)
+		}
+	}
+
+	return sb.String()
+}
+
+// Equal reports whether d and other hold the same header, questions and
+// records. Names are compared case-insensitively.
+func (d *DnsPacket) Equal(other *DnsPacket) bool {
+	if d == nil || other == nil {
+		return d == other
+	}
+
+	if (d.Header == nil) != (other.Header == nil) {
+		return false
+	}
+	if d.Header != nil && *d.Header != *other.Header {
+		return false
+	}
+
+	if len(d.Questions) != len(other.Questions) {
+		return false
+	}
+	for i := range d.Questions {
+		if !d.Questions[i].Equal(other.Questions[i]) {
+			return false
+		}
+	}
+
+	return recordsEqual(d.Answers, other.Answers) &&
+		recordsEqual(d.Authorities, other.Authorities) &&
+		recordsEqual(d.Resources, other.Resources)
+}
+
+// Clone returns a deep copy of d, so the copy can be modified without
+// affecting the original.
+func (d *DnsPacket) Clone() *DnsPacket {
+	if d == nil {
+		return nil
+	}
+
+	clone := NewDnsPacket()
+	if d.Header != nil {
+		header := *d.Header
+		clone.Header = &header
+	} else {
+		clone.Header = nil
+	}
+
+	for _, q := range d.Questions {
+		clone.Questions = append(clone.Questions, q.Clone())
+	}
+	clone.Answers = cloneRecords(d.Answers)
+	clone.Authorities = cloneRecords(d.Authorities)
+	clone.Resources = cloneRecords(d.Resources)
+
+	return clone
+}
+
+func cloneRecords(records []*DnsRecord) []*DnsRecord {
+	clone := make([]*DnsRecord, 0, len(records))
+	for _, r := range records {
+		clone = append(clone, r.Clone())
+	}
+	return clone
+}
+
+func recordsEqual(a, b []*DnsRecord) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Unpack parses a packet from its wire format. data has to hold exactly one
+// message, anything after the last record fails with ErrTrailingData.
+func Unpack(data []byte) (*DnsPacket, error) {
+	if len(data) > maxMessageSize {
+		return nil, fmt.Errorf("packet of %d bytes exceeds buffer size", len(data))
+	}
+	buffer := NewBytePacketBufferSize(len(data))
+	buffer.SetBuffer(data)
+
+	packet, err := FromBuffer2DnsPacket(buffer)
+	if err != nil {
+		return nil, err
+	}
+	if n := len(data) - int(buffer.Pos); n > 0 {
+		return nil, fmt.Errorf("%w: %d bytes", ErrTrailingData, n)
+	}
+	return packet, nil
+}
+
+// Every question takes at least 5 bytes on the wire, the root name and the
+// type and class, and every record at least 11 bytes.
+const (
+	minQuestionLen = 5
+	minRecordLen   = 11
+)
+
+// headerLen is the size of the fixed header every message starts with.
+const headerLen = 12
+
+var (
+	// ErrShortPacket is returned for messages too short to hold a header.
+	ErrShortPacket = errors.New("packet shorter than header")
+
+	// ErrShortHeader is returned by DnsHeader.Read if less than a full
+	// header remains in the buffer. The position is left unchanged.
+	ErrShortHeader = errors.New("buffer too short for header")
+
+	// ErrTrailingData is returned by Unpack for bytes following the last
+	// record.
+	ErrTrailingData = errors.New("trailing data after last record")
+
+	// ErrInvalidAddress is returned for an address that doesn't fit the
+	// type of its record, like an IPv6 address in an A record.
+	ErrInvalidAddress = errors.New("invalid address")
+
+	// ErrPacketTooLarge is returned by Write for a packet that doesn't fit
+	// into the rest of the buffer. Nothing is written then, so a caller
+	// can retry with a larger buffer, or over TCP.
+	ErrPacketTooLarge = errors.New("packet too large for buffer")
+)
+
 func FromBuffer2DnsPacket(buffer *BytePacketBuffer) (*DnsPacket, error) {
+	if len(buffer.Buf)-int(buffer.Pos) < headerLen {
+		return nil, ErrShortPacket
+	}
+
 	packet := NewDnsPacket()
 	if err := packet.Header.Read(buffer); err != nil {
 		return nil, err
 	}
 
-	for i := 0; i < int(packet.Header.Questions); i++ {
+	// Counts that can't possibly fit are rejected up front, instead of
+	// failing only after reading up to 65535 bogus entries.
+	h := packet.Header
+	records := int(h.Answers) + int(h.AuthoritativeEntries) + int(h.ResourceEntries)
+	remaining := len(buffer.Buf) - int(buffer.Pos)
+	if int(h.Questions)*minQuestionLen+records*minRecordLen > remaining {
+		return nil, fmt.Errorf("header claims %d questions and %d records, but only %d bytes remain",
+			h.Questions, records, remaining)
+	}
 
+	for i := 0; i < int(packet.Header.Questions); i++ {
 		q := NewDnsQuestion("", UNKNOWN)
 		err := q.Read(buffer)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("reading question %d of %d: %w", i+1, packet.Header.Questions, err)
 		}
 
 		packet.Questions = append(packet.Questions, q)
@@ -294,70 +899,197 @@ func FromNum2ResultCode(num uint8) ResultCode {
 		return NOTIMP
 	case 5:
 		return REFUSED
+	case 6:
+		return YXDOMAIN
+	case 7:
+		return YXRRSET
+	case 8:
+		return NXRRSET
+	case 9:
+		return NOTAUTH
+	case 10:
+		return NOTZONE
 	default:
 		return NOERROR
 	}
 }
 
+// RecordTypeToNum returns the number of typ on the wire, or 0 for UNKNOWN
+// and types that aren't registered.
 func RecordTypeToNum(typ RecordType) uint16 {
-	switch typ {
-	case A:
-		return 1
-	case NS:
-		return 2
-	case CNAME:
-		return 5
-	case MX:
-		return 15
-	case AAAA:
-		return 28
-	default:
-		return 0
-	}
+	info, _ := lookupRecordType(typ)
+	return info.num
 }
 
+// FromNum2RecordType maps the type of a record read from the wire. No
+// record can have the question-only types AXFR and ANY, so their numbers
+// map to UNKNOWN; see FromNum2QuestionType.
 func FromNum2RecordType(num uint16) RecordType {
-	switch num {
-	case 1:
-		return A
-	case 2:
-		return NS
-	case 5:
-		return CNAME
-	case 15:
-		return MX
-	case 28:
-		return AAAA
-	default:
+	typ, ok := lookupRecordNum(num)
+	if !ok || typ == AXFR || typ == ANY {
 		return UNKNOWN
 	}
+	return typ
 }
 
-type DnsQuestion struct {
-	Name string
-	Type RecordType
+// FromNum2QuestionType is like FromNum2RecordType, but also knows the
+// types only valid in questions.
+func FromNum2QuestionType(num uint16) RecordType {
+	switch num {
+	case 252:
+		return AXFR
+	case 255:
+		return ANY
+	default:
+		return FromNum2RecordType(num)
+	}
 }
 
-func NewDnsQuestion(name string, qtype RecordType) *DnsQuestion {
-	return &DnsQuestion{
-		Name: name,
-		Type: qtype,
+func (c ResultCode) String() string {
+	switch c {
+	case NOERROR:
+		return "NOERROR"
+	case FORMERR:
+		return "FORMERR"
+	case SERVFAIL:
+		return "SERVFAIL"
+	case NXDOMAIN:
+		return "NXDOMAIN"
+	case NOTIMP:
+		return "NOTIMP"
+	case REFUSED:
+		return "REFUSED"
+	case YXDOMAIN:
+		return "YXDOMAIN"
+	case YXRRSET:
+		return "YXRRSET"
+	case NXRRSET:
+		return "NXRRSET"
+	case NOTAUTH:
+		return "NOTAUTH"
+	case NOTZONE:
+		return "NOTZONE"
+	case BADVERS:
+		return "BADVERS"
+	case BADCOOKIE:
+		return "BADCOOKIE"
+	default:
+		return fmt.Sprintf("RCODE%d", int(c))
 	}
 }
 
-func (dq *DnsQuestion) Write(buffer *BytePacketBuffer) error {
-	err := buffer.WriteQName(dq.Name)
-	if err != nil {
-		return err
-
+func (t RecordType) String() string {
+	if info, ok := lookupRecordType(t); ok {
+		return info.name
 	}
+	return "UNKNOWN"
+}
 
-	err = buffer.Write2Byte(uint16(dq.Type))
-	if err != nil {
-		return err
+// ParseRecordType returns the RecordType named s, like "A" or "mx".
+func ParseRecordType(s string) (RecordType, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	for typ, info := range recordTypes {
+		if strings.EqualFold(info.name, s) {
+			return typ, nil
+		}
 	}
-
-	return buffer.Write2Byte(uint16(1))
+	return UNKNOWN, fmt.Errorf("unknown record type %q", s)
+}
+
+type DnsQuestion struct {
+	Name  string
+	Type  RecordType
+	Class Class // Zero means IN
+}
+
+// QuestionOption customizes a DnsQuestion built by NewDnsQuestion.
+type QuestionOption func(*DnsQuestion)
+
+// WithCaseRandomization randomly flips the case of every letter in the
+// question name (DNS-0x20). Responses can then be checked with
+// VerifyCaseEcho to make spoofed answers harder to forge.
+func WithCaseRandomization() QuestionOption {
+	return func(dq *DnsQuestion) {
+		dq.Name = randomizeCase(dq.Name)
+	}
+}
+
+func randomizeCase(name string) string {
+	bs := []byte(name)
+	for i, c := range bs {
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') {
+			if rand.IntN(2) == 1 {
+				bs[i] = c ^ 0x20
+			}
+		}
+	}
+	return string(bs)
+}
+
+func NewDnsQuestion(name string, qtype RecordType, opts ...QuestionOption) *DnsQuestion {
+	dq := &DnsQuestion{
+		Name: name,
+		Type: qtype,
+	}
+	for _, opt := range opts {
+		opt(dq)
+	}
+	return dq
+}
+
+// String renders the question like dig does, such as "google.com. IN A".
+func (dq *DnsQuestion) String() string {
+	return fmt.Sprintf("%s %s %s", fqdn(dq.Name), Class(dq.class()), dq.Type)
+}
+
+// class returns the class to write for dq, which is IN unless set
+// otherwise.
+func (dq *DnsQuestion) class() uint16 {
+	if dq.Class == 0 {
+		return uint16(ClassIN)
+	}
+	return uint16(dq.Class)
+}
+
+// fqdn returns name with a trailing dot, as names are presented.
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// Equal reports whether dq and other ask for the same name, type and class.
+func (dq *DnsQuestion) Equal(other *DnsQuestion) bool {
+	if dq == nil || other == nil {
+		return dq == other
+	}
+	return sameName(dq.Name, other.Name) && dq.Type == other.Type && dq.class() == other.class()
+}
+
+// Clone returns a copy of dq.
+func (dq *DnsQuestion) Clone() *DnsQuestion {
+	if dq == nil {
+		return nil
+	}
+	clone := *dq
+	return &clone
+}
+
+func (dq *DnsQuestion) Write(buffer *BytePacketBuffer) error {
+	err := buffer.WriteQName(dq.Name)
+	if err != nil {
+		return err
+
+	}
+
+	err = buffer.Write2Byte(RecordTypeToNum(dq.Type))
+	if err != nil {
+		return err
+	}
+
+	return buffer.Write2Byte(dq.class())
 }
 
 func (dq *DnsQuestion) Read(buffer *BytePacketBuffer) error {
@@ -373,10 +1105,14 @@ func (dq *DnsQuestion) Read(buffer *BytePacketBuffer) error {
 		return err
 	}
 
-	dq.Type = FromNum2RecordType(qtype)
+	dq.Type = FromNum2QuestionType(qtype)
 
-	_, err = buffer.Read2Bytes() // class
-	return err
+	class, err := buffer.Read2Bytes()
+	if err != nil {
+		return err
+	}
+	dq.Class = Class(class)
+	return nil
 }
 
 type DnsRecord struct {
@@ -385,16 +1121,199 @@ type DnsRecord struct {
 	QType    uint16 // Used for UNKNOWN
 	DataLen  uint16 // Used for UNKNOWN
 	TTL      uint32
-	Addr     net.IP // Used for A/AAAA
-	Host     string // NS/CNAME
-	Priority uint16 // MX
+	Class    Class    // Zero means IN
+	Addr     net.IP   // Used for A/AAAA
+	Host     string   // NS/CNAME/DNAME
+	Priority uint16   // MX/SVCB/HTTPS
+	Cpu      string   // HINFO
+	Os       string   // HINFO
+	MName    string   // SOA
+	RName    string   // SOA
+	Serial   uint32   // SOA
+	Refresh  uint32   // SOA
+	Retry    uint32   // SOA
+	Expire   uint32   // SOA
+	Minimum  uint32   // SOA
+	Txt      []string // TXT
+	// Target is the name of the service endpoint, or "." if it is the
+	// owner name itself. A priority of 0 makes the record an alias.
+	Target string     // SVCB/HTTPS
+	Params []SvcParam // SVCB/HTTPS
+	// PayloadSize is the UDP payload size advertised by an OPT record,
+	// which is stored in place of the class. The TTL holds the extended
+	// rcode, the EDNS version and the flags.
+	PayloadSize uint16       // OPT
+	Options     []EDNSOption // OPT
+	Raw         []byte       // DS/RRSIG/TSIG/UNKNOWN RDATA, kept as is
+}
+
+// String renders the record in presentation format, such as
+// "example.com. 300 IN MX 10 mail.example.com.". Records whose data is kept
+// raw are shown in the generic form of RFC 3597: "\# 4 0a000001".
+func (d *DnsRecord) String() string {
+	class := Class(d.class()).String()
+	typ := d.Type.String()
+	switch d.Type {
+	case OPT:
+		class = fmt.Sprintf("CLASS%d", d.PayloadSize)
+	case UNKNOWN:
+		typ = fmt.Sprintf("TYPE%d", d.QType)
+	}
+	return fmt.Sprintf("%s %d %s %s %s", fqdn(d.Domain), d.TTL, class, typ, d.Data())
+}
+
+// Data renders only the data of the record, as String does, such as
+// "10 mail.example.com." for an MX record or "192.0.2.1" for an A record.
+func (d *DnsRecord) Data() string {
+	switch d.Type {
+	case A, AAAA:
+		return d.Addr.String()
+	case NS, CNAME, DNAME:
+		return fqdn(d.Host)
+	case MX:
+		return fmt.Sprintf("%d %s", d.Priority, fqdn(d.Host))
+	case SVCB, HTTPS:
+		data := fmt.Sprintf("%d %s", d.Priority, fqdn(d.Target))
+		for _, p := range d.Params {
+			data += " " + p.String()
+		}
+		return data
+	case HINFO:
+		return strconv.Quote(d.Cpu) + " " + strconv.Quote(d.Os)
+	case SOA:
+		return fmt.Sprintf("%s %s %d %d %d %d %d", fqdn(d.MName), fqdn(d.RName),
+			d.Serial, d.Refresh, d.Retry, d.Expire, d.Minimum)
+	case TXT:
+		quoted := make([]string, len(d.Txt))
+		for i, str := range d.Txt {
+			quoted[i] = strconv.Quote(str)
+		}
+		return strings.Join(quoted, " ")
+	default:
+		raw := d.rawData()
+		return strings.TrimSpace(fmt.Sprintf("\\# %d %s", len(raw), hex.EncodeToString(raw)))
+	}
+}
+
+// rawData returns the RDATA of records kept as raw bytes. For OPT records
+// it is built from the options.
+func (d *DnsRecord) rawData() []byte {
+	if d.Type == OPT {
+		return packEDNSOptions(d.Options)
+	}
+	return d.Raw
+}
+
+// class returns the class to write for d, which is IN unless set otherwise.
+func (d *DnsRecord) class() uint16 {
+	if d.Class == 0 {
+		return uint16(ClassIN)
+	}
+	return uint16(d.Class)
+}
+
+// writeEmpty writes d without any data, as records of class ANY are unless
+// they carry raw data, like TSIG. Their type is the one of d, or QType for
+// UNKNOWN records.
+func (d *DnsRecord) writeEmpty(buffer *BytePacketBuffer) error {
+	typeNum := RecordTypeToNum(d.Type)
+	if d.Type == UNKNOWN {
+		typeNum = d.QType
+	}
+
+	if err := buffer.WriteQName(d.Domain); err != nil {
+		return err
+	}
+	if err := buffer.Write2Byte(typeNum); err != nil {
+		return err
+	}
+	if err := buffer.Write2Byte(d.class()); err != nil {
+		return err
+	}
+	if err := buffer.Write4Byte(d.TTL); err != nil {
+		return err
+	}
+	return buffer.Write2Byte(0)
+}
+
+// Equal reports whether d and other describe the same record. Addresses are
+// compared with net.IP.Equal, so the 4 and 16 byte forms of an IPv4 address
+// are considered equal.
+func (d *DnsRecord) Equal(other *DnsRecord) bool {
+	if d == nil || other == nil {
+		return d == other
+	}
+	return d.Type == other.Type &&
+		d.class() == other.class() &&
+		sameName(d.Domain, other.Domain) &&
+		d.QType == other.QType &&
+		d.DataLen == other.DataLen &&
+		d.TTL == other.TTL &&
+		d.Addr.Equal(other.Addr) &&
+		sameName(d.Host, other.Host) &&
+		d.Priority == other.Priority &&
+		d.Cpu == other.Cpu &&
+		d.Os == other.Os &&
+		sameName(d.MName, other.MName) &&
+		sameName(d.RName, other.RName) &&
+		d.Serial == other.Serial &&
+		d.Refresh == other.Refresh &&
+		d.Retry == other.Retry &&
+		d.Expire == other.Expire &&
+		d.Minimum == other.Minimum &&
+		slices.Equal(d.Txt, other.Txt) &&
+		sameName(d.Target, other.Target) &&
+		slices.EqualFunc(d.Params, other.Params, svcParamEqual) &&
+		d.PayloadSize == other.PayloadSize &&
+		slices.EqualFunc(d.Options, other.Options, ednsOptionEqual) &&
+		bytes.Equal(d.Raw, other.Raw)
+}
+
+// Clone returns a deep copy of d.
+func (d *DnsRecord) Clone() *DnsRecord {
+	if d == nil {
+		return nil
+	}
+	clone := *d
+	if d.Addr != nil {
+		clone.Addr = append(net.IP(nil), d.Addr...)
+	}
+	if d.Txt != nil {
+		clone.Txt = append([]string(nil), d.Txt...)
+	}
+	if d.Raw != nil {
+		clone.Raw = append([]byte(nil), d.Raw...)
+	}
+	clone.Params = cloneSvcParams(d.Params)
+	clone.Options = cloneEDNSOptions(d.Options)
+	return &clone
+}
 
+// TTLDuration returns the TTL of the record as a time.Duration.
+func (d *DnsRecord) TTLDuration() time.Duration {
+	return time.Duration(d.TTL) * time.Second
+}
+
+// SetTTLDuration sets the TTL of the record to ttl, truncated to whole
+// seconds. Negative durations become 0 and durations too long for the 32 bit
+// TTL field are capped at its maximum.
+func (d *DnsRecord) SetTTLDuration(ttl time.Duration) {
+	secs := ttl / time.Second
+	switch {
+	case secs < 0:
+		d.TTL = 0
+	case secs > math.MaxUint32:
+		d.TTL = math.MaxUint32
+	default:
+		d.TTL = uint32(secs)
+	}
 }
 
 func NewUnknownDnsRecord(domain string, qtype, dataLen uint16, ttl uint32) *DnsRecord {
 	return &DnsRecord{
 		Type:    UNKNOWN,
 		Domain:  domain,
+		Class:   ClassIN,
 		QType:   qtype,
 		DataLen: dataLen,
 		TTL:     ttl,
@@ -405,6 +1324,7 @@ func NewADnsRecord(domain string, addr net.IP, ttl uint32) *DnsRecord {
 	return &DnsRecord{
 		Type:   A,
 		Domain: domain,
+		Class:  ClassIN,
 		Addr:   addr,
 		TTL:    ttl,
 	}
@@ -414,6 +1334,7 @@ func NewNSDnsRecord(domain, host string, ttl uint32) *DnsRecord {
 	return &DnsRecord{
 		Type:   NS,
 		Domain: domain,
+		Class:  ClassIN,
 		Host:   host,
 		TTL:    ttl,
 	}
@@ -423,15 +1344,29 @@ func NewCNameDnsRecord(domain, host string, ttl uint32) *DnsRecord {
 	return &DnsRecord{
 		Type:   CNAME,
 		Domain: domain,
+		Class:  ClassIN,
 		Host:   host,
 		TTL:    ttl,
 	}
 }
 
+// NewDNAMEDnsRecord creates a record redirecting every name below domain to
+// the same name below target.
+func NewDNAMEDnsRecord(domain, target string, ttl uint32) *DnsRecord {
+	return &DnsRecord{
+		Type:   DNAME,
+		Domain: domain,
+		Class:  ClassIN,
+		Host:   target,
+		TTL:    ttl,
+	}
+}
+
 func NewMXDnsRecord(domain, host string, priority uint16, ttl uint32) *DnsRecord {
 	return &DnsRecord{
 		Type:     MX,
 		Domain:   domain,
+		Class:    ClassIN,
 		Host:     host,
 		Priority: priority,
 		TTL:      ttl,
@@ -442,11 +1377,115 @@ func NewAAAADnsRecord(domain string, addr net.IP, ttl uint32) *DnsRecord {
 	return &DnsRecord{
 		Type:   AAAA,
 		Domain: domain,
+		Class:  ClassIN,
 		Addr:   addr,
 		TTL:    ttl,
 	}
 }
 
+// NewCheckedADnsRecord is like NewADnsRecord, but fails with
+// ErrInvalidAddress unless addr is an IPv4 address, instead of leaving the
+// error to Write. IPv4-mapped IPv6 addresses are accepted and stored in
+// their 4 byte form.
+func NewCheckedADnsRecord(domain string, addr net.IP, ttl uint32) (*DnsRecord, error) {
+	ip := addr.To4()
+	if ip == nil {
+		return nil, fmt.Errorf("%w: %v is not an IPv4 address", ErrInvalidAddress, addr)
+	}
+	return NewADnsRecord(domain, ip, ttl), nil
+}
+
+// NewCheckedAAAADnsRecord is like NewAAAADnsRecord, but fails with
+// ErrInvalidAddress unless addr is an IPv6 address. IPv4 addresses, even in
+// their IPv4-mapped form, are rejected.
+func NewCheckedAAAADnsRecord(domain string, addr net.IP, ttl uint32) (*DnsRecord, error) {
+	ip := addr.To16()
+	if ip == nil || addr.To4() != nil {
+		return nil, fmt.Errorf("%w: %v is not an IPv6 address", ErrInvalidAddress, addr)
+	}
+	return NewAAAADnsRecord(domain, ip, ttl), nil
+}
+
+func NewHINFODnsRecord(domain, cpu, os string, ttl uint32) *DnsRecord {
+	return &DnsRecord{
+		Type:   HINFO,
+		Domain: domain,
+		Class:  ClassIN,
+		Cpu:    cpu,
+		Os:     os,
+		TTL:    ttl,
+	}
+}
+
+func NewSOADnsRecord(domain, mname, rname string, serial, refresh, retry, expire, minimum, ttl uint32) *DnsRecord {
+	return &DnsRecord{
+		Type:    SOA,
+		Domain:  domain,
+		Class:   ClassIN,
+		MName:   mname,
+		RName:   rname,
+		Serial:  serial,
+		Refresh: refresh,
+		Retry:   retry,
+		Expire:  expire,
+		Minimum: minimum,
+		TTL:     ttl,
+	}
+}
+
+func NewTXTDnsRecord(domain string, txt []string, ttl uint32) *DnsRecord {
+	return &DnsRecord{
+		Type:   TXT,
+		Domain: domain,
+		Class:  ClassIN,
+		Txt:    txt,
+		TTL:    ttl,
+	}
+}
+
+func NewOPTDnsRecord(payloadSize uint16, flags uint32, options ...EDNSOption) *DnsRecord {
+	return &DnsRecord{
+		Type:        OPT,
+		PayloadSize: payloadSize,
+		TTL:         flags,
+		Options:     options,
+	}
+}
+
+// NewRawDnsRecord creates a record of type typ, such as DS or RRSIG, whose
+// RDATA is kept as raw bytes.
+func NewRawDnsRecord(typ RecordType, domain string, raw []byte, ttl uint32) *DnsRecord {
+	return &DnsRecord{
+		Type:   typ,
+		Domain: domain,
+		Class:  ClassIN,
+		Raw:    raw,
+		TTL:    ttl,
+	}
+}
+
+// NewSVCBDnsRecord creates a SVCB record pointing to the service endpoint
+// target with the given parameters, which have to be sorted by key.
+func NewSVCBDnsRecord(domain string, priority uint16, target string, params []SvcParam, ttl uint32) *DnsRecord {
+	return &DnsRecord{
+		Type:     SVCB,
+		Domain:   domain,
+		Class:    ClassIN,
+		Priority: priority,
+		Target:   target,
+		Params:   params,
+		TTL:      ttl,
+	}
+}
+
+// NewHTTPSDnsRecord is like NewSVCBDnsRecord, but creates the HTTPS record
+// used for HTTPS origins.
+func NewHTTPSDnsRecord(domain string, priority uint16, target string, params []SvcParam, ttl uint32) *DnsRecord {
+	rec := NewSVCBDnsRecord(domain, priority, target, params, ttl)
+	rec.Type = HTTPS
+	return rec
+}
+
 func ReadDnsRecord(buffer *BytePacketBuffer) (*DnsRecord, error) {
 	domain, err := buffer.ReadQName()
 	if err != nil {
@@ -460,7 +1499,8 @@ func ReadDnsRecord(buffer *BytePacketBuffer) (*DnsRecord, error) {
 
 	qtype := FromNum2RecordType(qtypeNum)
 
-	if _, err := buffer.Read2Bytes(); err != nil { // class
+	class, err := buffer.Read2Bytes()
+	if err != nil {
 		return nil, err
 	}
 
@@ -474,83 +1514,145 @@ func ReadDnsRecord(buffer *BytePacketBuffer) (*DnsRecord, error) {
 		return nil, err
 	}
 
+	// Records of class ANY only appear in dynamic updates, where they carry
+	// no data. The class of an OPT record is its payload size instead, so an
+	// OPT record advertising 255 bytes is not one of them.
+	if Class(class) == ClassANY && dataLen == 0 && qtype != OPT {
+		record := &DnsRecord{
+			Type:   qtype,
+			Domain: domain,
+			TTL:    ttl,
+			Class:  ClassANY,
+		}
+		if qtype == UNKNOWN {
+			record.QType = qtypeNum
+		}
+		return record, nil
+	}
+
+	// The record data has to take up exactly RDLENGTH bytes, otherwise a
+	// lying length lets one record bleed into the next.
+	start := buffer.Pos
+	record, err := readRecordData(buffer, domain, qtype, qtypeNum, class, dataLen, ttl)
+	if err != nil {
+		return nil, err
+	}
+	if qtype != OPT {
+		record.Class = Class(class)
+	}
+
+	if consumed := buffer.Pos - start; consumed != dataLen {
+		return nil, fmt.Errorf("record data of %d bytes does not match RDLENGTH %d", consumed, dataLen)
+	}
+	return record, nil
+}
+
+func readRecordData(buffer *BytePacketBuffer, domain string, qtype RecordType, qtypeNum, class, dataLen uint16, ttl uint32) (*DnsRecord, error) {
+	if info, ok := lookupRecordType(qtype); ok && info.codec != nil {
+		return readWithCodec(buffer, info.codec, &DnsRecord{Type: qtype, Domain: domain, TTL: ttl}, dataLen)
+	}
+
 	switch qtype {
-	case A:
-		rawAddr, err := buffer.Read4Bytes()
+	case DNAME:
+		target, err := buffer.ReadQName()
+		if err != nil {
+			return nil, err
+		}
+		return NewDNAMEDnsRecord(domain, target, ttl), nil
+	case SVCB, HTTPS:
+		end := int(buffer.Pos) + int(dataLen)
+		priority, err := buffer.Read2Bytes()
+		if err != nil {
+			return nil, err
+		}
+		target, err := buffer.ReadQName()
+		if err != nil {
+			return nil, err
+		}
+		params, err := readSvcParams(buffer, end)
 		if err != nil {
 			return nil, err
 		}
 
-		addr := net.IPv4(
-			byte((rawAddr>>24)&0xFF),
-			byte((rawAddr>>16)&0xFF),
-			byte((rawAddr>>8)&0xFF),
-			byte((rawAddr)&0xFF),
-		)
-
-		return NewADnsRecord(domain, addr, ttl), nil
-
-	case AAAA:
-		raw_addr1, err := buffer.Read4Bytes()
+		rec := NewSVCBDnsRecord(domain, priority, target, params, ttl)
+		rec.Type = qtype
+		return rec, nil
+	case HINFO:
+		cpu, err := buffer.ReadCharacterString()
 		if err != nil {
 			return nil, err
 		}
-		raw_addr2, err := buffer.Read4Bytes()
+		os, err := buffer.ReadCharacterString()
 		if err != nil {
 			return nil, err
 		}
-		raw_addr3, err := buffer.Read4Bytes()
+		return NewHINFODnsRecord(domain, cpu, os, ttl), nil
+	case SOA:
+		mname, err := buffer.ReadQName()
 		if err != nil {
 			return nil, err
 		}
-		raw_addr4, err := buffer.Read4Bytes()
+		rname, err := buffer.ReadQName()
 		if err != nil {
 			return nil, err
 		}
-		addr := net.IP{
-			byte((raw_addr1 >> 24) & 0xFF),
-			byte((raw_addr1 >> 16) & 0xFF),
-			byte((raw_addr1 >> 8) & 0xFF),
-			byte((raw_addr1 >> 0) & 0xFF),
-			byte((raw_addr2 >> 24) & 0xFF),
-			byte((raw_addr2 >> 16) & 0xFF),
-			byte((raw_addr2 >> 8) & 0xFF),
-			byte((raw_addr2 >> 0) & 0xFF),
-			byte((raw_addr3 >> 24) & 0xFF),
-			byte((raw_addr3 >> 16) & 0xFF),
-			byte((raw_addr3 >> 8) & 0xFF),
-			byte((raw_addr3 >> 0) & 0xFF),
-			byte((raw_addr4 >> 24) & 0xFF),
-			byte((raw_addr4 >> 16) & 0xFF),
-			byte((raw_addr4 >> 8) & 0xFF),
-			byte((raw_addr4 >> 0) & 0xFF),
-		}
-
-		return NewAAAADnsRecord(domain, addr, ttl), nil
-	case NS:
-		ns, err := buffer.ReadQName()
+		serial, err := buffer.Read4Bytes()
 		if err != nil {
 			return nil, err
 		}
-		return NewNSDnsRecord(domain, ns, ttl), nil
-	case CNAME:
-		cname, err := buffer.ReadQName()
+		refresh, err := buffer.Read4Bytes()
 		if err != nil {
 			return nil, err
 		}
-		return NewCNameDnsRecord(domain, cname, ttl), nil
-	case MX:
-		priority, err := buffer.Read2Bytes()
+		retry, err := buffer.Read4Bytes()
+		if err != nil {
+			return nil, err
+		}
+		expire, err := buffer.Read4Bytes()
 		if err != nil {
 			return nil, err
 		}
-		mx, err := buffer.ReadQName()
+		minimum, err := buffer.Read4Bytes()
 		if err != nil {
 			return nil, err
 		}
-		return NewMXDnsRecord(domain, mx, priority, ttl), nil
+		return NewSOADnsRecord(domain, mname, rname, serial, refresh, retry, expire, minimum, ttl), nil
+	case TXT:
+		// The RDATA is one or more character strings filling up the
+		// whole data length.
+		var txt []string
+		end := int(buffer.Pos) + int(dataLen)
+		for int(buffer.Pos) < end {
+			str, err := buffer.ReadCharacterString()
+			if err != nil {
+				return nil, err
+			}
+			txt = append(txt, str)
+		}
+		return NewTXTDnsRecord(domain, txt, ttl), nil
+	case OPT, DS, RRSIG, TSIG:
+		raw, err := buffer.GetRangeCopy(buffer.Pos, dataLen)
+		if err != nil {
+			return nil, err
+		}
+		if err := buffer.Step(dataLen); err != nil {
+			return nil, err
+		}
+
+		if qtype == OPT {
+			options, err := parseEDNSOptions(raw)
+			if err != nil {
+				return nil, err
+			}
+			return NewOPTDnsRecord(class, ttl, options...), nil
+		}
+		return NewRawDnsRecord(qtype, domain, raw, ttl), nil
 	default:
-		if err := buffer.Step(uint16(dataLen)); err != nil {
+		raw, err := buffer.GetRangeCopy(buffer.Pos, dataLen)
+		if err != nil {
+			return nil, err
+		}
+		if err := buffer.Step(dataLen); err != nil {
 			return nil, err
 		}
 
@@ -560,24 +1662,115 @@ func ReadDnsRecord(buffer *BytePacketBuffer) (*DnsRecord, error) {
 			QType:   qtypeNum,
 			DataLen: dataLen,
 			TTL:     ttl,
+			Raw:     raw,
 		}, nil
 	}
 }
 
+// wireLen advances c past the record as written by Write.
+func (d *DnsRecord) wireLen(c *wireCounter) error {
+	if d.Class == ClassANY && d.Raw == nil {
+		if err := c.name(d.Domain); err != nil {
+			return err
+		}
+		c.pos += 10
+		return nil
+	}
+
+	info, _ := lookupRecordType(d.Type)
+	switch d.Type {
+	case A, AAAA, NS, CNAME, DNAME, MX, SVCB, HTTPS, HINFO, SOA, TXT, OPT, DS, RRSIG, TSIG, UNKNOWN:
+	default:
+		if !info.custom {
+			// Question-only types fail to write.
+			return nil
+		}
+	}
+
+	var err error
+	if d.Type == TSIG {
+		err = c.uncompressedName(d.Domain)
+	} else {
+		err = c.name(d.Domain)
+	}
+	if err != nil {
+		return err
+	}
+	c.pos += 10
+
+	if info.custom {
+		n, err := c.customDataLen(d, info.codec)
+		c.pos += n
+		return err
+	}
+
+	switch d.Type {
+	case A:
+		c.pos += 4
+	case AAAA:
+		c.pos += 16
+	case NS, CNAME:
+		return c.name(d.Host)
+	case DNAME:
+		return c.uncompressedName(d.Host)
+	case MX:
+		c.pos += 2
+		return c.name(d.Host)
+	case SVCB, HTTPS:
+		c.pos += 2
+		err := c.uncompressedName(d.Target)
+		for _, p := range d.Params {
+			c.pos += 4 + len(p.Value)
+		}
+		return err
+	case HINFO:
+		c.pos += 2 + len(d.Cpu) + len(d.Os)
+	case SOA:
+		if err := c.name(d.MName); err != nil {
+			return err
+		}
+		if err := c.name(d.RName); err != nil {
+			return err
+		}
+		c.pos += 20
+	case TXT:
+		for _, str := range d.Txt {
+			c.pos += 1 + len(str)
+		}
+	case OPT, DS, RRSIG, TSIG, UNKNOWN:
+		c.pos += len(d.rawData())
+	}
+	return nil
+}
+
 func (d *DnsRecord) Write(buffer *BytePacketBuffer) (uint16, error) {
 	startPos := buffer.Pos
 
+	if d.Class == ClassANY && d.Raw == nil {
+		if err := d.writeEmpty(buffer); err != nil {
+			return 0, err
+		}
+		return buffer.Pos - startPos, nil
+	}
+
+	if info, ok := lookupRecordType(d.Type); ok && info.codec != nil {
+		if err := d.writeWithCodec(buffer, info); err != nil {
+			return 0, err
+		}
+		return buffer.Pos - startPos, nil
+	}
+
 	switch d.Type {
-	case A:
+	case DNAME:
 		err := buffer.WriteQName(d.Domain)
 		if err != nil {
 			return 0, err
 		}
-		err = buffer.Write2Byte(uint16(RecordTypeToNum(A)))
+		err = buffer.Write2Byte(uint16(RecordTypeToNum(DNAME)))
 		if err != nil {
 			return 0, err
 		}
-		err = buffer.Write2Byte(uint16(1))
+		err = buffer.Write2Byte(d.class())
 		if err != nil {
 			return 0, err
 		}
@@ -585,42 +1778,76 @@ func (d *DnsRecord) Write(buffer *BytePacketBuffer) (uint16, error) {
 		if err != nil {
 			return 0, err
 		}
-		err = buffer.Write2Byte(uint16(4))
+		pos := buffer.Pos
+		err = buffer.Write2Byte(uint16(0))
 		if err != nil {
 			return 0, err
 		}
 
-		ip := d.Addr.To4()
-		if ip == nil {
-			return 0, errors.New("invalid IPv4 address")
+		// The target must not be compressed, as DNAME is not one of the
+		// types every server knows.
+		compress := buffer.Compress
+		buffer.Compress = false
+		err = buffer.WriteQName(d.Host)
+		buffer.Compress = compress
+		if err != nil {
+			return 0, err
 		}
 
-		err = buffer.Write1Byte(ip[0])
+		size := buffer.Pos - (pos + 2)
+		buffer.Set2Bytes(pos, size)
+	case SVCB, HTTPS:
+		err := buffer.WriteQName(d.Domain)
 		if err != nil {
 			return 0, err
 		}
-		err = buffer.Write1Byte(ip[1])
+		err = buffer.Write2Byte(uint16(RecordTypeToNum(d.Type)))
 		if err != nil {
 			return 0, err
 		}
-		err = buffer.Write1Byte(ip[2])
+		err = buffer.Write2Byte(d.class())
 		if err != nil {
 			return 0, err
 		}
-		err = buffer.Write1Byte(ip[3])
+		err = buffer.Write4Byte(d.TTL)
 		if err != nil {
 			return 0, err
 		}
-	case NS:
+		pos := buffer.Pos
+		err = buffer.Write2Byte(uint16(0))
+		if err != nil {
+			return 0, err
+		}
+		err = buffer.Write2Byte(d.Priority)
+		if err != nil {
+			return 0, err
+		}
+
+		// The target name must not be compressed, see RFC 9460.
+		compress := buffer.Compress
+		buffer.Compress = false
+		err = buffer.WriteQName(d.Target)
+		buffer.Compress = compress
+		if err != nil {
+			return 0, err
+		}
+		err = writeSvcParams(buffer, d.Params)
+		if err != nil {
+			return 0, err
+		}
+
+		size := buffer.Pos - (pos + 2)
+		buffer.Set2Bytes(pos, size)
+	case HINFO:
 		err := buffer.WriteQName(d.Domain)
 		if err != nil {
 			return 0, err
 		}
-		err = buffer.Write2Byte(uint16(RecordTypeToNum(NS)))
+		err = buffer.Write2Byte(uint16(RecordTypeToNum(HINFO)))
 		if err != nil {
 			return 0, err
 		}
-		err = buffer.Write2Byte(uint16(1))
+		err = buffer.Write2Byte(d.class())
 		if err != nil {
 			return 0, err
 		}
@@ -633,23 +1860,27 @@ func (d *DnsRecord) Write(buffer *BytePacketBuffer) (uint16, error) {
 		if err != nil {
 			return 0, err
 		}
-		err = buffer.WriteQName(d.Host)
+		err = buffer.WriteCharacterString(d.Cpu)
+		if err != nil {
+			return 0, err
+		}
+		err = buffer.WriteCharacterString(d.Os)
 		if err != nil {
 			return 0, err
 		}
 
 		size := buffer.Pos - (pos + 2)
 		buffer.Set2Bytes(pos, size)
-	case CNAME:
+	case SOA:
 		err := buffer.WriteQName(d.Domain)
 		if err != nil {
 			return 0, err
 		}
-		err = buffer.Write2Byte(uint16(RecordTypeToNum(CNAME)))
+		err = buffer.Write2Byte(uint16(RecordTypeToNum(SOA)))
 		if err != nil {
 			return 0, err
 		}
-		err = buffer.Write2Byte(uint16(1))
+		err = buffer.Write2Byte(d.class())
 		if err != nil {
 			return 0, err
 		}
@@ -662,23 +1893,33 @@ func (d *DnsRecord) Write(buffer *BytePacketBuffer) (uint16, error) {
 		if err != nil {
 			return 0, err
 		}
-		err = buffer.WriteQName(d.Host)
+		err = buffer.WriteQName(d.MName)
 		if err != nil {
 			return 0, err
 		}
+		err = buffer.WriteQName(d.RName)
+		if err != nil {
+			return 0, err
+		}
+		for _, v := range []uint32{d.Serial, d.Refresh, d.Retry, d.Expire, d.Minimum} {
+			err = buffer.Write4Byte(v)
+			if err != nil {
+				return 0, err
+			}
+		}
 
 		size := buffer.Pos - (pos + 2)
 		buffer.Set2Bytes(pos, size)
-	case MX:
+	case TXT:
 		err := buffer.WriteQName(d.Domain)
 		if err != nil {
 			return 0, err
 		}
-		err = buffer.Write2Byte(uint16(RecordTypeToNum(MX)))
+		err = buffer.Write2Byte(uint16(RecordTypeToNum(TXT)))
 		if err != nil {
 			return 0, err
 		}
-		err = buffer.Write2Byte(uint16(1))
+		err = buffer.Write2Byte(d.class())
 		if err != nil {
 			return 0, err
 		}
@@ -691,27 +1932,64 @@ func (d *DnsRecord) Write(buffer *BytePacketBuffer) (uint16, error) {
 		if err != nil {
 			return 0, err
 		}
-		err = buffer.Write2Byte(d.Priority)
+		for _, str := range d.Txt {
+			err = buffer.WriteCharacterString(str)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		size := buffer.Pos - (pos + 2)
+		buffer.Set2Bytes(pos, size)
+	case OPT, DS, RRSIG, TSIG:
+		// The key name of a TSIG record is never compressed.
+		compress := buffer.Compress
+		buffer.Compress = compress && d.Type != TSIG
+		err := buffer.WriteQName(d.Domain)
+		buffer.Compress = compress
 		if err != nil {
 			return 0, err
 		}
-		err = buffer.WriteQName(d.Host)
+		err = buffer.Write2Byte(uint16(RecordTypeToNum(d.Type)))
 		if err != nil {
 			return 0, err
 		}
-
-		size := buffer.Pos - (pos + 2)
-		buffer.Set2Bytes(pos, size)
-	case AAAA:
+		class := d.class()
+		if d.Type == OPT {
+			class = d.PayloadSize
+		}
+		err = buffer.Write2Byte(class)
+		if err != nil {
+			return 0, err
+		}
+		err = buffer.Write4Byte(d.TTL)
+		if err != nil {
+			return 0, err
+		}
+		raw := d.rawData()
+		err = buffer.Write2Byte(uint16(len(raw)))
+		if err != nil {
+			return 0, err
+		}
+		for _, b := range raw {
+			err = buffer.Write1Byte(b)
+			if err != nil {
+				return 0, err
+			}
+		}
+	case AXFR, ANY:
+		return 0, fmt.Errorf("%s is only valid in questions", d.Type)
+	case UNKNOWN:
+		// Records of types we don't know are passed on as they came in.
 		err := buffer.WriteQName(d.Domain)
 		if err != nil {
 			return 0, err
 		}
-		err = buffer.Write2Byte(uint16(RecordTypeToNum(AAAA)))
+		err = buffer.Write2Byte(d.QType)
 		if err != nil {
 			return 0, err
 		}
-		err = buffer.Write2Byte(uint16(1))
+		err = buffer.Write2Byte(d.class())
 		if err != nil {
 			return 0, err
 		}
@@ -719,30 +1997,132 @@ func (d *DnsRecord) Write(buffer *BytePacketBuffer) (uint16, error) {
 		if err != nil {
 			return 0, err
 		}
-		pos := buffer.Pos
-		err = buffer.Write2Byte(uint16(16))
+		err = buffer.Write2Byte(uint16(len(d.Raw)))
 		if err != nil {
 			return 0, err
 		}
-
-		ip := d.Addr.To16()
-		if ip == nil {
-			return 0, fmt.Errorf("invalid IPv6 address")
-		}
-
-		for i := 0; i < len(ip); i += 2 {
-			segment := binary.BigEndian.Uint16(ip[i : i+2])
-			err = buffer.Write2Byte(segment)
+		for _, b := range d.Raw {
+			err = buffer.Write1Byte(b)
 			if err != nil {
 				return 0, err
 			}
 		}
-
-		size := buffer.Pos - (pos + 2)
-		buffer.Set2Bytes(pos, size)
-	case UNKNOWN:
-		fmt.Printf("Skipping record: %v\n", d)
 	}
 
 	return (buffer.Pos - startPos), nil
 }
+
+// InZone reports whether name is zone itself or lies below it, comparing
+// whole labels case-insensitively. So "a.example.com" is in "example.com",
+// "notexample.com" is not, and every name is in the root zone "". Names
+// that are not valid are in no zone, and no name is in an invalid zone.
+func InZone(name, zone string) bool {
+	name, ok := canonicalName(name)
+	if !ok {
+		return false
+	}
+	zone, ok = canonicalName(zone)
+	if !ok {
+		return false
+	}
+
+	for name != zone {
+		if name == "" {
+			return false
+		}
+		name = parentName(name)
+	}
+	return true
+}
+
+// SynthesizeDNAME returns the name qname is redirected to by the DNAME
+// record dname, like "www.example.net" for "www.example.com" and a DNAME
+// from "example.com" to "example.net". It reports false if qname is not
+// below the owner of dname, or the result would be too long.
+func SynthesizeDNAME(dname *DnsRecord, qname string) (string, bool) {
+	owner, ok := canonicalName(dname.Domain)
+	if !ok {
+		return "", false
+	}
+	name, ok := canonicalName(qname)
+	if !ok || name == owner || !InZone(name, owner) {
+		return "", false
+	}
+	host, ok := canonicalName(dname.Host)
+	if !ok {
+		return "", false
+	}
+
+	// The prefix keeps the dot in front of owner, which is dropped again if
+	// host is the root.
+	prefix := strings.TrimSuffix(name, owner)
+	if owner == "" {
+		prefix += "."
+	}
+	target := prefix + host
+	if host == "" {
+		target = strings.TrimSuffix(prefix, ".")
+	}
+	if canonical, ok := canonicalName(target); !ok || canonical != target {
+		return "", false
+	}
+	return target, true
+}
+
+// CanonicalName returns name in the form used to compare names and to key
+// maps by them: lowercased and without a trailing dot, so "WWW.Example.COM."
+// becomes "www.example.com". The root is "". Escapes are honored, so
+// "a\.b" is a single label, and written the way ReadQName writes them, so
+// "\065" becomes "a". Names that cannot be encoded, with an empty label, a
+// label longer than 63 bytes or more than 255 bytes on the wire, also yield
+// "", so callers that have to tell them from the root check the name first.
+func CanonicalName(name string) string {
+	canonical, _ := canonicalName(name)
+	return canonical
+}
+
+// canonicalName is like CanonicalName, but reports false for names that
+// cannot be encoded instead of mapping them to the root.
+func canonicalName(name string) (string, bool) {
+	labels, err := splitLabels(name)
+	if err != nil {
+		return "", false
+	}
+
+	var canonical []byte
+	for i, label := range labels {
+		if len(label) > 63 {
+			return "", false
+		}
+		if i > 0 {
+			canonical = append(canonical, '.')
+		}
+		canonical = appendLabel(canonical, label, true)
+	}
+	return string(canonical), true
+}
+
+// parentName returns the name one label above the canonical name, "" for
+// the root. Dots escaped within a label don't separate labels.
+func parentName(name string) string {
+	for i := 0; i < len(name); i++ {
+		switch name[i] {
+		case '\\':
+			i++
+		case '.':
+			return name[i+1:]
+		}
+	}
+	return ""
+}
+
+// sameName reports whether a and b are the same name once canonicalized.
+// A name that is not valid is only the same as an identical string.
+func sameName(a, b string) bool {
+	canonicalA, okA := canonicalName(a)
+	canonicalB, okB := canonicalName(b)
+	if !okA || !okB {
+		return a == b
+	}
+	return canonicalA == canonicalB
+}
@@ -0,0 +1,1128 @@
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fixtures are the captured packets in the repository root.
+var fixtures = []string{
+	"../query_packet.txt",
+	"../response_packet.txt",
+	"../google_response_packet.txt",
+	"../google_multi_response_packet.txt",
+}
+
+func readFixture(t testing.TB, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func FuzzUnpack(f *testing.F) {
+	for _, name := range fixtures {
+		f.Add(readFixture(f, name))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p, err := Unpack(data)
+		if err != nil {
+			if p != nil {
+				t.Fatalf("Unpack returned a packet along with %v", err)
+			}
+			return
+		}
+		if p == nil {
+			t.Fatal("Unpack returned neither a packet nor an error")
+		}
+		// Whatever was read has to be writable again, or fail cleanly.
+		if msg, err := p.Pack(); err == nil {
+			if _, err := Unpack(msg); err != nil {
+				t.Fatalf("repacked message doesn't parse: %v", err)
+			}
+		}
+		_ = p.String()
+	})
+}
+
+func TestCanonicalName(t *testing.T) {
+	long := strings.Repeat("a", 64)
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"WWW.Example.COM.", "www.example.com", true},
+		{"", "", true},
+		{".", "", true},
+		{`a\.b.Example.com`, `a\.b.example.com`, true},
+		{`\065\066.com`, "ab.com", true},
+		{`a\\.com`, `a\\.com`, true},
+		{"a..b", "", false},
+		{long + ".com", "", false},
+		{strings.Repeat("abcdefgh.", 32) + "com", "", false},
+		{`\999.com`, "", false},
+		{`com\`, "", false},
+	}
+	for _, tt := range tests {
+		if got := CanonicalName(tt.name); got != tt.want {
+			t.Errorf("CanonicalName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+		if _, ok := canonicalName(tt.name); ok != tt.ok {
+			t.Errorf("canonicalName(%q) reports %v, want %v", tt.name, ok, tt.ok)
+		}
+	}
+}
+
+func TestUnpackMultiResponse(t *testing.T) {
+	// Every owner name is a pointer to the question, so reading a record
+	// must continue right after the pointer, not where it points to.
+	p, err := Unpack(readFixture(t, "../google_multi_response_packet.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"142.250.181.238",
+		"142.250.181.206",
+		"142.250.180.14",
+		"142.250.180.46",
+		"142.250.181.174",
+		"142.250.180.78",
+	}
+	if len(p.Answers) != len(want) {
+		t.Fatalf("got %d answers, want %d", len(p.Answers), len(want))
+	}
+	for i, rec := range p.Answers {
+		if rec.Domain != "google.com" || rec.Type != A || rec.TTL != 248 {
+			t.Errorf("answer %d is %v", i, rec)
+		}
+		if got := rec.Addr.String(); got != want[i] {
+			t.Errorf("answer %d has address %s, want %s", i, got, want[i])
+		}
+	}
+}
+
+func TestMultipleQuestions(t *testing.T) {
+	p := NewDnsPacket()
+	p.Header.ID = 1234
+	p.AddQuestion(NewDnsQuestion("example.com", A))
+	p.AddQuestion(NewDnsQuestion("example.org", AAAA))
+	if p.Header.Questions != 2 {
+		t.Fatalf("header counts %d questions, want 2", p.Header.Questions)
+	}
+
+	msg, err := p.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := Unpack(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Equal(p) {
+		t.Errorf("parsed\n%v\nwant\n%v", parsed, p)
+	}
+
+	// A count larger than the questions present fails with the question
+	// that is missing.
+	msg[5] = 3
+	_, err = Unpack(msg)
+	if err == nil || !strings.Contains(err.Error(), "question 3 of 3") {
+		t.Errorf("Unpack with a missing question returned %v", err)
+	}
+}
+
+func TestHINFORoundTrip(t *testing.T) {
+	for _, tt := range []struct{ cpu, os string }{
+		{"Intel", "Linux"},
+		{"", "Linux"},
+		{"Intel", ""},
+		{"", ""},
+	} {
+		p := NewDnsPacket()
+		p.Answers = append(p.Answers, NewHINFODnsRecord("host.example.com", tt.cpu, tt.os, 3600))
+		msg, err := p.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := Unpack(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := parsed.Answers[0]
+		if rec.Type != HINFO || rec.Cpu != tt.cpu || rec.Os != tt.os {
+			t.Errorf("HINFO %q %q read back as %v", tt.cpu, tt.os, rec)
+		}
+	}
+}
+
+func TestOpcodes(t *testing.T) {
+	for _, tt := range []struct {
+		opcode Opcode
+		name   string
+	}{
+		{OpcodeQuery, "QUERY"},
+		{OpcodeIQuery, "IQUERY"},
+		{OpcodeStatus, "STATUS"},
+		{OpcodeNotify, "NOTIFY"},
+		{OpcodeUpdate, "UPDATE"},
+		{15, "OPCODE15"},
+	} {
+		if got := tt.opcode.String(); got != tt.name {
+			t.Errorf("Opcode(%d).String() = %q, want %q", tt.opcode, got, tt.name)
+		}
+
+		p := NewDnsPacket()
+		p.Header.Opcode = tt.opcode
+		p.Header.RecursionDesired = true
+		p.Header.Response = true
+		msg, err := p.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := Opcode(msg[2] >> 3 & 0x0F); got != tt.opcode {
+			t.Errorf("%s written as opcode %d", tt.name, got)
+		}
+		if msg[2]&0x81 != 0x81 {
+			t.Errorf("%s clobbered the QR or RD bit: %08b", tt.name, msg[2])
+		}
+
+		parsed, err := Unpack(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.Header.Opcode != tt.opcode {
+			t.Errorf("%s read back as %s", tt.name, parsed.Header.Opcode)
+		}
+	}
+
+	p := NewDnsPacket()
+	p.Header.Opcode = 16
+	if _, err := p.Pack(); err == nil {
+		t.Error("opcode 16 was written")
+	}
+}
+
+// equalTestPacket returns a response with a record in every section, using
+// the given form of its IPv4 address.
+func equalTestPacket(addr net.IP) *DnsPacket {
+	p := NewDnsPacket()
+	p.Header.ID = 7
+	p.Header.Response = true
+	p.AddQuestion(NewDnsQuestion("www.example.com", A))
+	p.Answers = append(p.Answers, NewADnsRecord("www.example.com", addr, 300))
+	p.Authorities = append(p.Authorities, NewNSDnsRecord("example.com", "ns1.example.com", 3600))
+	p.Resources = append(p.Resources, NewADnsRecord("ns1.example.com", addr, 3600))
+	return p
+}
+
+func TestPacketEqual(t *testing.T) {
+	short := equalTestPacket(net.IP{192, 0, 2, 1})
+	long := equalTestPacket(net.ParseIP("192.0.2.1"))
+	if len(short.Answers[0].Addr) == len(long.Answers[0].Addr) {
+		t.Fatal("addresses have the same representation")
+	}
+	if !short.Equal(long) || !long.Equal(short) {
+		t.Error("packets differing in address representation are not equal")
+	}
+
+	upper := equalTestPacket(net.IP{192, 0, 2, 1})
+	upper.Questions[0].Name = "WWW.Example.COM."
+	upper.Answers[0].Domain = "WWW.EXAMPLE.COM"
+	if !short.Equal(upper) {
+		t.Error("packets differing in the case of names are not equal")
+	}
+
+	for name, edit := range map[string]func(p *DnsPacket){
+		"TTL":       func(p *DnsPacket) { p.Answers[0].TTL++ },
+		"address":   func(p *DnsPacket) { p.Resources[0].Addr = net.IP{192, 0, 2, 2} },
+		"ID":        func(p *DnsPacket) { p.Header.ID++ },
+		"question":  func(p *DnsPacket) { p.Questions[0].Type = AAAA },
+		"authority": func(p *DnsPacket) { p.Authorities[0].Host = "ns2.example.com" },
+		"records":   func(p *DnsPacket) { p.Answers = p.Answers[:0] },
+	} {
+		other := equalTestPacket(net.IP{192, 0, 2, 1})
+		edit(other)
+		if short.Equal(other) {
+			t.Errorf("packets differing in %s are equal", name)
+		}
+	}
+}
+
+func TestPacketClone(t *testing.T) {
+	orig := equalTestPacket(net.IP{192, 0, 2, 1})
+	orig.Answers = append(orig.Answers, NewTXTDnsRecord("www.example.com", []string{"text"}, 300))
+	clone := orig.Clone()
+	if !clone.Equal(orig) {
+		t.Fatalf("clone\n%v\ndiffers from\n%v", clone, orig)
+	}
+
+	clone.Header.ID++
+	clone.Questions[0].Name = "changed.example.com"
+	clone.Answers[0].TTL = 1
+	clone.Answers[0].Addr[3] = 99
+	clone.Answers[1].Txt[0] = "changed"
+	clone.Resources = clone.Resources[:0]
+
+	if orig.Header.ID != 7 || orig.Questions[0].Name != "www.example.com" {
+		t.Error("changing the clone changed the header or question of the original")
+	}
+	if rec := orig.Answers[0]; rec.TTL != 300 || !rec.Addr.Equal(net.IP{192, 0, 2, 1}) {
+		t.Errorf("changing the clone changed the original answer to %v", rec)
+	}
+	if orig.Answers[1].Txt[0] != "text" {
+		t.Error("changing the clone changed the original TXT record")
+	}
+	if len(orig.Resources) != 1 {
+		t.Error("changing the clone changed the additional section of the original")
+	}
+}
+
+// rawRecord returns a record owned by the root with the given type,
+// RDLENGTH and data, which need not agree.
+func rawRecord(qtype, dataLen uint16, data []byte) *BytePacketBuffer {
+	msg := []byte{0, byte(qtype >> 8), byte(qtype), 0, 1, 0, 0, 0, 60, byte(dataLen >> 8), byte(dataLen)}
+	msg = append(msg, data...)
+	buffer := NewBytePacketBufferSize(len(msg))
+	buffer.SetBuffer(msg)
+	return buffer
+}
+
+func TestReadUnknownRecordPastEnd(t *testing.T) {
+	buffer := rawRecord(99, 256, []byte{1, 2, 3, 4})
+	if rec, err := ReadDnsRecord(buffer); err == nil {
+		t.Fatalf("ReadDnsRecord = %v, want an error", rec)
+	}
+	if int(buffer.Pos) > len(buffer.Buf) {
+		t.Errorf("position %d is past the end of the buffer", buffer.Pos)
+	}
+
+	if err := buffer.Step(uint16(len(buffer.Buf))); !errors.Is(err, ErrBufferOverflow) {
+		t.Errorf("Step past the end returned %v", err)
+	}
+}
+
+func TestReadRecordDataLength(t *testing.T) {
+	addr := []byte{192, 0, 2, 1}
+	if rec, err := ReadDnsRecord(rawRecord(1, 4, addr)); err != nil || !rec.Addr.Equal(net.IP(addr)) {
+		t.Fatalf("ReadDnsRecord = %v, %v", rec, err)
+	}
+
+	for _, tt := range []struct {
+		name           string
+		qtype, dataLen uint16
+		data           []byte
+	}{
+		{"A shorter", 1, 3, addr},
+		{"A longer", 1, 5, append(addr, 0)},
+		{"NS shorter", 2, 3, []byte("\x03com\x00")},
+		{"NS longer", 2, 7, []byte("\x03com\x00\x00\x00")},
+	} {
+		if rec, err := ReadDnsRecord(rawRecord(tt.qtype, tt.dataLen, tt.data)); err == nil {
+			t.Errorf("%s RDLENGTH than the data: read %v", tt.name, rec)
+		}
+	}
+}
+
+func TestAAAARoundTrip(t *testing.T) {
+	for _, s := range []string{"::", "::1", "2001:db8::1", "2001:db8:85a3:8d3:1319:8a2e:370:7348"} {
+		addr := net.ParseIP(s)
+		p := NewDnsPacket()
+		p.Answers = append(p.Answers, NewAAAADnsRecord("example.com", addr, 300))
+		msg, err := p.Pack()
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		parsed, err := Unpack(msg)
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		if got := parsed.Answers[0].Addr; !got.Equal(addr) {
+			t.Errorf("%s read back as %v", s, got)
+		}
+	}
+
+	for _, s := range []string{"192.0.2.1", "::ffff:192.0.2.1"} {
+		p := NewDnsPacket()
+		p.Answers = append(p.Answers, NewAAAADnsRecord("example.com", net.ParseIP(s), 300))
+		if _, err := p.Pack(); !errors.Is(err, ErrInvalidAddress) {
+			t.Errorf("writing AAAA %s returned %v, want ErrInvalidAddress", s, err)
+		}
+	}
+}
+
+func TestPacketWriteSize(t *testing.T) {
+	for _, p := range []*DnsPacket{
+		NewDnsPacket(),
+		NewQuery("www.example.com", A, WithEDNS(1232)),
+		equalTestPacket(net.IP{192, 0, 2, 1}),
+	} {
+		buffer := NewBytePacketBuffer()
+		n, err := p.Write(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int(buffer.Pos) {
+			t.Errorf("Write returned %d, but wrote %d bytes", n, buffer.Pos)
+		}
+	}
+
+	// Writing after other data only counts the packet.
+	buffer := NewBytePacketBuffer()
+	buffer.Write2Byte(0)
+	p := NewQuery("www.example.com", A)
+	n, err := p.Write(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int(buffer.Pos)-2 {
+		t.Errorf("Write returned %d, but wrote %d bytes", n, buffer.Pos-2)
+	}
+}
+
+func TestInZone(t *testing.T) {
+	long := strings.Repeat("a", 64)
+	tests := []struct {
+		name, zone string
+		want       bool
+	}{
+		{"example.com", "example.com", true},
+		{"a.example.com", "example.com", true},
+		{"Example.COM.", "example.com", true},
+		{"fooexample.com", "example.com", false},
+		{"example.com", "a.example.com", false},
+		{"anything", "", true},
+		{"anything.", ".", true},
+		{`a\.example.com`, "example.com", false},
+		{`a\.example.com`, "com", true},
+		{long + ".com", "com", false},
+		{long, long, false},
+		{"example.com", long, false},
+	}
+	for _, tt := range tests {
+		if got := InZone(tt.name, tt.zone); got != tt.want {
+			t.Errorf("InZone(%q, %q) = %v, want %v", tt.name, tt.zone, got, tt.want)
+		}
+	}
+
+	if sameName(long+".com", "b"+long+".com") {
+		t.Error("distinct invalid names are the same name")
+	}
+}
+
+func TestWireLen(t *testing.T) {
+	svcb := NewHTTPSDnsRecord("example.com", 1, "cdn.example.com", []SvcParam{{Key: SvcALPN, Value: []byte("\x02h2")}}, 300)
+	packets := []*DnsPacket{
+		NewDnsPacket(),
+		NewQuery("www.example.com", A, WithEDNS(1232), WithNSID()),
+		equalTestPacket(net.IP{192, 0, 2, 1}),
+	}
+	p, _ := zoneResponse(t)
+	packets = append(packets, p)
+	p = NewDnsPacket()
+	p.Answers = append(p.Answers,
+		NewSOADnsRecord("example.com", "ns1.example.com", "admin.example.com", 1, 2, 3, 4, 5, 3600),
+		NewTXTDnsRecord("example.com", []string{"a", "bc"}, 300),
+		NewHINFODnsRecord("example.com", "cpu", "os", 300),
+		NewDNAMEDnsRecord("example.com", "example.net", 300),
+		svcb,
+		NewRawDnsRecord(RRSIG, "example.com", []byte{1, 2, 3}, 300))
+	packets = append(packets, p)
+
+	for i, p := range packets {
+		for _, compress := range []bool{true, false} {
+			buffer := NewBytePacketBufferSize(maxMessageSize)
+			buffer.Compress = compress
+			if _, err := p.Write(buffer); err != nil {
+				t.Fatal(err)
+			}
+			got, err := p.wireLen(compress)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != int(buffer.Pos) {
+				t.Errorf("packet %d with compression %v: wireLen = %d, written %d bytes", i, compress, got, buffer.Pos)
+			}
+		}
+		if n, _ := p.WireLen(); n != mustPackLen(t, p) {
+			t.Errorf("packet %d: WireLen = %d, Pack wrote %d bytes", i, n, mustPackLen(t, p))
+		}
+	}
+}
+
+func mustPackLen(t *testing.T, p *DnsPacket) int {
+	t.Helper()
+	msg, err := p.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(msg)
+}
+
+func TestTTLDuration(t *testing.T) {
+	rec := NewADnsRecord("example.com", net.IPv4(192, 0, 2, 1), 3600)
+	if d := rec.TTLDuration(); d != time.Hour {
+		t.Errorf("TTLDuration() = %v, want 1h", d)
+	}
+
+	tests := []struct {
+		ttl  time.Duration
+		want uint32
+	}{
+		{time.Hour, 3600},
+		{1500 * time.Millisecond, 1},
+		{0, 0},
+		{-time.Minute, 0},
+		{(math.MaxUint32 + 1) * time.Second, math.MaxUint32},
+	}
+	for _, tt := range tests {
+		rec.SetTTLDuration(tt.ttl)
+		if rec.TTL != tt.want {
+			t.Errorf("SetTTLDuration(%v) set TTL %d, want %d", tt.ttl, rec.TTL, tt.want)
+		}
+	}
+}
+
+func TestPackLarge(t *testing.T) {
+	p := NewDnsPacket()
+	p.Header.Response = true
+	for i := range 100 {
+		p.Answers = append(p.Answers, NewTXTDnsRecord("example.com", []string{strings.Repeat("x", i)}, 300))
+	}
+	msg, err := p.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg) <= 512 {
+		t.Fatalf("packed %d bytes, want more than 512", len(msg))
+	}
+	parsed, err := Unpack(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Equal(p) {
+		t.Errorf("large packet changed in a round trip")
+	}
+
+	for range 400 {
+		p.Answers = append(p.Answers, NewTXTDnsRecord("example.com", []string{strings.Repeat("x", 200)}, 300))
+	}
+	if _, err := p.Pack(); !errors.Is(err, ErrPacketTooLarge) {
+		t.Errorf("packing more than 65535 bytes returned %v", err)
+	}
+}
+
+func TestHeaderFlags(t *testing.T) {
+	query := NewQuery("example.com", A).Header
+	if s := query.FlagsString(); s != "rd" {
+		t.Errorf("query flags are %q, want %q", s, "rd")
+	}
+
+	resp := *query
+	resp.SetResponseFlags()
+	if s := resp.FlagsString(); s != "qr rd ra" {
+		t.Errorf("response flags are %q, want %q", s, "qr rd ra")
+	}
+
+	var h DnsHeader
+	for f := FlagQR; f <= FlagCD; f++ {
+		h.SetFlag(f, true)
+	}
+	if s := h.FlagsString(); s != "qr aa tc rd ra ad cd" {
+		t.Errorf("all flags are %q", s)
+	}
+	h.SetFlag(FlagTC, false)
+	if h.TruncatedMessage || h.Flag(FlagTC) || !h.Flag(FlagAA) {
+		t.Errorf("clearing tc left %q", h.FlagsString())
+	}
+	if h.Flag(HeaderFlag(100)) || HeaderFlag(100).String() != "FLAG100" {
+		t.Error("unknown flag is set or misnamed")
+	}
+}
+
+func TestSectionCounts(t *testing.T) {
+	msg := readFixture(t, "../response_packet.txt")
+
+	inflated := append([]byte(nil), msg...)
+	inflated[6], inflated[7] = 0xFF, 0xFF
+	_, err := Unpack(inflated)
+	if err == nil || !strings.Contains(err.Error(), "65535") {
+		t.Errorf("answer count of 65535 returned %v", err)
+	}
+
+	_, err = Unpack(append(msg, 0xDE, 0xAD))
+	if !errors.Is(err, ErrTrailingData) {
+		t.Errorf("trailing bytes returned %v, want %v", err, ErrTrailingData)
+	}
+
+	// Reading from a buffer leaves the rest of it alone.
+	buffer := NewBytePacketBuffer()
+	copy(buffer.Buf, append(msg, 0xDE, 0xAD))
+	if _, err := FromBuffer2DnsPacket(buffer); err != nil {
+		t.Errorf("FromBuffer2DnsPacket with bytes left: %v", err)
+	}
+	if int(buffer.Pos) != len(msg) {
+		t.Errorf("read %d bytes, want %d", buffer.Pos, len(msg))
+	}
+}
+
+func TestUnpackShort(t *testing.T) {
+	for _, msg := range [][]byte{nil, {}, {0x12, 0x34, 0x01, 0x00, 0x00}, make([]byte, headerLen-1)} {
+		if _, err := Unpack(msg); !errors.Is(err, ErrShortPacket) {
+			t.Errorf("Unpack(%x) returned %v, want %v", msg, err, ErrShortPacket)
+		}
+	}
+
+	header := []byte{0x12, 0x34, 0x81, 0x80, 0, 0, 0, 0, 0, 0, 0, 0}
+	p, err := Unpack(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Header.ID != 0x1234 || !p.Header.Response || len(p.Questions)+len(p.Answers)+len(p.Authorities)+len(p.Resources) != 0 {
+		t.Errorf("bare header parsed to\n%v", p)
+	}
+}
+
+// writtenQuestion returns the wire form of q.
+func writtenQuestion(t *testing.T, q *DnsQuestion) []byte {
+	t.Helper()
+	buffer := NewBytePacketBuffer()
+	if err := q.Write(buffer); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Buf[:buffer.Pos]
+}
+
+func TestANY(t *testing.T) {
+	if got := writtenQuestion(t, NewDnsQuestion("example.com", ANY)); got[len(got)-3] != 255 || got[len(got)-4] != 0 {
+		t.Errorf("ANY question written as %x", got)
+	}
+
+	buffer := nameBuffer(t, "example.com")
+	buffer.Buf = append(buffer.Buf, 0, 255, 0, 1)
+	q := NewDnsQuestion("", UNKNOWN)
+	if err := q.Read(buffer); err != nil {
+		t.Fatal(err)
+	}
+	if q.Type != ANY {
+		t.Errorf("question of type 255 read as %s", q.Type)
+	}
+
+	rec, err := ReadDnsRecord(rawRecord(255, 2, []byte{1, 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Type != UNKNOWN || rec.QType != 255 {
+		t.Errorf("record of type 255 read as %s (%d)", rec.Type, rec.QType)
+	}
+	if FromNum2RecordType(255) != UNKNOWN || FromNum2QuestionType(255) != ANY || RecordTypeToNum(ANY) != 255 {
+		t.Error("ANY maps to the wrong number")
+	}
+}
+
+func TestUnknownRecordRoundTrip(t *testing.T) {
+	p := NewDnsPacket()
+	p.Header.Response = true
+	p.AddQuestion(NewDnsQuestion("example.com", A))
+	unknown := NewUnknownDnsRecord("example.com", 99, 5, 300)
+	unknown.Raw = []byte{0xDE, 0xAD, 0xBE, 0xEF, 0x00}
+	p.Answers = append(p.Answers, unknown, NewADnsRecord("example.com", net.IPv4(192, 0, 2, 1), 300))
+
+	msg, err := p.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "\xc0\x0c\x00\x63\x00\x01\x00\x00\x01\x2c\x00\x05\xde\xad\xbe\xef\x00"
+	if !strings.Contains(string(msg), want) {
+		t.Errorf("unknown record not written verbatim in %x", msg)
+	}
+
+	parsed, err := Unpack(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := parsed.Answers[0]
+	if rec.Type != UNKNOWN || rec.QType != 99 || rec.DataLen != 5 || string(rec.Raw) != string(unknown.Raw) {
+		t.Errorf("unknown record read as %+v", rec)
+	}
+	if !parsed.Answers[1].Addr.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("record after the unknown one read as %v", parsed.Answers[1])
+	}
+
+	again, err := parsed.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != string(msg) {
+		t.Errorf("passing the packet through changed it from\n%x\nto\n%x", msg, again)
+	}
+}
+
+func TestDNAME(t *testing.T) {
+	p := NewDnsPacket()
+	p.Header.Response = true
+	p.Answers = append(p.Answers, NewDNAMEDnsRecord("example.com", "example.net", 300))
+	msg, err := p.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := Unpack(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dname := parsed.Answers[0]
+	if dname.Type != DNAME || dname.Host != "example.net" || RecordTypeToNum(DNAME) != 39 {
+		t.Fatalf("DNAME read as %v", dname)
+	}
+
+	long := strings.Repeat("a", 63) + "." + strings.Repeat("b", 63) + "." + strings.Repeat("c", 63)
+	for _, tt := range []struct {
+		qname  string
+		target string
+		ok     bool
+	}{
+		{"www.example.com", "www.example.net", true},
+		{"a.b.Example.COM.", "a.b.example.net", true},
+		{"example.com", "", false},
+		{"www.example.org", "", false},
+		{"www.fooexample.com", "", false},
+	} {
+		target, ok := SynthesizeDNAME(dname, tt.qname)
+		if target != tt.target || ok != tt.ok {
+			t.Errorf("SynthesizeDNAME(%q) = %q, %v, want %q, %v", tt.qname, target, ok, tt.target, tt.ok)
+		}
+	}
+
+	// The target would exceed 255 bytes.
+	longer := NewDNAMEDnsRecord("example.com", strings.Repeat("x", 60)+".example.net", 300)
+	if target, ok := SynthesizeDNAME(longer, long+".example.com"); ok {
+		t.Errorf("DNAME synthesized %d bytes long %q", len(target), target)
+	}
+
+	toRoot := NewDNAMEDnsRecord("example.com", "", 300)
+	if target, ok := SynthesizeDNAME(toRoot, "www.example.com"); target != "www" || !ok {
+		t.Errorf("DNAME to the root synthesized %q, %v", target, ok)
+	}
+}
+
+func TestHexDump(t *testing.T) {
+	p := equalTestPacket(net.IPv4(192, 0, 2, 1))
+	dump := p.HexDump()
+	if dump == "" {
+		t.Fatal("HexDump of a valid packet is empty")
+	}
+	parsed, err := FromHex(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Equal(p) {
+		t.Errorf("HexDump %s parsed to\n%v", dump, parsed)
+	}
+
+	// A dump split over lines parses all the same.
+	var lines []string
+	for len(dump) > 32 {
+		lines = append(lines, "\t"+dump[:32])
+		dump = dump[32:]
+	}
+	lines = append(lines, dump)
+	if split, err := FromHex(strings.Join(lines, "\n")); err != nil || !split.Equal(p) {
+		t.Errorf("split dump parsed to %v, %v", split, err)
+	}
+
+	if _, err := FromHex("12345z"); err == nil {
+		t.Error("FromHex accepted invalid hex")
+	}
+	bad := NewDnsPacket()
+	bad.AddQuestion(NewDnsQuestion("a..b", A))
+	if dump := bad.HexDump(); dump != "" {
+		t.Errorf("HexDump of an invalid packet = %q", dump)
+	}
+}
+
+func TestQuestionString(t *testing.T) {
+	ch := NewDnsQuestion("example.com", A)
+	ch.Class = ClassCH
+	for _, tt := range []struct {
+		q    *DnsQuestion
+		want string
+	}{
+		{NewDnsQuestion("google.com", A), "google.com. IN A"},
+		{NewDnsQuestion("example.com.", MX), "example.com. IN MX"},
+		{NewDnsQuestion("", NS), ". IN NS"},
+		{ch, "example.com. CH A"},
+	} {
+		if got := tt.q.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestRecordString(t *testing.T) {
+	unknown := NewUnknownDnsRecord("example.com", 99, 3, 300)
+	unknown.Raw = []byte{1, 2, 0xAB}
+	for _, tt := range []struct {
+		rec  *DnsRecord
+		want string
+	}{
+		{NewADnsRecord("example.com", net.IPv4(1, 2, 3, 4), 300), "example.com. 300 IN A 1.2.3.4"},
+		{NewAAAADnsRecord("example.com", net.ParseIP("2001:db8::1"), 300), "example.com. 300 IN AAAA 2001:db8::1"},
+		{NewCNameDnsRecord("www.example.com", "example.com", 60), "www.example.com. 60 IN CNAME example.com."},
+		{NewMXDnsRecord("example.com", "mail.example.com", 10, 3600), "example.com. 3600 IN MX 10 mail.example.com."},
+		{NewNSDnsRecord("example.com", "ns1.example.com", 86400), "example.com. 86400 IN NS ns1.example.com."},
+		{NewTXTDnsRecord("example.com", []string{"a b", `q"x`}, 1), `example.com. 1 IN TXT "a b" "q\"x"`},
+		{unknown, `example.com. 300 IN TYPE99 \# 3 0102ab`},
+		{NewUnknownDnsRecord("example.com", 99, 0, 300), `example.com. 300 IN TYPE99 \# 0`},
+	} {
+		if got := tt.rec.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestWriteTruncated(t *testing.T) {
+	p := ErrorResponse(NewQuery("example.com", TXT), NOERROR)
+	p.Resources = append(p.Resources, NewOPTDnsRecord(1232, 0))
+	for i := range 10 {
+		p.Answers = append(p.Answers, NewTXTDnsRecord("example.com", []string{fmt.Sprint(i, strings.Repeat("x", 60))}, 300))
+	}
+	if size, _ := p.WireLen(); size <= 512 {
+		t.Fatalf("packet has only %d bytes", size)
+	}
+
+	buffer := NewBytePacketBufferSize(maxMessageSize)
+	n, err := p.WriteTruncated(buffer, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n > 512 {
+		t.Errorf("truncated packet has %d bytes", n)
+	}
+	parsed, err := Unpack(buffer.Buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Header.TruncatedMessage || len(parsed.Answers) == 0 || len(parsed.Answers) >= 10 || parsed.OPT() == nil {
+		t.Errorf("truncated packet is\n%v", parsed)
+	}
+	for i, rec := range parsed.Answers {
+		if !rec.Equal(p.Answers[i]) {
+			t.Errorf("answer %d is %v, want %v", i, rec, p.Answers[i])
+		}
+	}
+	if p.Header.TruncatedMessage || len(p.Answers) != 10 {
+		t.Error("WriteTruncated modified the packet")
+	}
+
+	buffer = NewBytePacketBufferSize(maxMessageSize)
+	n, err = p.WriteTruncated(buffer, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed, err := Unpack(buffer.Buf[:n]); err != nil || parsed.Header.TruncatedMessage || len(parsed.Answers) != 10 {
+		t.Errorf("packet that fits was written as %v, %v", parsed, err)
+	}
+}
+
+func TestWriteTruncatedUncompressed(t *testing.T) {
+	name := strings.Repeat("x", 40) + ".example.com"
+	p := ErrorResponse(NewQuery(name, A), NOERROR)
+	for i := range 10 {
+		p.Answers = append(p.Answers, NewADnsRecord(name, net.IPv4(192, 0, 2, byte(i)), 300))
+	}
+	if size, _ := p.WireLen(); size > 512 {
+		t.Fatalf("compressed packet has %d bytes", size)
+	}
+
+	// Only the compressed packet fits.
+	buffer := NewBytePacketBufferSize(maxMessageSize)
+	buffer.Compress = false
+	n, err := p.WriteTruncated(buffer, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n > 512 {
+		t.Errorf("truncated packet has %d bytes", n)
+	}
+	parsed, err := Unpack(buffer.Buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Header.TruncatedMessage || len(parsed.Answers) == 0 || len(parsed.Answers) >= 10 {
+		t.Errorf("truncated packet is\n%v", parsed)
+	}
+}
+
+func TestCheckedAddressRecords(t *testing.T) {
+	v4, v6 := net.IPv4(192, 0, 2, 1), net.ParseIP("2001:db8::1")
+
+	rec, err := NewCheckedADnsRecord("example.com", v4, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Addr) != net.IPv4len || !rec.Addr.Equal(v4) || rec.Type != A {
+		t.Errorf("A record is %+v", rec)
+	}
+	rec, err = NewCheckedAAAADnsRecord("example.com", v6, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rec.Addr.Equal(v6) || rec.Type != AAAA {
+		t.Errorf("AAAA record is %+v", rec)
+	}
+
+	for _, addr := range []net.IP{v6, nil, {1, 2, 3}} {
+		if _, err := NewCheckedADnsRecord("example.com", addr, 300); !errors.Is(err, ErrInvalidAddress) {
+			t.Errorf("A record of %v returned %v, want %v", addr, err, ErrInvalidAddress)
+		}
+	}
+	for _, addr := range []net.IP{v4, v4.To4(), nil} {
+		if _, err := NewCheckedAAAADnsRecord("example.com", addr, 300); !errors.Is(err, ErrInvalidAddress) {
+			t.Errorf("AAAA record of %v returned %v, want %v", addr, err, ErrInvalidAddress)
+		}
+	}
+}
+
+func TestAddGlue(t *testing.T) {
+	p := ErrorResponse(NewQuery("example.com", NS), NOERROR)
+	p.Answers = append(p.Answers,
+		NewNSDnsRecord("example.com", "ns1.example.com", 3600),
+		NewNSDnsRecord("example.com", "ns2.example.com", 7200))
+	p.Header.Answers = uint16(len(p.Answers))
+	p.AddGlue("ns1.example.com", net.ParseIP("192.0.2.53"))
+	p.AddGlue("ns2.example.com", net.ParseIP("2001:db8::53"))
+	if p.Header.ResourceEntries != 2 {
+		t.Errorf("additional count is %d, want 2", p.Header.ResourceEntries)
+	}
+
+	msg, err := p.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := Unpack(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*DnsRecord{
+		NewADnsRecord("ns1.example.com", net.ParseIP("192.0.2.53"), 3600),
+		NewAAAADnsRecord("ns2.example.com", net.ParseIP("2001:db8::53"), 7200),
+	}
+	if len(parsed.Resources) != len(want) {
+		t.Fatalf("additional section is %v, want %v", parsed.Resources, want)
+	}
+	for i, rec := range parsed.Resources {
+		if !rec.Equal(want[i]) {
+			t.Errorf("glue record %d is %v, want %v", i, rec, want[i])
+		}
+	}
+}
+
+func TestSummaryLine(t *testing.T) {
+	for _, tt := range []struct {
+		header DnsHeader
+		want   string
+	}{
+		{DnsHeader{ID: 6666, Opcode: OpcodeQuery, Rescode: NXDOMAIN},
+			";; ->>HEADER<<- opcode: QUERY, status: NXDOMAIN, id: 6666"},
+		{DnsHeader{ID: 1, Opcode: OpcodeUpdate, Rescode: NOERROR},
+			";; ->>HEADER<<- opcode: UPDATE, status: NOERROR, id: 1"},
+		{DnsHeader{ID: 65535, Opcode: 9, Rescode: SERVFAIL},
+			";; ->>HEADER<<- opcode: OPCODE9, status: SERVFAIL, id: 65535"},
+	} {
+		if got := tt.header.SummaryLine(); got != tt.want {
+			t.Errorf("SummaryLine() = %q, want %q", got, tt.want)
+		}
+	}
+
+	p := ErrorResponse(NewQuery("missing.example.com", A), NXDOMAIN)
+	p.Header.ID = 6666
+	if got, want := p.String(), p.Header.SummaryLine()+"\n"; !strings.HasPrefix(got, want) {
+		t.Errorf("String() = %q, want it to start with %q", got, want)
+	}
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	for _, h := range []DnsHeader{
+		{ID: 0x1234, Response: true, RecursionDesired: true, RecursionAvailable: true, AuthedData: true, Rescode: SERVFAIL, Questions: 1},
+		{ID: 1, Response: true, AuthoritativeAnswer: true, Rescode: NXDOMAIN, Answers: 2, AuthoritativeEntries: 3, ResourceEntries: 4},
+		{ID: 2, Opcode: OpcodeUpdate, TruncatedMessage: true, CheckingDisabled: true, Z: true, Rescode: REFUSED},
+	} {
+		buffer := NewBytePacketBuffer()
+		if err := h.Write(buffer); err != nil {
+			t.Fatal(err)
+		}
+		if buffer.Pos != headerLen {
+			t.Errorf("header %+v wrote %d bytes, want %d", h, buffer.Pos, headerLen)
+		}
+		buffer.Pos = 0
+		var got DnsHeader
+		if err := got.Read(buffer); err != nil {
+			t.Fatal(err)
+		}
+		if got != h {
+			t.Errorf("header read back as\n%+v\nwant\n%+v", got, h)
+		}
+	}
+}
+
+func TestWriteTooLarge(t *testing.T) {
+	p := ErrorResponse(NewQuery("example.com", TXT), NOERROR)
+	for i := range 5 {
+		p.Answers = append(p.Answers, NewTXTDnsRecord(fmt.Sprintf("host%d.example.com", i), []string{strings.Repeat("x", 100)}, 300))
+	}
+
+	buffer := NewBytePacketBuffer()
+	n, err := p.Write(buffer)
+	if !errors.Is(err, ErrPacketTooLarge) || n != 0 {
+		t.Errorf("writing a packet over 512 bytes returned %d, %v, want %v", n, err, ErrPacketTooLarge)
+	}
+	if buffer.Pos != 0 || !bytes.Equal(buffer.Buf, make([]byte, len(buffer.Buf))) {
+		t.Errorf("failed write left %d bytes at position %d", len(bytes.TrimRight(buffer.Buf, "\x00")), buffer.Pos)
+	}
+
+	// The same packet fits once the buffer is large enough.
+	size, err := p.WireLen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := p.Write(NewBytePacketBufferSize(size)); err != nil || n != size {
+		t.Errorf("writing into %d bytes returned %d, %v", size, n, err)
+	}
+}
+
+func TestHeaderReadShort(t *testing.T) {
+	msg := readFixture(t, "../query_packet.txt")
+	for _, tt := range []struct {
+		data []byte
+		pos  uint16
+	}{
+		{msg[:7], 0},
+		{msg[:headerLen-1], 0},
+		// Enough bytes, but not after the position.
+		{msg[:headerLen+4], 5},
+	} {
+		buffer := NewBytePacketBufferSize(len(tt.data))
+		buffer.SetBuffer(tt.data)
+		buffer.Pos = tt.pos
+		var h DnsHeader
+		if err := h.Read(buffer); !errors.Is(err, ErrShortHeader) {
+			t.Errorf("reading a header from %d bytes at %d returned %v, want %v", len(tt.data), tt.pos, err, ErrShortHeader)
+		}
+		if buffer.Pos != tt.pos || h != (DnsHeader{}) {
+			t.Errorf("failed read moved to %d and read %+v", buffer.Pos, h)
+		}
+	}
+}
+
+func TestAddresses(t *testing.T) {
+	p := ErrorResponse(NewQuery("www.example.com", A), NOERROR)
+	p.Answers = []*DnsRecord{
+		NewCNameDnsRecord("www.example.com", "web.example.com", 300),
+		NewADnsRecord("web.example.com", net.ParseIP("192.0.2.1"), 300),
+		NewAAAADnsRecord("web.example.com", net.ParseIP("2001:db8::1"), 300),
+		NewADnsRecord("web.example.com", net.ParseIP("192.0.2.2"), 300),
+	}
+	p.Resources = []*DnsRecord{NewADnsRecord("ns1.example.com", net.ParseIP("192.0.2.53"), 300)}
+
+	want := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.2")}
+	got := p.Addresses()
+	if len(got) != len(want) {
+		t.Fatalf("Addresses() = %v, want %v", got, want)
+	}
+	for i := range got {
+		if !got[i].Equal(want[i]) {
+			t.Errorf("Addresses() = %v, want %v", got, want)
+			break
+		}
+	}
+	if addrs := NewDnsPacket().Addresses(); addrs != nil {
+		t.Errorf("Addresses() of an empty packet = %v", addrs)
+	}
+}
+
+func TestRecordClass(t *testing.T) {
+	chaos := func(rec *DnsRecord) *DnsRecord {
+		rec.Class = ClassCH
+		return rec
+	}
+	for _, rec := range []*DnsRecord{
+		chaos(NewADnsRecord("a.bind", net.IPv4(192, 0, 2, 1), 0)),
+		chaos(NewNSDnsRecord("bind", "ns.bind", 0)),
+		chaos(NewCNameDnsRecord("alias.bind", "version.bind", 0)),
+		chaos(NewMXDnsRecord("bind", "mail.bind", 10, 0)),
+		chaos(NewAAAADnsRecord("aaaa.bind", net.ParseIP("2001:db8::1"), 0)),
+		chaos(NewTXTDnsRecord("version.bind", []string{"9.18.0"}, 0)),
+	} {
+		p := ErrorResponse(NewQuery(rec.Domain, rec.Type), NOERROR)
+		p.Answers = append(p.Answers, rec)
+		msg, err := p.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := Unpack(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parsed.Answers) != 1 || parsed.Answers[0].Class != ClassCH || !parsed.Answers[0].Equal(rec) {
+			t.Errorf("%s record read back as %v", rec.Type, parsed.Answers)
+		}
+	}
+
+	// A record without a class is written as IN.
+	rec := NewADnsRecord("example.com", net.IPv4(192, 0, 2, 1), 300)
+	rec.Class = 0
+	buffer := NewBytePacketBuffer()
+	buffer.Compress = false
+	if _, err := rec.Write(buffer); err != nil {
+		t.Fatal(err)
+	}
+	if class := buffer.Buf[15:17]; !bytes.Equal(class, []byte{0, 1}) {
+		t.Errorf("record without a class was written with class %x", class)
+	}
+}
+
+func TestQuestionAndAnswer(t *testing.T) {
+	empty := NewDnsPacket()
+	for _, i := range []int{-1, 0, 1} {
+		if q, ok := empty.Question(i); ok || q != nil {
+			t.Errorf("Question(%d) of an empty packet = %v, %v", i, q, ok)
+		}
+		if rec, ok := empty.Answer(i); ok || rec != nil {
+			t.Errorf("Answer(%d) of an empty packet = %v, %v", i, rec, ok)
+		}
+	}
+
+	p := answerA(NewQuery("example.com", A), net.IPv4(192, 0, 2, 1))
+	if q, ok := p.Question(0); !ok || q != p.Questions[0] {
+		t.Errorf("Question(0) = %v, %v", q, ok)
+	}
+	if rec, ok := p.Answer(0); !ok || rec != p.Answers[0] {
+		t.Errorf("Answer(0) = %v, %v", rec, ok)
+	}
+	if _, ok := p.Question(1); ok {
+		t.Error("Question(1) found a second question")
+	}
+	if _, ok := p.Answer(1); ok {
+		t.Error("Answer(1) found a second answer")
+	}
+
+	// A response without a question fails validation instead of
+	// panicking.
+	req := NewQuery("example.com", A)
+	resp := ErrorResponse(req, NOERROR)
+	resp.Questions = nil
+	if err := MatchesQuery(req, resp); !errors.Is(err, ErrQuestionMismatch) {
+		t.Error("MatchesQuery accepted a response without a question")
+	}
+}
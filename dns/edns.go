@@ -0,0 +1,255 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// defaultEDNSPayload is the UDP payload size advertised when an OPT record
+// is added without an explicit size. 1232 bytes avoids IP fragmentation on
+// practically every path, as recommended by DNS flag day 2020.
+const defaultEDNSPayload = 1232
+
+// doBit is the DNSSEC OK flag in the TTL of an OPT record.
+const doBit = 1 << 15
+
+// Codes of the EDNS options.
+const (
+	EDNSOptionNSID      uint16 = 3
+	EDNSOptionCookie    uint16 = 10
+	EDNSOptionKeepalive uint16 = 11
+	EDNSOptionPadding   uint16 = 12
+)
+
+// keepaliveUnit is the unit of the timeout in the keepalive option.
+const keepaliveUnit = 100 * time.Millisecond
+
+// EDNSOption is an option carried in the data of an OPT record.
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+// parseEDNSOptions splits the data of an OPT record into its options.
+func parseEDNSOptions(raw []byte) ([]EDNSOption, error) {
+	var options []EDNSOption
+	for len(raw) > 0 {
+		if len(raw) < 4 {
+			return nil, errors.New("truncated EDNS option header")
+		}
+		code := binary.BigEndian.Uint16(raw)
+		length := int(binary.BigEndian.Uint16(raw[2:]))
+		if 4+length > len(raw) {
+			return nil, fmt.Errorf("EDNS option %d exceeds the record data", code)
+		}
+		options = append(options, EDNSOption{Code: code, Data: raw[4 : 4+length]})
+		raw = raw[4+length:]
+	}
+	return options, nil
+}
+
+// packEDNSOptions returns the data of an OPT record carrying options.
+func packEDNSOptions(options []EDNSOption) []byte {
+	var raw []byte
+	for _, o := range options {
+		raw = binary.BigEndian.AppendUint16(raw, o.Code)
+		raw = binary.BigEndian.AppendUint16(raw, uint16(len(o.Data)))
+		raw = append(raw, o.Data...)
+	}
+	return raw
+}
+
+func cloneEDNSOptions(options []EDNSOption) []EDNSOption {
+	if options == nil {
+		return nil
+	}
+	clone := make([]EDNSOption, len(options))
+	for i, o := range options {
+		clone[i] = EDNSOption{Code: o.Code, Data: append([]byte(nil), o.Data...)}
+	}
+	return clone
+}
+
+func ednsOptionEqual(a, b EDNSOption) bool {
+	return a.Code == b.Code && string(a.Data) == string(b.Data)
+}
+
+// QueryOption customizes a query built by NewQuery.
+type QueryOption func(*DnsPacket)
+
+// WithEDNS adds an OPT record advertising payloadSize to the query.
+func WithEDNS(payloadSize uint16) QueryOption {
+	return func(p *DnsPacket) {
+		p.ensureOPT().PayloadSize = payloadSize
+	}
+}
+
+// WithDNSSEC sets the DO bit, asking the server to include DNSSEC records
+// like RRSIG in the response. An OPT record is added if there is none yet.
+func WithDNSSEC() QueryOption {
+	return func(p *DnsPacket) {
+		p.ensureOPT().TTL |= doBit
+	}
+}
+
+// WithNSID asks the server to identify itself with the NSID option (RFC
+// 5001), which tells apart the instances of an anycast service. An OPT
+// record is added if there is none yet.
+func WithNSID() QueryOption {
+	return func(p *DnsPacket) {
+		opt := p.ensureOPT()
+		opt.Options = append(opt.Options, EDNSOption{Code: EDNSOptionNSID})
+	}
+}
+
+// WithKeepalive asks the server to announce how long it keeps an idle TCP
+// connection open, with the keepalive option (RFC 7828). It only makes
+// sense for queries sent over TCP. An OPT record is added if there is none
+// yet.
+func WithKeepalive() QueryOption {
+	return func(p *DnsPacket) {
+		opt := p.ensureOPT()
+		opt.Options = append(opt.Options, EDNSOption{Code: EDNSOptionKeepalive})
+	}
+}
+
+// KeepaliveOption returns the keepalive option a server sends to announce
+// the idle timeout of the connection. The timeout is rounded down to
+// multiples of 100ms, and capped at the largest one the option holds.
+func KeepaliveOption(timeout time.Duration) EDNSOption {
+	units := max(0, min(timeout/keepaliveUnit, 0xFFFF))
+	return EDNSOption{Code: EDNSOptionKeepalive, Data: binary.BigEndian.AppendUint16(nil, uint16(units))}
+}
+
+// Keepalive returns the idle timeout announced in the keepalive option of
+// a response, and false if there is none or it carries no timeout.
+func (d *DnsPacket) Keepalive() (time.Duration, bool) {
+	data, ok := d.option(EDNSOptionKeepalive)
+	if !ok || len(data) != 2 {
+		return 0, false
+	}
+	return time.Duration(binary.BigEndian.Uint16(data)) * keepaliveUnit, true
+}
+
+// WithPadding pads the query with the padding option (RFC 7830), so that
+// its length is a multiple of blockSize and doesn't give away the name
+// asked for. RFC 8467 recommends blocks of 128 bytes for queries. It has to
+// be the last option, as the padding only fits the query as built so far.
+// A blockSize less than 1 leaves the query unpadded; call Pad to get an
+// error for it instead.
+func WithPadding(blockSize int) QueryOption {
+	return func(p *DnsPacket) {
+		if blockSize < 1 {
+			return
+		}
+		// Pad only fails for a query that can't be written, which Write
+		// reports anyway.
+		_ = p.Pad(blockSize)
+	}
+}
+
+// Pad sets the padding option of d, so that d takes a multiple of
+// blockSize bytes when written with compression. An OPT record is added if
+// there is none yet, and any previous padding is replaced. Pad has to be
+// called again after any other change to d.
+//
+// The length is taken from WireLen, which compresses names the way the
+// buffers returned by NewBytePacketBuffer and Pack do. A message written
+// to a buffer with Compress turned off takes more bytes, and is not padded
+// to a multiple of blockSize.
+func (d *DnsPacket) Pad(blockSize int) error {
+	if blockSize < 1 {
+		return fmt.Errorf("invalid padding block size %d", blockSize)
+	}
+
+	opt := d.ensureOPT()
+	opt.Options = slices.DeleteFunc(opt.Options, func(o EDNSOption) bool {
+		return o.Code == EDNSOptionPadding
+	})
+	size, err := d.WireLen()
+	if err != nil {
+		return err
+	}
+
+	// The option header takes 4 bytes, the padding fills the rest of the
+	// last block.
+	n := (blockSize - (size+4)%blockSize) % blockSize
+	opt.Options = append(opt.Options, EDNSOption{Code: EDNSOptionPadding, Data: make([]byte, n)})
+	return nil
+}
+
+// NSID returns the server identifier sent in the NSID option of a
+// response, and false if there is none.
+func (d *DnsPacket) NSID() ([]byte, bool) {
+	return d.option(EDNSOptionNSID)
+}
+
+// option returns the data of the first EDNS option with the given code.
+func (d *DnsPacket) option(code uint16) ([]byte, bool) {
+	opt := d.OPT()
+	if opt == nil {
+		return nil, false
+	}
+	for _, o := range opt.Options {
+		if o.Code == code {
+			return o.Data, true
+		}
+	}
+	return nil, false
+}
+
+// OPT returns the OPT record of the additional section, or nil if the packet
+// has none.
+func (d *DnsPacket) OPT() *DnsRecord {
+	for _, rec := range d.Resources {
+		if rec.Type == OPT {
+			return rec
+		}
+	}
+	return nil
+}
+
+// ExtendedRcode returns the full 12 bit rcode of the packet. The lower 4
+// bits come from the header and the upper 8 bits from the TTL of the OPT
+// record, if there is one.
+func (d *DnsPacket) ExtendedRcode() int {
+	rcode := int(d.Header.Rescode) & 0x0F
+	if opt := d.OPT(); opt != nil {
+		rcode |= int(opt.TTL>>24) << 4
+	}
+	return rcode
+}
+
+// maxResponseSize returns the largest UDP response the sender of d accepts.
+// That is 512 bytes, unless its OPT record advertises more.
+func (d *DnsPacket) maxResponseSize() int {
+	size := 512
+	if opt := d.OPT(); opt != nil && int(opt.PayloadSize) > size {
+		size = int(opt.PayloadSize)
+	}
+	return size
+}
+
+// udpPayloadSize returns the size of the buffer needed to receive the
+// response to d over UDP. That is the payload size advertised by its OPT
+// record, but never less than the default, so that a server sending more
+// than it was asked for is not cut off.
+func (d *DnsPacket) udpPayloadSize() int {
+	size := defaultEDNSPayload
+	if opt := d.OPT(); opt != nil && int(opt.PayloadSize) > size {
+		size = int(opt.PayloadSize)
+	}
+	return size
+}
+
+func (d *DnsPacket) ensureOPT() *DnsRecord {
+	opt := d.OPT()
+	if opt == nil {
+		opt = NewOPTDnsRecord(defaultEDNSPayload, 0)
+		d.Resources = append(d.Resources, opt)
+	}
+	return opt
+}
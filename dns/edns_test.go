@@ -0,0 +1,237 @@
+package dns
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithPadding(t *testing.T) {
+	for _, name := range []string{"a.com", "www.example.com", "a-much-longer-name.subdomain.example.org"} {
+		for _, blockSize := range []int{1, 16, 128, 468} {
+			req := NewQuery(name, A, WithEDNS(1232), WithPadding(blockSize))
+			msg, err := req.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(msg)%blockSize != 0 {
+				t.Errorf("%s padded to %d bytes, not a multiple of %d", name, len(msg), blockSize)
+			}
+
+			parsed, err := Unpack(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			padding, ok := parsed.option(EDNSOptionPadding)
+			if !ok {
+				t.Fatalf("%s has no padding option", name)
+			}
+			want, _ := req.option(EDNSOptionPadding)
+			if len(padding) != len(want) {
+				t.Errorf("%s has %d bytes of padding, want %d", name, len(padding), len(want))
+			}
+		}
+	}
+}
+
+func TestPadReplacesPadding(t *testing.T) {
+	req := NewQuery("www.example.com", A)
+	if err := req.Pad(128); err != nil {
+		t.Fatal(err)
+	}
+	if err := req.Pad(64); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(req.OPT().Options); n != 1 {
+		t.Errorf("OPT has %d options, want 1", n)
+	}
+	if size, _ := req.WireLen(); size != 64 {
+		t.Errorf("query takes %d bytes, want 64", size)
+	}
+	if err := req.Pad(0); err == nil {
+		t.Error("Pad(0) succeeded")
+	}
+}
+
+func TestWithPaddingInvalidBlockSize(t *testing.T) {
+	req := NewQuery("example.com", A, WithPadding(0))
+	msg, err := req.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := Unpack(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := parsed.option(EDNSOptionPadding); ok {
+		t.Error("query with WithPadding(0) was padded")
+	}
+
+	if err := req.Pad(0); err == nil {
+		t.Error("Pad(0) succeeded")
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	resp := NewDnsPacket()
+	resp.Header.Response = true
+	resp.Resources = append(resp.Resources, NewOPTDnsRecord(1232, 0, KeepaliveOption(12345*time.Millisecond)))
+	msg, err := resp.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := Unpack(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeout, ok := parsed.Keepalive(); !ok || timeout != 12300*time.Millisecond {
+		t.Errorf("Keepalive() = %v, %v, want 12.3s", timeout, ok)
+	}
+
+	req := NewQuery("www.example.com", A, WithKeepalive())
+	if _, ok := req.Keepalive(); ok {
+		t.Error("query without a timeout reports one")
+	}
+	if _, ok := req.option(EDNSOptionKeepalive); !ok {
+		t.Error("query has no keepalive option")
+	}
+	if got := KeepaliveOption(-time.Second).Data; got[0] != 0 || got[1] != 0 {
+		t.Errorf("negative timeout encoded as %x", got)
+	}
+	if got := KeepaliveOption(time.Hour * 24).Data; got[0] != 0xFF || got[1] != 0xFF {
+		t.Errorf("long timeout encoded as %x", got)
+	}
+}
+
+func TestDNSSECRecordsRoundTrip(t *testing.T) {
+	req := NewQuery("example.com", DS, WithDNSSEC())
+	msg, err := req.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := Unpack(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opt := parsed.OPT(); opt == nil || opt.TTL&doBit == 0 {
+		t.Fatalf("DO bit is not set in\n%v", parsed)
+	}
+
+	rrsig := []byte{0, 1, 8, 2, 0, 0, 14, 16, 1, 2, 3, 4, 5, 6, 7, 8, 0xAB, 0xCD, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0xDE, 0xAD, 0xBE, 0xEF}
+	ds := []byte{0xAB, 0xCD, 8, 2, 1, 2, 3, 4}
+	resp := ErrorResponse(req, NOERROR)
+	resp.Answers = append(resp.Answers,
+		NewRawDnsRecord(DS, "example.com", ds, 3600),
+		NewRawDnsRecord(RRSIG, "example.com", rrsig, 3600))
+
+	for range 2 {
+		msg, err := resp.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp, err = Unpack(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := resp.Answers[0]; got.Type != DS || !bytes.Equal(got.Raw, ds) {
+		t.Errorf("DS read back as %v", got)
+	}
+	if got := resp.Answers[1]; got.Type != RRSIG || !bytes.Equal(got.Raw, rrsig) {
+		t.Errorf("RRSIG read back as %v", got)
+	}
+}
+
+func TestExtendedRcode(t *testing.T) {
+	resp := NewDnsPacket()
+	resp.Header.Response = true
+	resp.Resources = append(resp.Resources, NewOPTDnsRecord(1232, 1<<24))
+	msg, err := resp.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := Unpack(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.Header.Rescode != NOERROR {
+		t.Errorf("header rescode is %s, want NOERROR", parsed.Header.Rescode)
+	}
+	if rcode := parsed.ExtendedRcode(); rcode != int(BADVERS) {
+		t.Errorf("ExtendedRcode() = %d, want %d", rcode, BADVERS)
+	}
+	if s := ResultCode(parsed.ExtendedRcode()).String(); s != "BADVERS" {
+		t.Errorf("rcode 16 is named %q", s)
+	}
+
+	parsed.Resources = nil
+	if rcode := parsed.ExtendedRcode(); rcode != 0 {
+		t.Errorf("ExtendedRcode() without OPT = %d, want 0", rcode)
+	}
+}
+
+func TestEDNSOptionsRoundTrip(t *testing.T) {
+	cookie := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	p := NewQuery("example.com", A)
+	p.Resources = append(p.Resources, NewOPTDnsRecord(1232, 0,
+		EDNSOption{Code: EDNSOptionNSID},
+		EDNSOption{Code: EDNSOptionCookie, Data: cookie},
+	))
+
+	msg, err := p.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The OPT record data is both options, each with code and length.
+	rdata := "\x00\x10" + "\x00\x03\x00\x00" + "\x00\x0a\x00\x08" + string(cookie)
+	if !strings.HasSuffix(string(msg), rdata) {
+		t.Errorf("message %x doesn't end with the options %x", msg, rdata)
+	}
+
+	parsed, err := Unpack(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := parsed.OPT().Options
+	if len(opts) != 2 || opts[0].Code != EDNSOptionNSID || len(opts[0].Data) != 0 ||
+		opts[1].Code != EDNSOptionCookie || !bytes.Equal(opts[1].Data, cookie) {
+		t.Errorf("options read as %v", opts)
+	}
+
+	// An option running past the end of the data is malformed.
+	for _, raw := range [][]byte{{0, 3, 0, 4, 1}, {0, 3, 0}} {
+		if opts, err := parseEDNSOptions(raw); err == nil {
+			t.Errorf("parseEDNSOptions(%x) = %v", raw, opts)
+		}
+	}
+}
+
+func TestNSID(t *testing.T) {
+	query := NewQuery("example.com", A, WithNSID())
+	opt := query.OPT()
+	if opt == nil {
+		t.Fatal("WithNSID didn't add an OPT record")
+	}
+	if len(opt.Options) != 1 || opt.Options[0].Code != EDNSOptionNSID || len(opt.Options[0].Data) != 0 {
+		t.Errorf("query options are %v, want an empty NSID option", opt.Options)
+	}
+
+	resp := ErrorResponse(query, NOERROR)
+	if _, ok := resp.NSID(); ok {
+		t.Error("NSID found in a response without an OPT record")
+	}
+	resp.Resources = append(resp.Resources, NewOPTDnsRecord(1232, 0,
+		EDNSOption{Code: EDNSOptionNSID, Data: []byte("lax1")}))
+	msg, err := resp.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := Unpack(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nsid, ok := parsed.NSID(); !ok || string(nsid) != "lax1" {
+		t.Errorf("NSID returned %q, %v, want \"lax1\", true", nsid, ok)
+	}
+}
@@ -0,0 +1,11 @@
+package dns
+
+import "golang.org/x/net/idna"
+
+// ToASCII converts an internationalized domain name like "bücher.de" to its
+// A-label (Punycode) form "xn--bcher-kva.de" so it can be written with
+// WriteQName. Names that are already ASCII are passed through, apart from
+// being lowercased.
+func ToASCII(name string) (string, error) {
+	return idna.Lookup.ToASCII(name)
+}
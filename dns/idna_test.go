@@ -0,0 +1,24 @@
+package dns
+
+import "testing"
+
+func TestToASCII(t *testing.T) {
+	for _, tt := range []struct{ name, want string }{
+		{"bücher.de", "xn--bcher-kva.de"},
+		{"www.example.com", "www.example.com"},
+		{"xn--bcher-kva.de", "xn--bcher-kva.de"},
+	} {
+		got, err := ToASCII(tt.name)
+		if err != nil {
+			t.Errorf("ToASCII(%q): %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ToASCII(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := ToASCII("a\u200db.com"); err == nil {
+		t.Error("ToASCII accepted a name with a zero width joiner")
+	}
+}
@@ -0,0 +1,385 @@
+package dns
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// maxCNAMEHops bounds how many CNAMEs are followed for a single lookup.
+const maxCNAMEHops = 8
+
+// LookupFollowCNAME looks up the records of type qtype for name, following
+// CNAMEs. Chains are usually resolved within a single response, but if the
+// server stops at a CNAME, the target is looked up separately. An empty
+// result without error means the final name has no records of qtype.
+func LookupFollowCNAME(ctx context.Context, server, name string, qtype RecordType) ([]*DnsRecord, error) {
+	return StubResolver{Transport: UDPTransport{Server: server}}.LookupFollowCNAME(ctx, name, qtype)
+}
+
+// LookupFollowCNAME is like the function of the same name, but sends its
+// queries through r.
+func (r StubResolver) LookupFollowCNAME(ctx context.Context, name string, qtype RecordType) ([]*DnsRecord, error) {
+	seen := map[string]bool{}
+	for hops := 0; hops < maxCNAMEHops; hops++ {
+		key, ok := canonicalName(name)
+		if !ok {
+			return nil, fmt.Errorf("invalid name %q", name)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("CNAME loop at %s", name)
+		}
+		seen[key] = true
+
+		resp, err := r.Lookup(ctx, name, qtype)
+		if err != nil {
+			return nil, err
+		}
+		if resp.RecursionRefused() {
+			return nil, ErrRecursionRefused
+		}
+		if resp.Header.Rescode != NOERROR {
+			return nil, fmt.Errorf("lookup %s failed with %s", name, resp.Header.Rescode)
+		}
+
+		records, target := followChain(resp.Answers, name, qtype)
+		if len(records) > 0 || sameName(target, name) {
+			return records, nil
+		}
+		name = target
+	}
+	return nil, fmt.Errorf("more than %d CNAMEs followed", maxCNAMEHops)
+}
+
+// followChain follows the CNAMEs for name within answers and returns the
+// records of type qtype for the end of the chain, together with the name
+// the chain ended at. A DNAME above a name without CNAME redirects it, too.
+func followChain(answers []*DnsRecord, name string, qtype RecordType) ([]*DnsRecord, string) {
+	for hops := 0; hops <= maxCNAMEHops; hops++ {
+		var records []*DnsRecord
+		var cname string
+		for _, rec := range answers {
+			if !sameName(rec.Domain, name) {
+				continue
+			}
+			if rec.Type == qtype {
+				records = append(records, rec)
+			} else if rec.Type == CNAME {
+				cname = rec.Host
+			}
+		}
+
+		if len(records) == 0 && cname == "" {
+			for _, rec := range answers {
+				if rec.Type == DNAME {
+					if target, ok := SynthesizeDNAME(rec, name); ok {
+						cname = target
+						break
+					}
+				}
+			}
+		}
+
+		if len(records) > 0 || cname == "" {
+			return records, name
+		}
+		name = cname
+	}
+	return nil, name
+}
+
+// LookupChain is like LookupFollowCNAME, but returns every record the name
+// was redirected by before the records of type qtype, in the order they
+// were followed. For "www" pointing to "cdn" pointing to an address that
+// is the CNAME of www, the CNAME of cdn and the A record. A name reached
+// through a DNAME is preceded by the DNAME.
+func LookupChain(ctx context.Context, server, name string, qtype RecordType) ([]*DnsRecord, error) {
+	return StubResolver{Transport: UDPTransport{Server: server}}.LookupChain(ctx, name, qtype)
+}
+
+// LookupChain is like the function of the same name, but sends its queries
+// through r.
+func (r StubResolver) LookupChain(ctx context.Context, name string, qtype RecordType) ([]*DnsRecord, error) {
+	key, ok := canonicalName(name)
+	if !ok {
+		return nil, fmt.Errorf("invalid name %q", name)
+	}
+	var chain []*DnsRecord
+	seen := map[string]bool{key: true}
+	for {
+		resp, err := r.Lookup(ctx, name, qtype)
+		if err != nil {
+			return nil, err
+		}
+		if resp.RecursionRefused() {
+			return nil, ErrRecursionRefused
+		}
+		if resp.Header.Rescode != NOERROR {
+			return nil, fmt.Errorf("lookup %s failed with %s", name, resp.Header.Rescode)
+		}
+
+		records, hops, target, err := chainHops(resp.Answers, name, qtype, seen)
+		if err != nil {
+			return nil, err
+		}
+		// Without hops or with records the chain has ended, otherwise the
+		// server stopped at a CNAME and the target needs a query of its own.
+		chain = append(chain, hops...)
+		if len(hops) == 0 || len(records) > 0 {
+			return append(chain, records...), nil
+		}
+		name = target
+	}
+}
+
+// chainHops follows the chain for name within answers like followChain,
+// but also returns the CNAME or DNAME records followed. seen holds the
+// names reached so far, across responses, and a name reached twice is a
+// loop.
+func chainHops(answers []*DnsRecord, name string, qtype RecordType, seen map[string]bool) ([]*DnsRecord, []*DnsRecord, string, error) {
+	var hops []*DnsRecord
+	for {
+		var records []*DnsRecord
+		var hop *DnsRecord
+		var target string
+		for _, rec := range answers {
+			if !sameName(rec.Domain, name) {
+				continue
+			}
+			if rec.Type == qtype {
+				records = append(records, rec)
+			} else if rec.Type == CNAME {
+				hop, target = rec, rec.Host
+			}
+		}
+
+		if len(records) == 0 && hop == nil {
+			for _, rec := range answers {
+				if rec.Type == DNAME {
+					if synthesized, ok := SynthesizeDNAME(rec, name); ok {
+						hop, target = rec, synthesized
+						break
+					}
+				}
+			}
+		}
+
+		if len(records) > 0 || hop == nil {
+			return records, hops, name, nil
+		}
+
+		key, ok := canonicalName(target)
+		if !ok {
+			return nil, nil, "", fmt.Errorf("invalid CNAME target %q", target)
+		}
+		if seen[key] {
+			return nil, nil, "", fmt.Errorf("CNAME loop at %s", target)
+		}
+		if len(seen) > maxCNAMEHops {
+			return nil, nil, "", fmt.Errorf("more than %d CNAMEs followed", maxCNAMEHops)
+		}
+		seen[key] = true
+		hops = append(hops, hop)
+		name = target
+	}
+}
+
+// LookupAddr resolves host to its IPv4 and IPv6 addresses, querying A and
+// AAAA at the same time and following CNAMEs. The addresses are ordered by
+// family as given in order, which defaults to AAAA before A. If only one of
+// the families resolves, its addresses are returned without error.
+func LookupAddr(ctx context.Context, server, host string, order ...RecordType) ([]net.IP, error) {
+	if len(order) == 0 {
+		order = []RecordType{AAAA, A}
+	}
+
+	results := make([][]net.IP, len(order))
+	errs := make([]error, len(order))
+
+	var wg sync.WaitGroup
+	for i, qtype := range order {
+		wg.Add(1)
+		go func(i int, qtype RecordType) {
+			defer wg.Done()
+
+			records, err := LookupFollowCNAME(ctx, server, host, qtype)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			for _, rec := range records {
+				results[i] = append(results[i], rec.Addr)
+			}
+		}(i, qtype)
+	}
+	wg.Wait()
+
+	var ips []net.IP
+	for _, r := range results {
+		ips = append(ips, r...)
+	}
+
+	if len(ips) == 0 {
+		if err := errors.Join(errs...); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+	return ips, nil
+}
+
+// LookupTXT returns the TXT records of name, following CNAMEs. A record
+// made up of several character-strings is returned joined into one string,
+// as is common for long SPF and DKIM records.
+func LookupTXT(ctx context.Context, server, name string) ([]string, error) {
+	records, err := LookupFollowCNAME(ctx, server, name, TXT)
+	if err != nil {
+		return nil, err
+	}
+
+	txts := make([]string, 0, len(records))
+	for _, rec := range records {
+		txts = append(txts, strings.Join(rec.Txt, ""))
+	}
+	return txts, nil
+}
+
+// MXHost is a mail exchanger of a domain.
+type MXHost struct {
+	Preference uint16
+	Host       string
+
+	// IPs are the addresses of Host found in the additional section of
+	// the response. They are not looked up separately, so this is empty
+	// if the server sent no glue.
+	IPs []net.IP
+}
+
+// LookupMX returns the mail exchangers of domain, the most preferred one
+// first.
+func LookupMX(ctx context.Context, server, domain string) ([]MXHost, error) {
+	return StubResolver{Transport: UDPTransport{Server: server}}.LookupMX(ctx, domain)
+}
+
+// LookupMX is like the function of the same name, but sends its query
+// through r.
+func (r StubResolver) LookupMX(ctx context.Context, domain string) ([]MXHost, error) {
+	resp, err := r.Lookup(ctx, domain, MX)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Header.Rescode != NOERROR {
+		return nil, fmt.Errorf("lookup %s failed with %s", domain, resp.Header.Rescode)
+	}
+
+	records, _ := followChain(resp.Answers, domain, MX)
+	hosts := make([]MXHost, 0, len(records))
+	for _, rec := range records {
+		mx := MXHost{Preference: rec.Priority, Host: rec.Host}
+		for _, glue := range resp.Resources {
+			if (glue.Type == A || glue.Type == AAAA) && sameName(glue.Domain, rec.Host) {
+				mx.IPs = append(mx.IPs, glue.Addr)
+			}
+		}
+		hosts = append(hosts, mx)
+	}
+
+	slices.SortStableFunc(hosts, func(a, b MXHost) int {
+		return cmp.Compare(a.Preference, b.Preference)
+	})
+	return hosts, nil
+}
+
+// maxParallelQueries bounds the queries ResolveAll has in flight at once.
+const maxParallelQueries = 4
+
+// ResolveAll looks up name for each of types concurrently and returns the
+// responses by type, whatever their rescode. A failing query doesn't stop
+// the others: the responses received are returned together with the errors
+// of the failed types, joined into one.
+func ResolveAll(ctx context.Context, server, name string, types []RecordType) (map[RecordType]*DnsPacket, error) {
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		responses = make(map[RecordType]*DnsPacket, len(types))
+		errs      []error
+	)
+
+	sem := make(chan struct{}, maxParallelQueries)
+	for _, qtype := range types {
+		wg.Add(1)
+		go func(qtype RecordType) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			resp, err := Lookup(ctx, server, name, qtype)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", qtype, err))
+				return
+			}
+			responses[qtype] = resp
+		}(qtype)
+	}
+	wg.Wait()
+
+	return responses, errors.Join(errs...)
+}
+
+// ResolveBatch looks up qtype for each of names, running up to concurrency
+// lookups at once. It returns the responses by name, whatever their
+// rescode, and the errors of the names that failed. Once ctx is done, the
+// names not looked up yet fail with its error.
+func ResolveBatch(ctx context.Context, server string, qtype RecordType, names []string, concurrency int) (map[string]*DnsPacket, map[string]error) {
+	return StubResolver{Transport: UDPTransport{Server: server}}.ResolveBatch(ctx, qtype, names, concurrency)
+}
+
+// ResolveBatch is like the function of the same name, but sends its
+// queries through r.
+func (r StubResolver) ResolveBatch(ctx context.Context, qtype RecordType, names []string, concurrency int) (map[string]*DnsPacket, map[string]error) {
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		responses = make(map[string]*DnsPacket, len(names))
+		errs      = map[string]error{}
+	)
+
+	sem := make(chan struct{}, max(concurrency, 1))
+	for _, name := range names {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			mu.Lock()
+			errs[name] = ctx.Err()
+			mu.Unlock()
+			continue
+		}
+
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			resp, err := r.Lookup(ctx, name, qtype)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[name] = err
+				return
+			}
+			responses[name] = resp
+		}(name)
+	}
+	wg.Wait()
+
+	return responses, errs
+}
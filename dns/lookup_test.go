@@ -0,0 +1,291 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testIPv4 = net.IPv4(192, 0, 2, 1)
+	testIPv6 = net.ParseIP("2001:db8::1")
+)
+
+// exampleZone holds hosts with addresses of either or both families, and
+// names pointing to them.
+func exampleZone() *Zone {
+	z := NewZone("example.com")
+	z.Add(
+		NewSOADnsRecord("example.com", "ns.example.com", "admin.example.com", 1, 3600, 600, 86400, 300, 3600),
+		NewADnsRecord("both.example.com", testIPv4, 300),
+		NewAAAADnsRecord("both.example.com", testIPv6, 300),
+		NewADnsRecord("v4.example.com", testIPv4, 300),
+		NewAAAADnsRecord("v6.example.com", testIPv6, 300),
+		NewCNameDnsRecord("alias.example.com", "both.example.com", 300),
+	)
+	return z
+}
+
+// serveZone answers queries from z on a local UDP port and returns its
+// address.
+func serveZone(t *testing.T, z *Zone) string {
+	return serveUDP(t, z.answer)
+}
+
+func TestLookupAddr(t *testing.T) {
+	server := serveZone(t, exampleZone())
+
+	tests := []struct {
+		host  string
+		order []RecordType
+		want  []net.IP
+	}{
+		{"both.example.com", nil, []net.IP{testIPv6, testIPv4}},
+		{"both.example.com", []RecordType{A, AAAA}, []net.IP{testIPv4, testIPv6}},
+		{"alias.example.com", nil, []net.IP{testIPv6, testIPv4}},
+		{"v4.example.com", nil, []net.IP{testIPv4}},
+		{"v6.example.com", nil, []net.IP{testIPv6}},
+	}
+	for _, tt := range tests {
+		ips, err := LookupAddr(context.Background(), server, tt.host, tt.order...)
+		if err != nil {
+			t.Errorf("LookupAddr(%s, %v): %v", tt.host, tt.order, err)
+			continue
+		}
+		if len(ips) != len(tt.want) {
+			t.Errorf("LookupAddr(%s, %v) = %v, want %v", tt.host, tt.order, ips, tt.want)
+			continue
+		}
+		for i := range ips {
+			if !ips[i].Equal(tt.want[i]) {
+				t.Errorf("LookupAddr(%s, %v) = %v, want %v", tt.host, tt.order, ips, tt.want)
+				break
+			}
+		}
+	}
+
+	if ips, err := LookupAddr(context.Background(), server, "missing.example.com"); err == nil {
+		t.Errorf("LookupAddr of a missing name returned %v", ips)
+	}
+}
+
+func TestLookupTXT(t *testing.T) {
+	z := exampleZone()
+	z.Add(
+		NewTXTDnsRecord("example.com", []string{"v=spf1 ip4:192.0.2.0/24 ", "include:_spf.example.net ~all"}, 300),
+		NewTXTDnsRecord("example.com", []string{"verification=abc123"}, 300),
+		NewCNameDnsRecord("txt.example.com", "example.com", 300),
+	)
+	server := serveZone(t, z)
+
+	want := []string{"v=spf1 ip4:192.0.2.0/24 include:_spf.example.net ~all", "verification=abc123"}
+	for _, name := range []string{"example.com", "txt.example.com"} {
+		txts, err := LookupTXT(context.Background(), server, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(txts, want) {
+			t.Errorf("LookupTXT(%s) = %q, want %q", name, txts, want)
+		}
+	}
+
+	if txts, err := LookupTXT(context.Background(), server, "v4.example.com"); err != nil || len(txts) != 0 {
+		t.Errorf("LookupTXT of a name without TXT = %q, %v", txts, err)
+	}
+}
+
+func TestLookupMX(t *testing.T) {
+	mail1, mail2 := net.IPv4(192, 0, 2, 25), net.ParseIP("2001:db8::25")
+	server := serveUDP(t, func(req *DnsPacket) *DnsPacket {
+		resp := ErrorResponse(req, NOERROR)
+		resp.Answers = append(resp.Answers,
+			NewMXDnsRecord("example.com", "backup.example.net", 20, 300),
+			NewMXDnsRecord("example.com", "mail.example.com", 10, 300),
+		)
+		resp.Resources = append(resp.Resources,
+			NewADnsRecord("mail.example.com", mail1, 300),
+			NewAAAADnsRecord("Mail.Example.com", mail2, 300),
+			NewADnsRecord("other.example.com", testIPv4, 300),
+		)
+		return resp
+	})
+
+	hosts, err := LookupMX(context.Background(), server, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 2 {
+		t.Fatalf("LookupMX returned %v", hosts)
+	}
+	if hosts[0].Preference != 10 || hosts[0].Host != "mail.example.com" ||
+		len(hosts[0].IPs) != 2 || !hosts[0].IPs[0].Equal(mail1) || !hosts[0].IPs[1].Equal(mail2) {
+		t.Errorf("first MX is %+v", hosts[0])
+	}
+	if hosts[1].Preference != 20 || hosts[1].Host != "backup.example.net" || len(hosts[1].IPs) != 0 {
+		t.Errorf("second MX is %+v", hosts[1])
+	}
+}
+
+func TestResolveAll(t *testing.T) {
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	server := serveUDP(t, func(req *DnsPacket) *DnsPacket {
+		mu.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+
+		switch req.Questions[0].Type {
+		case TXT:
+			return ErrorResponse(req, SERVFAIL)
+		case SOA:
+			return nil
+		}
+		return exampleZone().answer(req)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	types := []RecordType{A, AAAA, MX, TXT, NS, CNAME, HINFO, SOA}
+	responses, err := ResolveAll(ctx, server, "both.example.com", types)
+
+	if err == nil || !strings.Contains(err.Error(), "SOA") {
+		t.Errorf("ResolveAll returned error %v, want one for SOA", err)
+	}
+	if len(responses) != len(types)-1 {
+		t.Errorf("got responses for %d types, want %d", len(responses), len(types)-1)
+	}
+	if resp := responses[A]; resp == nil || len(resp.Answers) != 1 || !resp.Answers[0].Addr.Equal(testIPv4) {
+		t.Errorf("A response is\n%v", resp)
+	}
+	if resp := responses[AAAA]; resp == nil || len(resp.Answers) != 1 || !resp.Answers[0].Addr.Equal(testIPv6) {
+		t.Errorf("AAAA response is\n%v", resp)
+	}
+	if resp := responses[MX]; resp == nil || resp.Header.Rescode != NOERROR || len(resp.Answers) != 0 {
+		t.Errorf("MX response is\n%v", resp)
+	}
+	if resp := responses[TXT]; resp == nil || resp.Header.Rescode != SERVFAIL {
+		t.Errorf("TXT response is\n%v", resp)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if maxInFlight > maxParallelQueries {
+		t.Errorf("%d queries in flight at once, want at most %d", maxInFlight, maxParallelQueries)
+	}
+}
+
+func TestResolveBatch(t *testing.T) {
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	server := serveUDP(t, func(req *DnsPacket) *DnsPacket {
+		mu.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return ErrorResponse(req, NOERROR)
+	})
+
+	var names []string
+	for i := range 10 {
+		names = append(names, fmt.Sprintf("host%d.example.com", i))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	responses, errs := ResolveBatch(ctx, server, A, names, 3)
+
+	if len(errs) != 0 {
+		t.Errorf("ResolveBatch returned errors %v", errs)
+	}
+	for _, name := range names {
+		if resp := responses[name]; resp == nil || resp.Questions[0].Name != name {
+			t.Errorf("response for %s is\n%v", name, resp)
+		}
+	}
+	mu.Lock()
+	if maxInFlight > 3 {
+		t.Errorf("%d queries in flight at once, want at most 3", maxInFlight)
+	}
+	mu.Unlock()
+
+	// Once the context is done, every name fails without a query.
+	cancel()
+	responses, errs = ResolveBatch(ctx, server, A, names, 3)
+	if len(responses) != 0 || len(errs) != len(names) {
+		t.Errorf("ResolveBatch after cancel returned %d responses and %d errors", len(responses), len(errs))
+	}
+	for name, err := range errs {
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("error for %s is %v, want %v", name, err, context.Canceled)
+		}
+	}
+}
+
+func TestLookupChain(t *testing.T) {
+	www := NewCNameDnsRecord("www.example.com", "cdn.example.com", 300)
+	cdn := NewCNameDnsRecord("cdn.example.com", "both.example.com", 300)
+	z := exampleZone()
+	z.Add(www, cdn,
+		NewCNameDnsRecord("loop1.example.com", "loop2.example.com", 300),
+		NewCNameDnsRecord("loop2.example.com", "loop1.example.com", 300))
+	ctx := context.Background()
+
+	// The zone answers every hop on its own, so each takes a query.
+	var upstream countingServer
+	server := serveUDP(t, func(req *DnsPacket) *DnsPacket {
+		upstream.handle(req)
+		return z.answer(req)
+	})
+	chain, err := LookupChain(ctx, server, "www.example.com", A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*DnsRecord{www, cdn, NewADnsRecord("both.example.com", testIPv4, 300)}
+	checkChain := func(chain []*DnsRecord) {
+		t.Helper()
+		if len(chain) != len(want) {
+			t.Fatalf("chain is %v, want %v", chain, want)
+		}
+		for i, rec := range chain {
+			if !rec.Equal(want[i]) {
+				t.Errorf("hop %d is %v, want %v", i, rec, want[i])
+			}
+		}
+	}
+	checkChain(chain)
+	if n := len(upstream.queries()); n != 3 {
+		t.Errorf("chain took %d queries, want 3", n)
+	}
+
+	// A server that follows the chain itself answers it in one response.
+	full := serveUDP(t, func(req *DnsPacket) *DnsPacket {
+		resp := ErrorResponse(req, NOERROR)
+		resp.Answers = append(resp.Answers, want...)
+		return resp
+	})
+	chain, err = LookupChain(ctx, full, "www.example.com", A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkChain(chain)
+
+	if chain, err := LookupChain(ctx, server, "loop1.example.com", A); err == nil {
+		t.Errorf("CNAME loop returned chain %v", chain)
+	}
+	if chain, err := LookupChain(ctx, server, "missing.example.com", A); err == nil {
+		t.Errorf("missing name returned chain %v", chain)
+	}
+}
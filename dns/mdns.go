@@ -0,0 +1,112 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// mdnsGroups are the multicast addresses mDNS queries are sent to, see RFC
+// 6762.
+var mdnsGroups = []string{"224.0.0.251:5353", "[ff02::fb]:5353"}
+
+// mdnsWindow is how long LookupMDNS collects responses when the context has
+// no deadline.
+const mdnsWindow = time.Second
+
+// mdnsMaxMessage is the largest mDNS message, which may exceed the usual
+// UDP limits on links with jumbo frames.
+const mdnsMaxMessage = 9000
+
+// mdnsUnicastResponse is the top bit of the class of an mDNS question,
+// which asks for a unicast response (QU) instead of a multicast one (QM).
+// In records it marks the set as complete, flushing older cached records.
+const mdnsUnicastResponse = 1 << 15
+
+// LookupMDNS sends a multicast DNS query for service, like
+// "_http._tcp.local", to the IPv4 and IPv6 mDNS groups, and collects every
+// response arriving until the context deadline, or for a second if there
+// is none. Any number of devices may answer, so all responses are
+// returned, in the order they arrived, and none at all is not an error.
+//
+// The query is a one-shot query from an ephemeral port, with ID 0 as RFC
+// 6762 requires. It sets the QU bit in the question class, asking
+// responders for a unicast reply, as the socket doesn't join the group.
+// Responses are accepted from any address and with any ID, since mDNS
+// responders don't echo either reliably. The class of their records may
+// have the cache-flush bit set.
+func LookupMDNS(ctx context.Context, service string, qtype RecordType) ([]*DnsPacket, error) {
+	return collectMDNS(ctx, mdnsGroups, service, qtype)
+}
+
+func collectMDNS(ctx context.Context, groups []string, service string, qtype RecordType) ([]*DnsPacket, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, mdnsWindow)
+		defer cancel()
+	}
+
+	req := NewDnsPacket()
+	q := NewDnsQuestion(service, qtype)
+	q.Class = ClassIN | mdnsUnicastResponse
+	req.AddQuestion(q)
+	msg, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var lc net.ListenConfig
+	conn, err := lc.ListenPacket(ctx, "udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	// A host may lack either family, so the query only fails if it can't
+	// be sent to any group.
+	var errs []error
+	for _, group := range groups {
+		addr, err := net.ResolveUDPAddr("udp", group)
+		if err == nil {
+			_, err = conn.WriteTo(msg, addr)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == len(groups) {
+		return nil, errors.Join(errs...)
+	}
+
+	var responses []*DnsPacket
+	for {
+		buffer := NewBytePacketBufferSize(mdnsMaxMessage)
+		n, _, err := conn.ReadFrom(buffer.Buf)
+		if err != nil {
+			// The end of the window is the expected way out.
+			if errors.Is(ctx.Err(), context.Canceled) {
+				return nil, ctx.Err()
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return responses, nil
+			}
+			return nil, err
+		}
+		buffer.Buf = buffer.Buf[:n]
+
+		resp, err := FromBuffer2DnsPacket(buffer)
+		if err != nil || !resp.Header.Response {
+			continue
+		}
+		responses = append(responses, resp)
+	}
+}
@@ -0,0 +1,74 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCollectMDNS(t *testing.T) {
+	var mu sync.Mutex
+	var classes []Class
+	// responder answers like an mDNS device at addr, with the cache-flush
+	// bit set in the class of its record.
+	responder := func(addr net.IP) string {
+		return serveUDP(t, func(req *DnsPacket) *DnsPacket {
+			mu.Lock()
+			classes = append(classes, req.Questions[0].Class)
+			mu.Unlock()
+			resp := answerA(req, addr)
+			resp.Header.AuthoritativeAnswer = true
+			resp.Answers[0].Class |= mdnsUnicastResponse
+			return resp
+		})
+	}
+	groups := []string{
+		responder(net.IPv4(192, 0, 2, 1)),
+		responder(net.IPv4(192, 0, 2, 2)),
+		// A query echoed back isn't a response and is skipped.
+		serveUDP(t, func(req *DnsPacket) *DnsPacket { return req }),
+		// A group that can't be reached doesn't fail the lookup.
+		"invalid:port",
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	responses, err := collectMDNS(ctx, groups, "printer.local", A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("collecting returned after %v, before the window ended", elapsed)
+	}
+
+	var addrs []string
+	for _, resp := range responses {
+		if resp.Header.ID != 0 || len(resp.Answers) != 1 {
+			t.Errorf("unexpected response\n%v", resp)
+			continue
+		}
+		addrs = append(addrs, resp.Answers[0].Addr.String())
+	}
+	slices.Sort(addrs)
+	if want := []string{"192.0.2.1", "192.0.2.2"}; !slices.Equal(addrs, want) {
+		t.Errorf("collected answers from %v, want %v", addrs, want)
+	}
+	mu.Lock()
+	for _, class := range classes {
+		if class != ClassIN|mdnsUnicastResponse {
+			t.Errorf("question has class %#x, want IN with the QU bit", uint16(class))
+		}
+	}
+	mu.Unlock()
+
+	// Without any group to send to, the lookup fails.
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := collectMDNS(ctx, []string{"invalid:port"}, "printer.local", A); err == nil {
+		t.Error("collecting without a reachable group succeeded")
+	}
+}
@@ -0,0 +1,222 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ParseRecord parses a record from a line in master file format, like
+// "www.example.com 3600 IN A 1.2.3.4" or
+// "example.com. 300 IN MX 10 mail.example.com.". The TTL and the class are
+// optional and may come in either order, they default to 0 and IN. Strings
+// of TXT and HINFO records can be quoted, and a ";" outside of quotes
+// starts a comment. Only the types with fields in DnsRecord are supported,
+// apart from OPT.
+func ParseRecord(line string) (*DnsRecord, error) {
+	tokens, err := tokenizeRecord(line)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) < 3 {
+		return nil, fmt.Errorf("record %q is missing fields", line)
+	}
+
+	domain := parseName(tokens[0])
+	tokens = tokens[1:]
+
+	var ttl uint32
+	class := ClassIN
+	for seenTTL, seenClass := false, false; len(tokens) > 0; tokens = tokens[1:] {
+		text := tokens[0]
+		if n, err := strconv.ParseUint(text, 10, 32); err == nil && !seenTTL {
+			ttl, seenTTL = uint32(n), true
+		} else if c, ok := parseClass(text); ok && !seenClass {
+			class, seenClass = c, true
+		} else {
+			break
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("record %q has no type", line)
+	}
+
+	typ, err := ParseRecordType(tokens[0])
+	if err != nil {
+		return nil, err
+	}
+	rec, err := parseRecordData(typ, domain, ttl, tokens[1:])
+	if err != nil {
+		return nil, fmt.Errorf("record %q: %w", line, err)
+	}
+	rec.Class = class
+	return rec, nil
+}
+
+// tokenizeRecord splits line into its fields. The quotes around a field
+// are removed, but escapes are kept, so that names keep them for
+// splitLabels and strings can be unescaped by unescapeString.
+func tokenizeRecord(line string) ([]string, error) {
+	var tokens []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" || line[0] == ';' {
+			return tokens, nil
+		}
+
+		if line[0] == '"' {
+			end := 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				return nil, fmt.Errorf("unterminated string in %q", line)
+			}
+			tokens = append(tokens, line[1:end])
+			line = line[end+1:]
+			continue
+		}
+
+		// An escaped space or semicolon doesn't end the field.
+		end := 0
+		for end < len(line) && strings.IndexByte(" \t;", line[end]) < 0 {
+			if line[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		end = min(end, len(line))
+		tokens = append(tokens, line[:end])
+		line = line[end:]
+	}
+}
+
+// unescapeString resolves the escapes of a <character-string> in master
+// file format, as splitLabels does for names: "\DDD" is the byte with the
+// decimal value DDD, and a backslash followed by any other character is
+// that character.
+func unescapeString(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+
+	text := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c != '\\':
+			text = append(text, c)
+		case i+3 < len(s) && isDigits(s[i+1:i+4]):
+			n, _ := strconv.Atoi(s[i+1 : i+4])
+			if n > 0xFF {
+				return "", fmt.Errorf("invalid escape \\%s in %q", s[i+1:i+4], s)
+			}
+			text = append(text, byte(n))
+			i += 3
+		case i+1 < len(s):
+			text = append(text, s[i+1])
+			i++
+		default:
+			return "", fmt.Errorf("trailing backslash in %q", s)
+		}
+	}
+	return string(text), nil
+}
+
+// parseName drops the trailing dot of an absolute name, which is how names
+// are stored in records. An escaped dot at the end belongs to the last label
+// and is kept.
+func parseName(name string) string {
+	for i := 0; i < len(name); i++ {
+		switch {
+		case name[i] == '\\':
+			i++
+		case name[i] == '.' && i == len(name)-1:
+			return name[:i]
+		}
+	}
+	return name
+}
+
+func parseClass(s string) (Class, bool) {
+	for _, c := range []Class{ClassIN, ClassCH, ClassNONE, ClassANY} {
+		if strings.EqualFold(c.String(), s) {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+func parseRecordData(typ RecordType, domain string, ttl uint32, tokens []string) (*DnsRecord, error) {
+	want := map[RecordType]int{A: 1, AAAA: 1, NS: 1, CNAME: 1, DNAME: 1, MX: 2, HINFO: 2, SOA: 7}
+	if n, ok := want[typ]; ok && len(tokens) != n {
+		return nil, fmt.Errorf("%s needs %d fields, got %d", typ, n, len(tokens))
+	}
+
+	switch typ {
+	case A, AAAA:
+		ip := net.ParseIP(tokens[0])
+		if ip == nil {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidAddress, tokens[0])
+		}
+		if typ == A {
+			return NewCheckedADnsRecord(domain, ip, ttl)
+		}
+		return NewCheckedAAAADnsRecord(domain, ip, ttl)
+	case NS:
+		return NewNSDnsRecord(domain, parseName(tokens[0]), ttl), nil
+	case CNAME:
+		return NewCNameDnsRecord(domain, parseName(tokens[0]), ttl), nil
+	case DNAME:
+		return NewDNAMEDnsRecord(domain, parseName(tokens[0]), ttl), nil
+	case MX:
+		priority, err := strconv.ParseUint(tokens[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MX preference %q", tokens[0])
+		}
+		return NewMXDnsRecord(domain, parseName(tokens[1]), uint16(priority), ttl), nil
+	case HINFO:
+		cpu, err := unescapeString(tokens[0])
+		if err != nil {
+			return nil, err
+		}
+		os, err := unescapeString(tokens[1])
+		if err != nil {
+			return nil, err
+		}
+		return NewHINFODnsRecord(domain, cpu, os, ttl), nil
+	case SOA:
+		var values [5]uint32
+		for i, tok := range tokens[2:] {
+			n, err := strconv.ParseUint(tok, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid SOA value %q", tok)
+			}
+			values[i] = uint32(n)
+		}
+		return NewSOADnsRecord(domain, parseName(tokens[0]), parseName(tokens[1]),
+			values[0], values[1], values[2], values[3], values[4], ttl), nil
+	case TXT:
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("TXT needs at least one string")
+		}
+		txt := make([]string, len(tokens))
+		for i, tok := range tokens {
+			text, err := unescapeString(tok)
+			if err != nil {
+				return nil, err
+			}
+			if len(text) > 255 {
+				return nil, fmt.Errorf("TXT string of %d bytes exceeds 255", len(text))
+			}
+			txt[i] = text
+		}
+		return NewTXTDnsRecord(domain, txt, ttl), nil
+	default:
+		return nil, fmt.Errorf("parsing %s records is not supported", typ)
+	}
+}
@@ -0,0 +1,57 @@
+package dns
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseRecord(t *testing.T) {
+	tests := []struct {
+		line string
+		want *DnsRecord
+	}{
+		{"www.example.com 3600 IN A 1.2.3.4", NewADnsRecord("www.example.com", net.IPv4(1, 2, 3, 4), 3600)},
+		{"www.example.com. IN 60 AAAA 2001:db8::1", NewAAAADnsRecord("www.example.com", net.ParseIP("2001:db8::1"), 60)},
+		{"www.example.com 300 CNAME host.example.com.", NewCNameDnsRecord("www.example.com", "host.example.com", 300)},
+		{"example.com 300 IN NS ns1.example.com. ; primary", NewNSDnsRecord("example.com", "ns1.example.com", 300)},
+		{"example.com 300 IN MX 10 mail.example.com.", NewMXDnsRecord("example.com", "mail.example.com", 10, 300)},
+		{`example.com 300 IN TXT "v=spf1 -all" plain`, NewTXTDnsRecord("example.com", []string{"v=spf1 -all", "plain"}, 300)},
+		{`example.com 300 IN TXT "say \"hi\"; \\ \065\010"`, NewTXTDnsRecord("example.com", []string{"say \"hi\"; \\ A\n"}, 300)},
+		{`example.com 300 IN TXT a\ b\;c`, NewTXTDnsRecord("example.com", []string{"a b;c"}, 300)},
+		{`example.com 300 IN HINFO "Intel x86" Linux`, NewHINFODnsRecord("example.com", "Intel x86", "Linux", 300)},
+		{`www.example.com 300 CNAME odd\.`, NewCNameDnsRecord("www.example.com", `odd\.`, 300)},
+		{`www.example.com 300 CNAME odd\\.`, NewCNameDnsRecord("www.example.com", `odd\\`, 300)},
+		{". 300 IN NS a.root-servers.net.", NewNSDnsRecord("", "a.root-servers.net", 300)},
+	}
+	for _, tt := range tests {
+		got, err := ParseRecord(tt.line)
+		if err != nil {
+			t.Errorf("ParseRecord(%q): %v", tt.line, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("ParseRecord(%q) = %v, want %v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseRecordErrors(t *testing.T) {
+	for _, line := range []string{
+		"",
+		"www.example.com 3600 IN",
+		"www.example.com 3600 IN A",
+		"www.example.com 3600 IN A 1.2.3",
+		"www.example.com 3600 IN A 2001:db8::1",
+		"www.example.com 3600 IN AAAA 1.2.3.4",
+		"example.com 300 IN MX mail.example.com.",
+		"example.com 300 IN MX 70000 mail.example.com.",
+		`example.com 300 IN TXT "unterminated`,
+		`example.com 300 IN TXT "\256"`,
+		`example.com 300 IN TXT trailing\`,
+		"example.com 300 IN BOGUS data",
+	} {
+		if rec, err := ParseRecord(line); err == nil {
+			t.Errorf("ParseRecord(%q) = %v, want an error", line, rec)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package dns
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimit configures how many queries per second the server answers for
+// a single client IP.
+type RateLimit struct {
+	// QueriesPerSecond is the sustained rate allowed per client IP.
+	QueriesPerSecond float64
+	// Burst is how many queries a client may send at once. It defaults to
+	// QueriesPerSecond, but at least 1, as a smaller bucket never holds a
+	// whole token.
+	Burst int
+	// Drop silently discards queries over the limit. Otherwise they are
+	// answered with an empty response with the TC bit set, so legitimate
+	// clients retry over TCP while spoofed sources gain no amplification.
+	Drop bool
+}
+
+// sweepInterval is how often idle clients are evicted from the limiter.
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket per client IP. Its zero value is ready to
+// use and it is safe for concurrent use.
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// allow reports whether a query from client may be answered at now and
+// takes a token from its bucket if so.
+func (l *rateLimiter) allow(client string, limit RateLimit, now time.Time) bool {
+	burst := float64(limit.Burst)
+	if burst <= 0 {
+		burst = max(1, limit.QueriesPerSecond)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.buckets == nil {
+		l.buckets = map[string]*bucket{}
+	}
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweep(limit, burst, now)
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[client] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * limit.QueriesPerSecond
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep evicts clients whose bucket has refilled completely, as they are
+// indistinguishable from clients never seen before.
+func (l *rateLimiter) sweep(limit RateLimit, burst float64, now time.Time) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*limit.QueriesPerSecond >= burst {
+			delete(l.buckets, client)
+		}
+	}
+	l.lastSweep = now
+}
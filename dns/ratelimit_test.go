@@ -0,0 +1,109 @@
+package dns
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingConn records the responses written by the server.
+type recordingConn struct {
+	net.PacketConn
+
+	mu      sync.Mutex
+	replies map[string][]*DnsPacket
+}
+
+func (c *recordingConn) WriteTo(msg []byte, addr net.Addr) (int, error) {
+	resp, err := Unpack(msg)
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.replies == nil {
+		c.replies = map[string][]*DnsPacket{}
+	}
+	ip := clientIP(addr)
+	c.replies[ip] = append(c.replies[ip], resp)
+	return len(msg), nil
+}
+
+// sendQuery hands a query from ip to s as if it arrived over UDP.
+func sendQuery(t *testing.T, s *Server, conn net.PacketConn, ip string) {
+	t.Helper()
+	msg, err := NewQuery("www.example.com", A).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer := GetBuffer()
+	copy(buffer.Buf, msg)
+	s.handleQuery(conn, &net.UDPAddr{IP: net.ParseIP(ip), Port: 5353}, buffer, len(msg))
+}
+
+func TestServerRateLimit(t *testing.T) {
+	for _, drop := range []bool{false, true} {
+		s := &Server{
+			Upstream:  upstreamServer(t),
+			RateLimit: &RateLimit{QueriesPerSecond: 1, Burst: 3, Drop: drop},
+		}
+		conn := &recordingConn{}
+		for range 10 {
+			sendQuery(t, s, conn, "192.0.2.10")
+		}
+		sendQuery(t, s, conn, "192.0.2.20")
+
+		var answered, truncated int
+		for _, resp := range conn.replies["192.0.2.10"] {
+			if resp.Header.TruncatedMessage && len(resp.Answers) == 0 {
+				truncated++
+			} else if len(resp.Answers) == 1 {
+				answered++
+			}
+		}
+		// The burst may have been refilled by a token while the queries
+		// were sent.
+		if answered < 3 || answered > 4 {
+			t.Errorf("drop %v: %d of 10 queries were answered, want the burst of 3", drop, answered)
+		}
+		if wantTruncated := 10 - answered; !drop && truncated != wantTruncated {
+			t.Errorf("%d queries got a truncated response, want %d", truncated, wantTruncated)
+		}
+		if drop && truncated != 0 {
+			t.Errorf("%d queries were answered with a truncated response instead of dropped", truncated)
+		}
+
+		other := conn.replies["192.0.2.20"]
+		if len(other) != 1 || other[0].Header.TruncatedMessage || len(other[0].Answers) != 1 {
+			t.Errorf("drop %v: other client got %v", drop, other)
+		}
+	}
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	var l rateLimiter
+	now := time.Now()
+
+	// A rate below one query per second still allows a single query.
+	limit := RateLimit{QueriesPerSecond: 0.5}
+	if !l.allow("a", limit, now) {
+		t.Error("first query at 0.5 qps was refused")
+	}
+	if l.allow("a", limit, now) {
+		t.Error("second query at 0.5 qps was allowed")
+	}
+	if !l.allow("a", limit, now.Add(2*time.Second)) {
+		t.Error("query after the bucket refilled was refused")
+	}
+
+	// Idle clients are evicted once their bucket has refilled.
+	l.allow("b", limit, now.Add(2*time.Second))
+	l.allow("c", limit, now.Add(2*time.Second+sweepInterval))
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("idle client was not evicted")
+	}
+	if _, ok := l.buckets["c"]; !ok {
+		t.Error("active client was evicted")
+	}
+}
@@ -0,0 +1,229 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strings"
+)
+
+// DefaultRootHints are the IPv4 addresses of the 13 root servers, a to m,
+// where recursive lookups start unless a Resolver has its own RootHints.
+var DefaultRootHints = []net.IP{
+	net.IPv4(198, 41, 0, 4),
+	net.IPv4(170, 247, 170, 2),
+	net.IPv4(192, 33, 4, 12),
+	net.IPv4(199, 7, 91, 13),
+	net.IPv4(192, 203, 230, 10),
+	net.IPv4(192, 5, 5, 241),
+	net.IPv4(192, 112, 36, 4),
+	net.IPv4(198, 97, 190, 53),
+	net.IPv4(192, 36, 148, 17),
+	net.IPv4(192, 58, 128, 30),
+	net.IPv4(193, 0, 14, 129),
+	net.IPv4(199, 7, 83, 42),
+	net.IPv4(202, 12, 27, 33),
+}
+
+// maxRecursionSteps bounds the number of queries of a recursive lookup.
+const maxRecursionSteps = 32
+
+// maxNSNesting bounds how deeply the lookups of name servers that came
+// without glue may nest, each one needed to reach the server of the one
+// before.
+const maxNSNesting = 4
+
+// Resolver resolves names by itself, starting at the root servers and
+// following referrals down to the authoritative server.
+type Resolver struct {
+	// Exchange sends req to server, given as "host:port", and returns the
+	// response. It defaults to a plain UDP exchange and can be replaced,
+	// for example to run against canned responses in tests.
+	Exchange func(ctx context.Context, server string, req *DnsPacket) (*DnsPacket, error)
+
+	// MaxPayload is the UDP payload size advertised to the servers asked,
+	// and so the largest response they send. Zero sends no OPT record, so
+	// servers stick to 512 bytes.
+	MaxPayload uint16
+
+	// RootHints are the addresses of the root servers. Every lookup
+	// starts at one of them picked at random. Nil uses DefaultRootHints.
+	RootHints []net.IP
+}
+
+// RecursiveLookup resolves qname with a zero Resolver.
+func RecursiveLookup(ctx context.Context, qname string, qtype RecordType) (*DnsPacket, error) {
+	var r Resolver
+	return r.RecursiveLookup(ctx, qname, qtype)
+}
+
+// RecursiveLookup resolves qname starting at the root servers.
+//
+// Following RFC 7816, intermediate servers never see the full name. Each
+// server is only asked for the NS records of the next label below the zone
+// it is known to serve, like "com" at the root and then "example.com" at the
+// com servers. Only the final step reveals the full name and the real type.
+//
+// Referrals without glue are followed by looking up the address of the
+// name server first.
+func (r *Resolver) RecursiveLookup(ctx context.Context, qname string, qtype RecordType) (*DnsPacket, error) {
+	return r.recursiveLookup(ctx, qname, qtype, 0)
+}
+
+func (r *Resolver) recursiveLookup(ctx context.Context, qname string, qtype RecordType, nesting int) (*DnsPacket, error) {
+	raw, err := splitLabels(qname)
+	if err != nil {
+		return nil, err
+	}
+	// The labels are kept in presentation form, so that joining them
+	// escapes the dots within a label again.
+	labels := make([]string, len(raw))
+	for i, label := range raw {
+		labels[i] = string(appendLabel(nil, label, false))
+	}
+	ns := r.root()
+	if ns == nil {
+		return nil, errors.New("no root hints")
+	}
+	depth := 1
+
+	for step := 0; step < maxRecursionSteps; step++ {
+		name, typ := qname, qtype
+		minimized := depth < len(labels)
+		if minimized {
+			name, typ = strings.Join(labels[len(labels)-depth:], "."), NS
+		}
+
+		req := NewDnsPacket()
+		req.Header.ID = newQueryID()
+		req.AddQuestion(NewDnsQuestion(name, typ))
+		if r.MaxPayload > 0 {
+			WithEDNS(r.MaxPayload)(req)
+		}
+
+		resp, err := r.exchange(ctx, net.JoinHostPort(ns.String(), "53"), req)
+		if err != nil {
+			return nil, err
+		}
+
+		// A name that does not exist has no names below it either. The
+		// response to a minimized query is about an ancestor of qname, so
+		// the result is rebuilt to answer the question actually asked.
+		if resp.Header.Rescode == NXDOMAIN {
+			if minimized {
+				nx := ErrorResponse(resp, NXDOMAIN)
+				nx.Header.AuthoritativeAnswer = resp.Header.AuthoritativeAnswer
+				nx.Questions = []*DnsQuestion{NewDnsQuestion(qname, qtype)}
+				nx.Authorities = resp.Authorities
+				return nx, nil
+			}
+			return resp, nil
+		}
+
+		if !minimized && len(resp.Answers) > 0 && resp.Header.Rescode == NOERROR {
+			return resp, nil
+		}
+
+		newNS := resp.GetResolvedNS(name)
+		if newNS == nil {
+			if host := resp.GetUnresolvedNS(name); host != "" {
+				newNS, err = r.resolveNS(ctx, host, nesting)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		if newNS != nil {
+			ns = newNS
+			if minimized {
+				depth++
+			}
+			continue
+		}
+
+		if !minimized {
+			return resp, nil
+		}
+
+		// No zone cut at this label, so the same server is asked about
+		// the next one.
+		depth++
+	}
+
+	return nil, errors.New("recursive lookup exceeded the maximum number of steps")
+}
+
+// root picks a root server at random, or returns nil if there is none.
+func (r *Resolver) root() net.IP {
+	hints := r.RootHints
+	if hints == nil {
+		hints = DefaultRootHints
+	}
+	if len(hints) == 0 {
+		return nil
+	}
+	return hints[rand.IntN(len(hints))]
+}
+
+// resolveNS looks up the address of the name server host, which a referral
+// named without glue.
+func (r *Resolver) resolveNS(ctx context.Context, host string, nesting int) (net.IP, error) {
+	if nesting >= maxNSNesting {
+		return nil, fmt.Errorf("too many nested lookups resolving name server %s", host)
+	}
+
+	resp, err := r.recursiveLookup(ctx, host, A, nesting+1)
+	if err != nil {
+		return nil, err
+	}
+
+	records, _ := followChain(resp.Answers, host, A)
+	if len(records) == 0 {
+		return nil, fmt.Errorf("name server %s has no address", host)
+	}
+	return records[0].Addr, nil
+}
+
+func (r *Resolver) exchange(ctx context.Context, server string, req *DnsPacket) (*DnsPacket, error) {
+	if r.Exchange != nil {
+		return r.Exchange(ctx, server, req)
+	}
+	return exchangeUDP(ctx, server, req)
+}
+
+// GetNS returns the NS records of the authority section that are
+// responsible for qname.
+func (d *DnsPacket) GetNS(qname string) []*DnsRecord {
+	var records []*DnsRecord
+	for _, rec := range d.Authorities {
+		if rec.Type == NS && InZone(qname, rec.Domain) {
+			records = append(records, rec)
+		}
+	}
+	return records
+}
+
+// GetResolvedNS returns the address of a name server responsible for qname,
+// using the glue records of the additional section. It returns nil if the
+// referral came without glue.
+func (d *DnsPacket) GetResolvedNS(qname string) net.IP {
+	for _, ns := range d.GetNS(qname) {
+		for _, rec := range d.Resources {
+			if rec.Type == A && sameName(rec.Domain, ns.Host) {
+				return rec.Addr
+			}
+		}
+	}
+	return nil
+}
+
+// GetUnresolvedNS returns the host name of a name server responsible for
+// qname, or "" if there is none.
+func (d *DnsPacket) GetUnresolvedNS(qname string) string {
+	for _, ns := range d.GetNS(qname) {
+		return ns.Host
+	}
+	return ""
+}
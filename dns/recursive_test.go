@@ -0,0 +1,247 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestGetNS(t *testing.T) {
+	referral := NewDnsPacket()
+	referral.Authorities = append(referral.Authorities,
+		NewNSDnsRecord("example.com", "ns1.example.com", 3600),
+		NewNSDnsRecord("Example.COM.", "ns2.example.net", 3600),
+		NewNSDnsRecord("fooexample.com", "ns.fooexample.com", 3600),
+		NewSOADnsRecord("example.com", "ns1.example.com", "admin.example.com", 1, 2, 3, 4, 5, 3600),
+	)
+	referral.Resources = append(referral.Resources, NewADnsRecord("ns1.example.com", net.IPv4(192, 0, 2, 53), 3600))
+
+	for _, tt := range []struct {
+		qname string
+		want  int
+	}{
+		{"example.com", 2},
+		{"www.EXAMPLE.com", 2},
+		{"www.fooexample.com", 1},
+		{"example.org", 0},
+	} {
+		if got := referral.GetNS(tt.qname); len(got) != tt.want {
+			t.Errorf("GetNS(%q) = %v, want %d records", tt.qname, got, tt.want)
+		}
+	}
+
+	if ip := referral.GetResolvedNS("www.example.com"); !ip.Equal(net.IPv4(192, 0, 2, 53)) {
+		t.Errorf("GetResolvedNS = %v", ip)
+	}
+	if ip := referral.GetResolvedNS("www.fooexample.com"); ip != nil {
+		t.Errorf("GetResolvedNS without glue = %v", ip)
+	}
+}
+
+// referral returns a response to req delegating zone to the name server
+// host at addr, with glue.
+func referral(req *DnsPacket, zone, host string, addr net.IP) *DnsPacket {
+	resp := ErrorResponse(req, NOERROR)
+	resp.Authorities = append(resp.Authorities, NewNSDnsRecord(zone, host, 3600))
+	resp.Resources = append(resp.Resources, NewADnsRecord(host, addr, 3600))
+	return resp
+}
+
+// fakeHierarchy is a root, a com and an example.com server, reached through
+// the Exchange of a Resolver. It records the queries each server got.
+type fakeHierarchy struct {
+	mu      sync.Mutex
+	queries []string
+}
+
+var (
+	fakeRoot    = net.IPv4(198, 51, 100, 1)
+	fakeCom     = net.IPv4(198, 51, 100, 2)
+	fakeExample = net.IPv4(198, 51, 100, 3)
+)
+
+func (h *fakeHierarchy) exchange(ctx context.Context, server string, req *DnsPacket) (*DnsPacket, error) {
+	q := req.Questions[0]
+	h.mu.Lock()
+	h.queries = append(h.queries, fmt.Sprintf("%s %s %s", server, q.Name, q.Type))
+	h.mu.Unlock()
+
+	switch server {
+	case net.JoinHostPort(fakeRoot.String(), "53"):
+		return referral(req, "com", "a.gtld.test", fakeCom), nil
+	case net.JoinHostPort(fakeCom.String(), "53"):
+		return referral(req, "example.com", "ns1.example.com", fakeExample), nil
+	case net.JoinHostPort(fakeExample.String(), "53"):
+		z := exampleZone()
+		z.Add(NewADnsRecord("host.sub.example.com", testIPv4, 300))
+		return z.answer(req), nil
+	}
+	return nil, fmt.Errorf("unexpected server %s", server)
+}
+
+func TestRecursiveLookupMinimizesQNAME(t *testing.T) {
+	for _, tt := range []struct {
+		qname string
+		want  []string
+	}{
+		{"v4.example.com", []string{
+			"198.51.100.1:53 com NS",
+			"198.51.100.2:53 example.com NS",
+			"198.51.100.3:53 v4.example.com A",
+		}},
+		// Without a zone cut at sub, the same server is asked for it first.
+		{"host.sub.example.com", []string{
+			"198.51.100.1:53 com NS",
+			"198.51.100.2:53 example.com NS",
+			"198.51.100.3:53 sub.example.com NS",
+			"198.51.100.3:53 host.sub.example.com A",
+		}},
+		// Nothing exists below a name that doesn't exist.
+		{"host.missing.example.com", []string{
+			"198.51.100.1:53 com NS",
+			"198.51.100.2:53 example.com NS",
+			"198.51.100.3:53 missing.example.com NS",
+		}},
+		// An escaped dot doesn't separate labels.
+		{`a\.b.example.com`, []string{
+			"198.51.100.1:53 com NS",
+			"198.51.100.2:53 example.com NS",
+			`198.51.100.3:53 a\.b.example.com A`,
+		}},
+	} {
+		h := &fakeHierarchy{}
+		r := &Resolver{Exchange: h.exchange, RootHints: []net.IP{fakeRoot}}
+		if _, err := r.RecursiveLookup(context.Background(), tt.qname, A); err != nil {
+			t.Errorf("RecursiveLookup(%s): %v", tt.qname, err)
+		}
+		if !slices.Equal(h.queries, tt.want) {
+			t.Errorf("RecursiveLookup(%s) sent\n%q\nwant\n%q", tt.qname, h.queries, tt.want)
+		}
+	}
+}
+
+func TestRecursiveLookupNXDOMAIN(t *testing.T) {
+	h := &fakeHierarchy{}
+	r := &Resolver{Exchange: h.exchange, RootHints: []net.IP{fakeRoot}}
+
+	// The lookup stops at missing.example.com, but the result is for the
+	// name and type asked for.
+	resp, err := r.RecursiveLookup(context.Background(), "host.missing.example.com", A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Rescode != NXDOMAIN {
+		t.Errorf("lookup of a missing name got %s", resp.Header.Rescode)
+	}
+	if q, ok := resp.Question(0); !ok || !q.Equal(NewDnsQuestion("host.missing.example.com", A)) || len(resp.Questions) != 1 {
+		t.Errorf("NXDOMAIN result has the questions %v", resp.Questions)
+	}
+	if len(resp.Authorities) != 1 || resp.Authorities[0].Type != SOA {
+		t.Errorf("NXDOMAIN result has the authority section %v", resp.Authorities)
+	}
+}
+
+// gluelessExchange is a hierarchy where the com servers are named without
+// glue, as ns.nic.test, and have to be looked up through the test servers.
+// The loop servers are named within their own zone, without glue, so
+// they can never be reached.
+func gluelessExchange(h *fakeHierarchy) func(ctx context.Context, server string, req *DnsPacket) (*DnsPacket, error) {
+	fakeTest := net.IPv4(198, 51, 100, 4)
+	return func(ctx context.Context, server string, req *DnsPacket) (*DnsPacket, error) {
+		q := req.Questions[0]
+		switch server {
+		case net.JoinHostPort(fakeRoot.String(), "53"), net.JoinHostPort(fakeTest.String(), "53"):
+			h.mu.Lock()
+			h.queries = append(h.queries, fmt.Sprintf("%s %s %s", server, q.Name, q.Type))
+			h.mu.Unlock()
+		}
+
+		switch server {
+		case net.JoinHostPort(fakeRoot.String(), "53"):
+			switch {
+			case InZone(q.Name, "com"):
+				resp := ErrorResponse(req, NOERROR)
+				resp.Authorities = append(resp.Authorities, NewNSDnsRecord("com", "ns.nic.test", 3600))
+				return resp, nil
+			case InZone(q.Name, "loop"):
+				resp := ErrorResponse(req, NOERROR)
+				resp.Authorities = append(resp.Authorities, NewNSDnsRecord("loop", "ns.loop", 3600))
+				return resp, nil
+			}
+			return referral(req, "test", "ns.test", fakeTest), nil
+		case net.JoinHostPort(fakeTest.String(), "53"):
+			resp := ErrorResponse(req, NOERROR)
+			resp.Header.AuthoritativeAnswer = true
+			if q.Type == A {
+				resp.Answers = append(resp.Answers, NewADnsRecord(q.Name, fakeCom, 3600))
+			}
+			return resp, nil
+		}
+		return h.exchange(ctx, server, req)
+	}
+}
+
+func TestRecursiveLookupWithoutGlue(t *testing.T) {
+	h := &fakeHierarchy{}
+	r := &Resolver{Exchange: gluelessExchange(h), RootHints: []net.IP{fakeRoot}}
+
+	resp, err := r.RecursiveLookup(context.Background(), "v4.example.com", A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answers) != 1 || !resp.Answers[0].Addr.Equal(testIPv4) {
+		t.Errorf("lookup through a glueless referral got\n%v", resp)
+	}
+	want := []string{
+		"198.51.100.1:53 com NS",
+		"198.51.100.1:53 test NS",
+		"198.51.100.4:53 nic.test NS",
+		"198.51.100.4:53 ns.nic.test A",
+		"198.51.100.2:53 example.com NS",
+		"198.51.100.3:53 v4.example.com A",
+	}
+	if !slices.Equal(h.queries, want) {
+		t.Errorf("sent\n%q\nwant\n%q", h.queries, want)
+	}
+
+	if _, err := r.RecursiveLookup(context.Background(), "www.loop", A); err == nil {
+		t.Error("lookup through unreachable name servers succeeded")
+	}
+}
+
+func TestRootHints(t *testing.T) {
+	if len(DefaultRootHints) != 13 {
+		t.Errorf("%d default root hints, want 13", len(DefaultRootHints))
+	}
+
+	hints := []net.IP{net.IPv4(198, 51, 100, 10), net.IPv4(198, 51, 100, 11), net.IPv4(198, 51, 100, 12)}
+	started := map[string]bool{}
+	r := &Resolver{
+		RootHints: hints,
+		Exchange: func(ctx context.Context, server string, req *DnsPacket) (*DnsPacket, error) {
+			started[server] = true
+			return ErrorResponse(req, NXDOMAIN), nil
+		},
+	}
+	for range 100 {
+		if _, err := r.RecursiveLookup(context.Background(), "example.com", A); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, hint := range hints {
+		if !started[net.JoinHostPort(hint.String(), "53")] {
+			t.Errorf("no lookup started at %s, only at %v", hint, started)
+		}
+	}
+	if len(started) != len(hints) {
+		t.Errorf("lookups started at %v", started)
+	}
+
+	r.RootHints = []net.IP{}
+	if _, err := r.RecursiveLookup(context.Background(), "example.com", A); err == nil {
+		t.Error("lookup without root hints succeeded")
+	}
+}
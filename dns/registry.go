@@ -0,0 +1,264 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// RecordCodec reads and writes the data of the records of one type, see
+// RegisterRecordType. Read is given a buffer positioned at the start of the
+// data and ending with it, and rec with the owner name, type and TTL set.
+// It has to consume all of the data. Write only writes the data of rec;
+// the owner name, type, class, TTL and length are written around it.
+type RecordCodec interface {
+	Read(buffer *BytePacketBuffer, rec *DnsRecord) error
+	Write(buffer *BytePacketBuffer, rec *DnsRecord) error
+}
+
+type recordTypeInfo struct {
+	num   uint16
+	name  string
+	codec RecordCodec
+	// custom is set for types added by RegisterRecordType.
+	custom bool
+}
+
+var (
+	registryMu sync.RWMutex
+	// recordTypes holds every type known by number and name. The ones
+	// with a codec are read and written by it, the others by the switches
+	// of readRecordData and DnsRecord.Write.
+	recordTypes = map[RecordType]recordTypeInfo{
+		A:     {num: 1, name: "A", codec: aCodec{}},
+		NS:    {num: 2, name: "NS", codec: hostCodec{}},
+		CNAME: {num: 5, name: "CNAME", codec: hostCodec{}},
+		MX:    {num: 15, name: "MX", codec: mxCodec{}},
+		AAAA:  {num: 28, name: "AAAA", codec: aaaaCodec{}},
+		HINFO: {num: 13, name: "HINFO"},
+		SOA:   {num: 6, name: "SOA"},
+		TXT:   {num: 16, name: "TXT"},
+		OPT:   {num: 41, name: "OPT"},
+		DS:    {num: 43, name: "DS"},
+		RRSIG: {num: 46, name: "RRSIG"},
+		AXFR:  {num: 252, name: "AXFR"},
+		TSIG:  {num: 250, name: "TSIG"},
+		ANY:   {num: 255, name: "ANY"},
+		DNAME: {num: 39, name: "DNAME"},
+		SVCB:  {num: 64, name: "SVCB"},
+		HTTPS: {num: 65, name: "HTTPS"},
+	}
+	recordTypesByNum = func() map[uint16]RecordType {
+		byNum := make(map[uint16]RecordType, len(recordTypes))
+		for typ, info := range recordTypes {
+			byNum[info.num] = typ
+		}
+		return byNum
+	}()
+	// nextRecordType is the RecordType given to the next registered type.
+	nextRecordType = HTTPS + 1
+)
+
+// RegisterRecordType adds a record type with the given number and name, so
+// that its records are read and written by codec instead of being kept as
+// UNKNOWN. It returns the RecordType of the new type. Names embedded in the
+// data are never compressed, as RFC 3597 requires for types not known to
+// every server. Types are usually registered from an init function, before
+// any message is read.
+func RegisterRecordType(num uint16, name string, codec RecordCodec) (RecordType, error) {
+	if codec == nil {
+		return UNKNOWN, fmt.Errorf("record type %s has no codec", name)
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if typ, ok := recordTypesByNum[num]; ok {
+		return UNKNOWN, fmt.Errorf("record type %d is already registered as %s", num, recordTypes[typ].name)
+	}
+	for _, info := range recordTypes {
+		if strings.EqualFold(info.name, name) {
+			return UNKNOWN, fmt.Errorf("record type %s is already registered", name)
+		}
+	}
+
+	typ := nextRecordType
+	nextRecordType++
+	recordTypes[typ] = recordTypeInfo{num: num, name: name, codec: codec, custom: true}
+	recordTypesByNum[num] = typ
+	return typ, nil
+}
+
+func lookupRecordType(typ RecordType) (recordTypeInfo, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	info, ok := recordTypes[typ]
+	return info, ok
+}
+
+func lookupRecordNum(num uint16) (RecordType, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	typ, ok := recordTypesByNum[num]
+	return typ, ok
+}
+
+// readWithCodec reads the dataLen bytes of data of rec with codec. The
+// codec only gets to see a buffer ending with the data.
+func readWithCodec(buffer *BytePacketBuffer, codec RecordCodec, rec *DnsRecord, dataLen uint16) (*DnsRecord, error) {
+	end := int(buffer.Pos) + int(dataLen)
+	if end > len(buffer.Buf) {
+		return nil, ErrBufferOverflow
+	}
+
+	data := *buffer
+	data.Buf = buffer.Buf[:end]
+	err := codec.Read(&data, rec)
+
+	data.Buf = buffer.Buf
+	*buffer = data
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// writeWithCodec writes d with the data written by codec.
+func (d *DnsRecord) writeWithCodec(buffer *BytePacketBuffer, info recordTypeInfo) error {
+	if err := buffer.WriteQName(d.Domain); err != nil {
+		return err
+	}
+	if err := buffer.Write2Byte(info.num); err != nil {
+		return err
+	}
+	if err := buffer.Write2Byte(d.class()); err != nil {
+		return err
+	}
+	if err := buffer.Write4Byte(d.TTL); err != nil {
+		return err
+	}
+	pos := buffer.Pos
+	if err := buffer.Write2Byte(0); err != nil {
+		return err
+	}
+
+	compress := buffer.Compress
+	buffer.Compress = compress && !info.custom
+	err := info.codec.Write(buffer, d)
+	buffer.Compress = compress
+	if err != nil {
+		return err
+	}
+
+	buffer.Set2Bytes(pos, buffer.Pos-(pos+2))
+	return nil
+}
+
+// customDataLen returns the length of the data of d, which is of a
+// registered type, by writing it to a scratch buffer. The buffer is
+// allocated on first use and shared by the records of one count.
+func (c *wireCounter) customDataLen(d *DnsRecord, codec RecordCodec) (int, error) {
+	if c.scratch == nil {
+		c.scratch = NewBytePacketBufferSize(maxMessageSize)
+		c.scratch.Compress = false
+	}
+	c.scratch.Pos = 0
+	if err := codec.Write(c.scratch, d); err != nil {
+		return 0, err
+	}
+	return int(c.scratch.Pos), nil
+}
+
+type aCodec struct{}
+
+func (aCodec) Read(buffer *BytePacketBuffer, rec *DnsRecord) error {
+	raw, err := buffer.Read4Bytes()
+	if err != nil {
+		return err
+	}
+	rec.Addr = net.IPv4(byte(raw>>24), byte(raw>>16), byte(raw>>8), byte(raw))
+	return nil
+}
+
+func (aCodec) Write(buffer *BytePacketBuffer, rec *DnsRecord) error {
+	ip := rec.Addr.To4()
+	if ip == nil {
+		return fmt.Errorf("%w: %v is not an IPv4 address", ErrInvalidAddress, rec.Addr)
+	}
+	for _, b := range ip {
+		if err := buffer.Write1Byte(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type aaaaCodec struct{}
+
+func (aaaaCodec) Read(buffer *BytePacketBuffer, rec *DnsRecord) error {
+	addr := make(net.IP, net.IPv6len)
+	for i := range addr {
+		b, err := buffer.Read()
+		if err != nil {
+			return err
+		}
+		addr[i] = b
+	}
+	rec.Addr = addr
+	return nil
+}
+
+func (aaaaCodec) Write(buffer *BytePacketBuffer, rec *DnsRecord) error {
+	// An IPv4 address would also convert to 16 bytes, but doesn't belong
+	// in an AAAA record.
+	ip := rec.Addr.To16()
+	if ip == nil || rec.Addr.To4() != nil {
+		return fmt.Errorf("%w: %v is not an IPv6 address", ErrInvalidAddress, rec.Addr)
+	}
+	for _, b := range ip {
+		if err := buffer.Write1Byte(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hostCodec handles the types whose data is a single name, NS and CNAME.
+type hostCodec struct{}
+
+func (hostCodec) Read(buffer *BytePacketBuffer, rec *DnsRecord) error {
+	host, err := buffer.ReadQName()
+	if err != nil {
+		return err
+	}
+	rec.Host = host
+	return nil
+}
+
+func (hostCodec) Write(buffer *BytePacketBuffer, rec *DnsRecord) error {
+	return buffer.WriteQName(rec.Host)
+}
+
+type mxCodec struct{}
+
+func (mxCodec) Read(buffer *BytePacketBuffer, rec *DnsRecord) error {
+	priority, err := buffer.Read2Bytes()
+	if err != nil {
+		return err
+	}
+	host, err := buffer.ReadQName()
+	if err != nil {
+		return err
+	}
+	rec.Priority = priority
+	rec.Host = host
+	return nil
+}
+
+func (mxCodec) Write(buffer *BytePacketBuffer, rec *DnsRecord) error {
+	if err := buffer.Write2Byte(rec.Priority); err != nil {
+		return err
+	}
+	return buffer.WriteQName(rec.Host)
+}
@@ -0,0 +1,89 @@
+package dns
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// targetCodec handles a private use type whose data is a priority and a
+// name, like MX.
+type targetCodec struct{}
+
+func (targetCodec) Read(buffer *BytePacketBuffer, rec *DnsRecord) error {
+	return mxCodec{}.Read(buffer, rec)
+}
+
+func (targetCodec) Write(buffer *BytePacketBuffer, rec *DnsRecord) error {
+	return mxCodec{}.Write(buffer, rec)
+}
+
+// typeTarget is registered once for the whole package, as the registry
+// can't forget a type again.
+var typeTarget = func() RecordType {
+	typ, err := RegisterRecordType(65280, "TARGET", targetCodec{})
+	if err != nil {
+		panic(err)
+	}
+	return typ
+}()
+
+func TestRegisterRecordType(t *testing.T) {
+	if typeTarget.String() != "TARGET" || RecordTypeToNum(typeTarget) != 65280 || FromNum2RecordType(65280) != typeTarget {
+		t.Errorf("registered type maps to %q and %d", typeTarget, RecordTypeToNum(typeTarget))
+	}
+	if typ, err := ParseRecordType("target"); err != nil || typ != typeTarget {
+		t.Errorf("ParseRecordType(\"target\") = %v, %v", typ, err)
+	}
+
+	p := ErrorResponse(NewQuery("example.com", typeTarget), NOERROR)
+	rec := &DnsRecord{Type: typeTarget, Domain: "example.com", Class: ClassIN, TTL: 300, Priority: 10, Host: "mail.example.com"}
+	p.Answers = append(p.Answers, rec, NewADnsRecord("mail.example.com", net.IPv4(192, 0, 2, 1), 300))
+	msg, err := p.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The name in the data is written in full, though its suffix was
+	// written before.
+	if !bytes.Contains(msg, []byte("\x00\x0a\x04mail\x07example\x03com\x00")) {
+		t.Errorf("message %q doesn't hold the data uncompressed", msg)
+	}
+
+	parsed, err := Unpack(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.Answers) != 2 || !parsed.Answers[0].Equal(rec) {
+		t.Errorf("answers read back as %v", parsed.Answers)
+	}
+	if again, err := parsed.Pack(); err != nil || !bytes.Equal(again, msg) {
+		t.Errorf("packing again returned %x, %v, want %x", again, err, msg)
+	}
+
+	for _, tt := range []struct {
+		num   uint16
+		name  string
+		codec RecordCodec
+	}{
+		{65280, "OTHER", targetCodec{}},
+		{65281, "mx", targetCodec{}},
+		{65281, "NOCODEC", nil},
+	} {
+		if _, err := RegisterRecordType(tt.num, tt.name, tt.codec); err == nil {
+			t.Errorf("registering %s as %d succeeded", tt.name, tt.num)
+		}
+	}
+}
+
+func BenchmarkWireLenRegisteredType(b *testing.B) {
+	p := ErrorResponse(NewQuery("example.com", typeTarget), NOERROR)
+	for i := range 8 {
+		p.Answers = append(p.Answers, &DnsRecord{Type: typeTarget, Domain: "example.com", Class: ClassIN, TTL: 300, Priority: uint16(i), Host: "mail.example.com"})
+	}
+	b.ReportAllocs()
+	for range b.N {
+		if _, err := p.wireLen(true); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
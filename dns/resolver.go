@@ -0,0 +1,420 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+// defaultTimeout bounds a query when the context has no deadline.
+const defaultTimeout = 5 * time.Second
+
+// transferIdleTimeout is how long Transfer waits for each message.
+var transferIdleTimeout = defaultTimeout
+
+// retryBackoff is how long LookupRetry waits for the first attempt to be
+// answered. Every further attempt waits twice as long as the previous one.
+const retryBackoff = 100 * time.Millisecond
+
+// ErrNotResponse is returned for a reply that does not have the Response
+// bit set. It is either spoofed or a query crossing ours.
+var ErrNotResponse = errors.New("reply is not a response")
+
+// ErrRecursionRefused is returned when a server doesn't answer a recursive
+// query because it offers no recursion, see RecursionRefused.
+var ErrRecursionRefused = errors.New("server does not offer recursion")
+
+// ErrQuestionMismatch is returned for a reply that carries the ID of our
+// query, but asks a different question. It is either spoofed or the server
+// is broken, and its records must not be trusted.
+var ErrQuestionMismatch = errors.New("reply is for a different question")
+
+// MatchesQuery checks that resp is the response to req. It has to carry the
+// same ID, have the Response bit set, and repeat the question of req. Names
+// are compared in canonical form, so case and a trailing dot don't matter.
+func MatchesQuery(req, resp *DnsPacket) error {
+	if resp.Header.ID != req.Header.ID {
+		return fmt.Errorf("unexpected message id %d", resp.Header.ID)
+	}
+	if !resp.Header.Response {
+		return ErrNotResponse
+	}
+	want, ok := req.Question(0)
+	if !ok {
+		return nil
+	}
+	got, ok := resp.Question(0)
+	if !ok {
+		return fmt.Errorf("%w: reply has no question", ErrQuestionMismatch)
+	}
+	if !got.Equal(want) {
+		return fmt.Errorf("%w: asked for %s, got %s", ErrQuestionMismatch, want, got)
+	}
+	return nil
+}
+
+// RecursionRefused reports whether d is the response of a server that
+// ignored the request for recursion, as authoritative servers do for names
+// outside their zones. Such a response carries no answers but isn't an
+// authoritative statement that there are none, so the query has to be sent
+// elsewhere, or resolved iteratively.
+func (d *DnsPacket) RecursionRefused() bool {
+	h := d.Header
+	if !h.RecursionDesired || h.RecursionAvailable || h.AuthoritativeAnswer || len(d.Answers) > 0 {
+		return false
+	}
+	return h.Rescode == NOERROR || h.Rescode == REFUSED
+}
+
+func newQueryID() uint16 {
+	return uint16(rand.Uint32())
+}
+
+// NewQuery builds a recursive query for qname with a random ID.
+func NewQuery(qname string, qtype RecordType, opts ...QueryOption) *DnsPacket {
+	req := NewDnsPacket()
+	req.Header.ID = newQueryID()
+	req.Header.RecursionDesired = true
+	req.AddQuestion(NewDnsQuestion(qname, qtype))
+	for _, opt := range opts {
+		opt(req)
+	}
+	return req
+}
+
+// Lookup sends a recursive query for qname to server over UDP and returns
+// the response.
+func Lookup(ctx context.Context, server, qname string, qtype RecordType, opts ...QueryOption) (*DnsPacket, error) {
+	return exchangeUDP(ctx, server, NewQuery(qname, qtype, opts...))
+}
+
+// LookupTCP is like Lookup, but sends the query over TCP.
+func LookupTCP(ctx context.Context, server, qname string, qtype RecordType, opts ...QueryOption) (*DnsPacket, error) {
+	return exchangeTCP(ctx, "tcp", server, NewQuery(qname, qtype, opts...))
+}
+
+func exchangeTCP(ctx context.Context, network, server string, req *DnsPacket) (*DnsPacket, error) {
+	conn, _, stop, err := dial(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer stop()
+
+	if err := WriteTCP(conn, req); err != nil {
+		return nil, err
+	}
+
+	resp, err := ReadTCP(conn)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	if err := MatchesQuery(req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// LookupRetry is like Lookup, but re-sends the query if no answer arrived in
+// time, up to maxAttempts times. The wait starts at 100ms and doubles with
+// every attempt, capped by the context deadline. The backoff only spaces out
+// the retransmits: the last attempt waits until the deadline, so a slow
+// server still gets the whole timeout to answer. All attempts share the same
+// ID, so a late answer to an earlier attempt is accepted as well. The last
+// error is returned if every attempt fails.
+func LookupRetry(ctx context.Context, server, qname string, qtype RecordType, maxAttempts int) (*DnsPacket, error) {
+	return exchangeRetry(ctx, "udp", server, NewQuery(qname, qtype), maxAttempts)
+}
+
+func exchangeRetry(ctx context.Context, network, server string, req *DnsPacket, maxAttempts int) (*DnsPacket, error) {
+	if maxAttempts < 1 {
+		return nil, errors.New("at least one attempt is required")
+	}
+
+	conn, deadline, stop, err := dial(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer stop()
+
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		if err := writeUDP(conn, req); err != nil {
+			return nil, err
+		}
+
+		attemptDeadline := time.Now().Add(backoff)
+		if attempt == maxAttempts || attemptDeadline.After(deadline) {
+			attemptDeadline = deadline
+		}
+		conn.SetReadDeadline(attemptDeadline)
+
+		resp, err := readUDP(ctx, conn, req)
+		if err == nil {
+			return resp, nil
+		}
+
+		var netErr net.Error
+		if attempt == maxAttempts || !errors.As(err, &netErr) || !netErr.Timeout() ||
+			!time.Now().Before(deadline) {
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// exchangeUDP sends req to server and waits for the response carrying the
+// same ID, which has to match req as checked by MatchesQuery. Datagrams
+// with any other ID, or that don't parse, are ignored. Responses may be as
+// large as the payload size advertised by req.
+func exchangeUDP(ctx context.Context, server string, req *DnsPacket) (*DnsPacket, error) {
+	conn, _, stop, err := dial(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer stop()
+
+	if err := writeUDP(conn, req); err != nil {
+		return nil, err
+	}
+	return readUDP(ctx, conn, req)
+}
+
+// Exchange sends req to addr over conn and waits up to timeout for the
+// response carrying the same ID, which has to match req as checked by
+// MatchesQuery. Datagrams from other addresses, with any other ID, or that
+// don't parse are ignored.
+func Exchange(conn net.PacketConn, addr net.Addr, req *DnsPacket, timeout time.Duration) (*DnsPacket, error) {
+	reqBuffer := NewBytePacketBuffer()
+	if _, err := req.Write(reqBuffer); err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteTo(reqBuffer.Buf[:reqBuffer.Pos], addr); err != nil {
+		return nil, err
+	}
+
+	for {
+		respBuffer := NewBytePacketBufferSize(req.udpPayloadSize())
+		n, from, err := conn.ReadFrom(respBuffer.Buf)
+		if err != nil {
+			return nil, err
+		}
+		if from.String() != addr.String() {
+			continue
+		}
+		respBuffer.Buf = respBuffer.Buf[:n]
+
+		resp, err := FromBuffer2DnsPacket(respBuffer)
+		if err != nil {
+			continue
+		}
+
+		if resp.Header.ID == req.Header.ID {
+			if err := MatchesQuery(req, resp); err != nil {
+				return nil, err
+			}
+			return resp, nil
+		}
+	}
+}
+
+// dial connects to server and applies the context deadline, or the
+// default timeout if there is none, to the connection. Cancelling ctx
+// unblocks any pending read, and the returned stop function has to be called
+// once the connection is no longer used.
+func dial(ctx context.Context, network, server string) (net.Conn, time.Time, func() bool, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, time.Time{}, nil, err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultTimeout)
+	}
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	return conn, deadline, stop, nil
+}
+
+func writeUDP(conn net.Conn, req *DnsPacket) error {
+	reqBuffer := NewBytePacketBuffer()
+	if _, err := req.Write(reqBuffer); err != nil {
+		return err
+	}
+
+	_, err := conn.Write(reqBuffer.Buf[:reqBuffer.Pos])
+	return err
+}
+
+func readUDP(ctx context.Context, conn net.Conn, req *DnsPacket) (*DnsPacket, error) {
+	for {
+		respBuffer := NewBytePacketBufferSize(req.udpPayloadSize())
+		n, err := conn.Read(respBuffer.Buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		respBuffer.Buf = respBuffer.Buf[:n]
+
+		resp, err := FromBuffer2DnsPacket(respBuffer)
+		if err != nil {
+			continue
+		}
+
+		if resp.Header.ID == req.Header.ID {
+			if err := MatchesQuery(req, resp); err != nil {
+				return nil, err
+			}
+			return resp, nil
+		}
+	}
+}
+
+// LookupRace sends the same query to all servers at once and returns the
+// first response with a NOERROR rescode. The remaining queries are cancelled.
+// An error is only returned if every server fails.
+func LookupRace(ctx context.Context, servers []string, qname string, qtype RecordType) (*DnsPacket, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("no servers to query")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		packet *DnsPacket
+		err    error
+	}
+
+	// The channel is buffered so that the losing goroutines never block and
+	// can exit once their query is cancelled.
+	results := make(chan result, len(servers))
+	for _, server := range servers {
+		go func(server string) {
+			packet, err := Lookup(ctx, server, qname, qtype)
+			if err == nil && packet.Header.Rescode != NOERROR {
+				err = fmt.Errorf("%s answered with rescode %v", server, packet.Header.Rescode)
+			}
+			results <- result{packet, err}
+		}(server)
+	}
+
+	var errs []error
+	for range servers {
+		r := <-results
+		if r.err == nil {
+			return r.packet, nil
+		}
+		errs = append(errs, r.err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// VerifyCaseEcho checks that resp echoes the questions of req byte-for-byte,
+// including the case of every letter. It is meant to be used together with
+// WithCaseRandomization, and resp must have been read from a buffer with
+// PreserveCase set.
+func VerifyCaseEcho(req, resp *DnsPacket) error {
+	if len(req.Questions) != len(resp.Questions) {
+		return fmt.Errorf("response has %d questions, expected %d", len(resp.Questions), len(req.Questions))
+	}
+
+	for i, q := range req.Questions {
+		if resp.Questions[i].Name != q.Name {
+			return fmt.Errorf("response question %q does not match %q", resp.Questions[i].Name, q.Name)
+		}
+	}
+	return nil
+}
+
+// Transfer transfers the full contents of zone from server over TCP. The
+// transfer is made up of one or more messages, starting and ending with the
+// SOA record of the zone. All records are returned, including both SOAs.
+// This is an AXFR query, so server has to allow transfers to us; the function
+// can't be called AXFR as that name is the record type. Every message has to
+// arrive within 5 seconds of the previous one, or by the context deadline if
+// that is sooner, so a stalled server can't hang the transfer.
+func Transfer(ctx context.Context, server, zone string) ([]*DnsRecord, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	req := NewDnsPacket()
+	req.Header.ID = newQueryID()
+	req.AddQuestion(NewDnsQuestion(zone, AXFR))
+
+	if err := WriteTCP(conn, req); err != nil {
+		return nil, err
+	}
+
+	var records []*DnsRecord
+	for {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		idle := time.Now().Add(transferIdleTimeout)
+		if deadline, ok := ctx.Deadline(); ok && deadline.Before(idle) {
+			idle = deadline
+		}
+		conn.SetReadDeadline(idle)
+
+		resp, err := ReadTCP(conn)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+
+		if resp.Header.ID != req.Header.ID {
+			return nil, fmt.Errorf("unexpected message id %d", resp.Header.ID)
+		}
+		if !resp.Header.Response {
+			return nil, ErrNotResponse
+		}
+		if resp.Header.Rescode != NOERROR {
+			return nil, fmt.Errorf("zone transfer refused with rescode %v", resp.Header.Rescode)
+		}
+
+		for _, rec := range resp.Answers {
+			if len(records) == 0 && rec.Type != SOA {
+				return nil, errors.New("zone transfer does not start with a SOA record")
+			}
+
+			records = append(records, rec)
+			if len(records) > 1 && rec.Type == SOA {
+				return records, nil
+			}
+		}
+	}
+}
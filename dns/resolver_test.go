@@ -0,0 +1,548 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serveUDP answers the queries arriving on a local UDP port with handle,
+// which drops a query by returning nil. Queries are handled concurrently.
+// It returns the address to send to.
+func serveUDP(t *testing.T, handle func(req *DnsPacket) *DnsPacket) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveConn(t, conn, handle)
+}
+
+// serveConn is like serveUDP, but answers the queries arriving on conn.
+func serveConn(t *testing.T, conn net.PacketConn, handle func(req *DnsPacket) *DnsPacket) string {
+	t.Helper()
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, maxMessageSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req, err := Unpack(buf[:n])
+			if err != nil {
+				continue
+			}
+			go func() {
+				resp := handle(req)
+				if resp == nil {
+					return
+				}
+				msg, err := resp.Pack()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				conn.WriteTo(msg, addr)
+			}()
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// serveTCP accepts connections on a local TCP port and passes each one to
+// handle, closing it afterwards. It returns the address to connect to.
+func serveTCP(t *testing.T, handle func(conn net.Conn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestCaseRandomizationEcho(t *testing.T) {
+	const name = "www.example.com"
+	var q *DnsQuestion
+	for range 100 {
+		q = NewDnsQuestion(name, A, WithCaseRandomization())
+		if q.Name != name {
+			break
+		}
+	}
+	if q.Name == name || strings.ToLower(q.Name) != name {
+		t.Fatalf("randomized %q to %q", name, q.Name)
+	}
+
+	req := NewDnsPacket()
+	req.AddQuestion(q)
+	resp := req.Clone()
+	resp.Header.Response = true
+	msg, err := resp.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := NewBytePacketBufferSize(len(msg))
+	buffer.SetBuffer(msg)
+	buffer.PreserveCase = true
+	echoed, err := FromBuffer2DnsPacket(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if echoed.Questions[0].Name != q.Name {
+		t.Errorf("echoed name %q, want %q", echoed.Questions[0].Name, q.Name)
+	}
+	if err := VerifyCaseEcho(req, echoed); err != nil {
+		t.Error(err)
+	}
+
+	echoed.Questions[0].Name = strings.ToLower(q.Name)
+	if err := VerifyCaseEcho(req, echoed); err == nil {
+		t.Error("lowercased echo was accepted")
+	}
+}
+
+// transferMessages returns the messages of a transfer of example.com in
+// response to req, split over two messages.
+func transferMessages(req *DnsPacket) []*DnsPacket {
+	soa := NewSOADnsRecord("example.com", "ns1.example.com", "admin.example.com", 2024010101, 7200, 3600, 1209600, 300, 3600)
+	sections := [][]*DnsRecord{
+		{soa, NewNSDnsRecord("example.com", "ns1.example.com", 3600)},
+		{NewADnsRecord("ns1.example.com", net.IPv4(192, 0, 2, 1), 3600), NewADnsRecord("www.example.com", net.IPv4(192, 0, 2, 2), 300), soa},
+	}
+
+	var msgs []*DnsPacket
+	for _, answers := range sections {
+		msg := ErrorResponse(req, NOERROR)
+		msg.Header.AuthoritativeAnswer = true
+		msg.Answers = answers
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func TestTransfer(t *testing.T) {
+	server := serveTCP(t, func(conn net.Conn) {
+		req, err := ReadTCP(conn)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if q := req.Questions[0]; q.Type != AXFR || q.Name != "example.com" {
+			t.Errorf("got question %v", q)
+		}
+		for _, msg := range transferMessages(req) {
+			if err := WriteTCP(conn, msg); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	records, err := Transfer(ctx, server, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := []RecordType{SOA, NS, A, A, SOA}
+	if len(records) != len(types) {
+		t.Fatalf("got %d records, want %d", len(records), len(types))
+	}
+	for i, rec := range records {
+		if rec.Type != types[i] {
+			t.Errorf("record %d is %v, want type %s", i, rec, types[i])
+		}
+	}
+}
+
+func TestTransferIdleTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { transferIdleTimeout = timeout }(transferIdleTimeout)
+	transferIdleTimeout = 100 * time.Millisecond
+
+	// The server sends the first message, and then nothing but keeps the
+	// connection open.
+	done := make(chan struct{})
+	defer close(done)
+	server := serveTCP(t, func(conn net.Conn) {
+		req, err := ReadTCP(conn)
+		if err != nil {
+			return
+		}
+		WriteTCP(conn, transferMessages(req)[0])
+		<-done
+	})
+
+	start := time.Now()
+	_, err := Transfer(context.Background(), server, "example.com")
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Transfer from a stalled server returned %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Transfer gave up after %v", elapsed)
+	}
+}
+
+func TestLookupRace(t *testing.T) {
+	answerAfter := func(delay time.Duration, code ResultCode, last byte) string {
+		return serveUDP(t, func(req *DnsPacket) *DnsPacket {
+			time.Sleep(delay)
+			resp := answerA(req, net.IPv4(192, 0, 2, last))
+			resp.Header.Rescode = code
+			return resp
+		})
+	}
+
+	servers := []string{
+		answerAfter(300*time.Millisecond, NOERROR, 1),
+		answerAfter(20*time.Millisecond, NOERROR, 2),
+		answerAfter(0, SERVFAIL, 3),
+	}
+	resp, err := LookupRace(context.Background(), servers, "www.example.com", A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := resp.Answers[0].Addr; !addr.Equal(net.IPv4(192, 0, 2, 2)) {
+		t.Errorf("got the answer %v, want the one of the fastest server", addr)
+	}
+
+	servers = []string{
+		answerAfter(0, SERVFAIL, 1),
+		answerAfter(10*time.Millisecond, REFUSED, 2),
+		answerAfter(0, NXDOMAIN, 3),
+	}
+	if resp, err := LookupRace(context.Background(), servers, "www.example.com", A); err == nil {
+		t.Errorf("LookupRace with failing servers returned\n%v", resp)
+	}
+}
+
+func TestLookupRetry(t *testing.T) {
+	var mu sync.Mutex
+	var ids []uint16
+	server := serveUDP(t, func(req *DnsPacket) *DnsPacket {
+		mu.Lock()
+		defer mu.Unlock()
+		ids = append(ids, req.Header.ID)
+		if len(ids) < 3 {
+			return nil
+		}
+		return answerA(req, net.IPv4(192, 0, 2, 1))
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := LookupRetry(ctx, server, "www.example.com", A, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answers) != 1 {
+		t.Errorf("got response\n%v", resp)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ids) != 3 || ids[1] != ids[0] || ids[2] != ids[0] {
+		t.Errorf("server got queries with IDs %v, want 3 with the same ID", ids)
+	}
+
+	// The last attempt waits for the rest of the timeout, not just its
+	// backoff.
+	slow := serveUDP(t, func(req *DnsPacket) *DnsPacket {
+		time.Sleep(300 * time.Millisecond)
+		return answerA(req, net.IPv4(192, 0, 2, 1))
+	})
+	if _, err := LookupRetry(ctx, slow, "www.example.com", A, 1); err != nil {
+		t.Errorf("LookupRetry from a server answering after 300ms: %v", err)
+	}
+
+	short, cancelShort := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancelShort()
+	if _, err := LookupRetry(short, serveUDP(t, func(*DnsPacket) *DnsPacket { return nil }), "www.example.com", A, 2); err == nil {
+		t.Error("LookupRetry from a server that never answers succeeded")
+	}
+}
+
+// largeResponse answers req with as many TXT records as fit in size bytes.
+func largeResponse(req *DnsPacket, size int) *DnsPacket {
+	resp := ErrorResponse(req, NOERROR)
+	text := strings.Repeat("x", 100)
+	for {
+		resp.Answers = append(resp.Answers, NewTXTDnsRecord(req.Questions[0].Name, []string{text}, 300))
+		if n, _ := resp.WireLen(); n > size {
+			resp.Answers = resp.Answers[:len(resp.Answers)-1]
+			return resp
+		}
+	}
+}
+
+func TestLookupLargeUDP(t *testing.T) {
+	for _, tt := range []struct {
+		size int
+		opts []QueryOption
+	}{
+		{1100, nil},
+		{1232, nil},
+		{1100, []QueryOption{WithEDNS(1232)}},
+		{3000, []QueryOption{WithEDNS(4096)}},
+	} {
+		want := largeResponse(NewQuery("example.com", TXT), tt.size)
+		server := serveUDP(t, func(req *DnsPacket) *DnsPacket {
+			return largeResponse(req, tt.size)
+		})
+
+		resp := lookup(t, server, "example.com", TXT, tt.opts...)
+		if len(resp.Answers) != len(want.Answers) || resp.Header.TruncatedMessage {
+			t.Errorf("response of %d bytes has %d answers, want %d", tt.size, len(resp.Answers), len(want.Answers))
+		}
+		if msg, err := resp.Pack(); err != nil || len(msg) <= 512 {
+			t.Errorf("response packs to %d bytes: %v", len(msg), err)
+		}
+	}
+}
+
+func TestResolverMaxPayload(t *testing.T) {
+	var payload uint16
+	r := &Resolver{
+		MaxPayload: 4096,
+		RootHints:  []net.IP{net.IPv4(198, 51, 100, 1)},
+		Exchange: func(ctx context.Context, server string, req *DnsPacket) (*DnsPacket, error) {
+			if opt := req.OPT(); opt != nil {
+				payload = opt.PayloadSize
+			}
+			return ErrorResponse(req, NXDOMAIN), nil
+		},
+	}
+	if _, err := r.RecursiveLookup(context.Background(), "example.com", A); err != nil {
+		t.Fatal(err)
+	}
+	if payload != 4096 {
+		t.Errorf("resolver advertised a payload of %d, want 4096", payload)
+	}
+}
+
+// listenUDP returns a local UDP socket, closed when the test ends.
+func listenUDP(t *testing.T) net.PacketConn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestExchange(t *testing.T) {
+	server := listenUDP(t)
+	stranger := listenUDP(t)
+	conn := listenUDP(t)
+
+	go func() {
+		buf := make([]byte, maxMessageSize)
+		n, addr, err := server.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req, err := Unpack(buf[:n])
+		if err != nil {
+			return
+		}
+
+		// Neither a datagram from another address, nor one with another
+		// ID, nor one that doesn't parse is taken for the response.
+		spoofed, _ := answerA(req, net.IPv4(203, 0, 113, 1)).Pack()
+		stranger.WriteTo(spoofed, addr)
+		server.WriteTo([]byte{0xde, 0xad}, addr)
+		wrongID := answerA(req, net.IPv4(203, 0, 113, 2))
+		wrongID.Header.ID++
+		msg, _ := wrongID.Pack()
+		server.WriteTo(msg, addr)
+
+		msg, _ = answerA(req, net.IPv4(192, 0, 2, 1)).Pack()
+		server.WriteTo(msg, addr)
+	}()
+
+	req := NewQuery("example.com", A)
+	resp, err := Exchange(conn, server.LocalAddr(), req, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.ID != req.Header.ID || len(resp.Answers) != 1 || !resp.Answers[0].Addr.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("Exchange returned\n%v", resp)
+	}
+
+	// Nothing answers this time.
+	_, err = Exchange(conn, server.LocalAddr(), req, 50*time.Millisecond)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("unanswered Exchange returned %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+}
+
+func TestLookupSkipsMalformed(t *testing.T) {
+	server := listenUDP(t)
+	go func() {
+		buf := make([]byte, maxMessageSize)
+		n, addr, err := server.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req, err := Unpack(buf[:n])
+		if err != nil {
+			return
+		}
+
+		server.WriteTo([]byte{0xde, 0xad}, addr)
+		msg, _ := answerA(req, net.IPv4(192, 0, 2, 1)).Pack()
+		server.WriteTo(msg, addr)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := Lookup(ctx, server.LocalAddr().String(), "example.com", A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answers) != 1 || !resp.Answers[0].Addr.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("Lookup returned\n%v", resp)
+	}
+}
+
+func TestRejectNonResponse(t *testing.T) {
+	echo := serveUDP(t, func(req *DnsPacket) *DnsPacket { return req })
+	otherQuestion := serveUDP(t, func(req *DnsPacket) *DnsPacket {
+		resp := answerA(req, net.IPv4(192, 0, 2, 1))
+		resp.Questions[0].Name = "example.org"
+		return resp
+	})
+
+	ctx := context.Background()
+	if _, err := Lookup(ctx, echo, "example.com", A); !errors.Is(err, ErrNotResponse) {
+		t.Errorf("Lookup of an echoed query returned %v, want %v", err, ErrNotResponse)
+	}
+	if _, err := Lookup(ctx, otherQuestion, "example.com", A); !errors.Is(err, ErrQuestionMismatch) {
+		t.Errorf("Lookup answered for another question returned %v, want %v", err, ErrQuestionMismatch)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Exchange(listenUDP(t), addr, NewQuery("example.com", A), 5*time.Second)
+	if !errors.Is(err, ErrNotResponse) {
+		t.Errorf("Exchange of an echoed query returned %v, want %v", err, ErrNotResponse)
+	}
+}
+
+func TestRecursionRefused(t *testing.T) {
+	req := NewQuery("example.org", A)
+	response := func(rcode ResultCode, setup func(h *DnsHeader)) *DnsPacket {
+		resp := ErrorResponse(req, rcode)
+		resp.Header.RecursionAvailable = false
+		if setup != nil {
+			setup(resp.Header)
+		}
+		return resp
+	}
+
+	for _, tt := range []struct {
+		name    string
+		resp    *DnsPacket
+		refused bool
+	}{
+		{"no recursion", response(NOERROR, nil), true},
+		{"refused", response(REFUSED, nil), true},
+		{"authoritative NXDOMAIN", response(NXDOMAIN, func(h *DnsHeader) { h.AuthoritativeAnswer = true }), false},
+		{"recursive NXDOMAIN", response(NXDOMAIN, func(h *DnsHeader) { h.RecursionAvailable = true }), false},
+		{"authoritative NODATA", response(NOERROR, func(h *DnsHeader) { h.AuthoritativeAnswer = true }), false},
+		{"recursive NODATA", response(NOERROR, func(h *DnsHeader) { h.RecursionAvailable = true }), false},
+		{"not asked to recurse", response(NOERROR, func(h *DnsHeader) { h.RecursionDesired = false }), false},
+		{"answered", answerA(req, net.IPv4(192, 0, 2, 1)), false},
+	} {
+		if got := tt.resp.RecursionRefused(); got != tt.refused {
+			t.Errorf("%s: RecursionRefused() = %v, want %v", tt.name, got, tt.refused)
+		}
+	}
+
+	// An authoritative server answers for its zone only, without
+	// recursion.
+	z := exampleZone()
+	server := serveUDP(t, func(req *DnsPacket) *DnsPacket {
+		if !InZone(req.Questions[0].Name, z.Origin) {
+			return ErrorResponse(req, NOERROR)
+		}
+		return z.answer(req)
+	})
+	ctx := context.Background()
+	if _, err := LookupFollowCNAME(ctx, server, "example.org", A); !errors.Is(err, ErrRecursionRefused) {
+		t.Errorf("lookup outside the zone returned %v, want %v", err, ErrRecursionRefused)
+	}
+	if _, err := LookupFollowCNAME(ctx, server, "missing.example.com", A); err == nil || errors.Is(err, ErrRecursionRefused) {
+		t.Errorf("lookup of a missing name returned %v, want NXDOMAIN", err)
+	}
+}
+
+func TestMatchesQuery(t *testing.T) {
+	req := NewQuery("www.example.com", A)
+	for _, tt := range []struct {
+		name   string
+		change func(resp *DnsPacket)
+		err    error
+	}{
+		{name: "same"},
+		{name: "case and trailing dot", change: func(resp *DnsPacket) { resp.Questions[0].Name = "WWW.Example.COM." }},
+		{name: "wrong type", change: func(resp *DnsPacket) { resp.Questions[0].Type = AAAA }, err: ErrQuestionMismatch},
+		{name: "wrong name", change: func(resp *DnsPacket) { resp.Questions[0].Name = "www.example.com.evil" }, err: ErrQuestionMismatch},
+		{name: "wrong class", change: func(resp *DnsPacket) { resp.Questions[0].Class = ClassCH }, err: ErrQuestionMismatch},
+		{name: "no question", change: func(resp *DnsPacket) { resp.Questions = nil }, err: ErrQuestionMismatch},
+		{name: "not a response", change: func(resp *DnsPacket) { resp.Header.Response = false }, err: ErrNotResponse},
+	} {
+		resp := answerA(req, net.IPv4(192, 0, 2, 1))
+		if tt.change != nil {
+			tt.change(resp)
+		}
+		if err := MatchesQuery(req, resp); !errors.Is(err, tt.err) {
+			t.Errorf("%s: MatchesQuery returned %v, want %v", tt.name, err, tt.err)
+		}
+	}
+
+	resp := answerA(req, net.IPv4(192, 0, 2, 1))
+	resp.Header.ID++
+	if err := MatchesQuery(req, resp); err == nil {
+		t.Error("MatchesQuery accepted a reply with another ID")
+	}
+
+	// Exchange checks the question as well.
+	wrongType := serveUDP(t, func(req *DnsPacket) *DnsPacket {
+		resp := answerA(req, net.IPv4(192, 0, 2, 1))
+		resp.Questions[0].Type = AAAA
+		return resp
+	})
+	addr, err := net.ResolveUDPAddr("udp", wrongType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Exchange(listenUDP(t), addr, NewQuery("example.com", A), 5*time.Second)
+	if !errors.Is(err, ErrQuestionMismatch) {
+		t.Errorf("Exchange answered for another type returned %v, want %v", err, ErrQuestionMismatch)
+	}
+}
@@ -0,0 +1,397 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Server answers queries received over UDP and TCP by forwarding them to
+// an upstream resolver, or authoritatively for names in one of its zones.
+type Server struct {
+	// Addr is the address to listen on for both UDP and TCP, like ":53".
+	Addr string
+	// Upstream is the address of the resolver queries are forwarded to.
+	Upstream string
+
+	// Blocklist holds domains that are answered locally instead of being
+	// forwarded. An entry like "example.com" blocks the domain and all its
+	// subdomains, while "*.example.com" only blocks the subdomains. Entries
+	// are matched case-insensitively, with or without a trailing dot. It
+	// must not be changed once the server is serving.
+	Blocklist map[string]bool
+	// BlockWithNXDOMAIN answers blocked queries with NXDOMAIN. Otherwise A
+	// and AAAA queries are answered with 0.0.0.0 and :: respectively, and
+	// other types with an empty answer.
+	BlockWithNXDOMAIN bool
+
+	// Zones are answered from directly instead of forwarding.
+	Zones []*Zone
+
+	// RateLimit limits the queries answered per client IP. Nil disables
+	// rate limiting.
+	RateLimit *RateLimit
+
+	// TrustUpstreamAD passes on the AD bit of forwarded responses. The
+	// server doesn't validate DNSSEC itself, so it clears AD by default;
+	// only set this if the upstream validates and is reached over a
+	// trusted path.
+	TrustUpstreamAD bool
+
+	// Cache, if set, holds the responses of upstream. Queries are answered
+	// from it while the records are fresh, and with expired records if
+	// upstream fails, as far as the cache allows. Nil disables caching.
+	Cache *Cache
+
+	limiter rateLimiter
+
+	blockOnce sync.Once
+	// blocked holds the canonical names of the Blocklist entries.
+	blocked map[string]bool
+}
+
+// blockedTTL is the TTL of the records answering a blocked query.
+const blockedTTL = 60
+
+// tcpIdleTimeout is how long a TCP connection is kept open waiting for the
+// next query.
+const tcpIdleTimeout = 10 * time.Second
+
+// ListenAndServe listens on s.Addr for UDP and TCP and serves queries until
+// an error occurs on either. Clients retry over TCP when a response over
+// UDP is truncated, and get the full response there. If the port of s.Addr
+// is 0, TCP listens on the port picked for UDP.
+func (s *Server) ListenAndServe() error {
+	conn, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	l, err := net.Listen("tcp", conn.LocalAddr().String())
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	errc := make(chan error, 2)
+	go func() { errc <- s.Serve(conn) }()
+	go func() { errc <- s.ServeTCP(l) }()
+	return <-errc
+}
+
+// Serve answers every query arriving on conn until conn is closed. Packets
+// that are responses themselves are dropped.
+func (s *Server) Serve(conn net.PacketConn) error {
+	for {
+		buffer := GetBuffer()
+		n, addr, err := conn.ReadFrom(buffer.Buf[:])
+		if err != nil {
+			PutBuffer(buffer)
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		// Without an ID there is nothing to answer.
+		if n < 2 || isResponse(buffer.Buf[:n]) {
+			PutBuffer(buffer)
+			continue
+		}
+
+		go s.handleQuery(conn, addr, buffer, n)
+	}
+}
+
+// ServeTCP answers the queries arriving on every connection accepted from l
+// until l is closed. A connection may carry any number of queries, which are
+// answered in order, and is closed once it has been idle for 10 seconds.
+// Responses are never truncated, and queries over TCP are not rate limited,
+// as their source address can't be spoofed.
+func (s *Server) ServeTCP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		go s.handleTCP(conn)
+	}
+}
+
+func (s *Server) handleTCP(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+
+		var prefix [2]byte
+		if _, err := io.ReadFull(conn, prefix[:]); err != nil {
+			return
+		}
+		buffer, err := NewBytePacketBufferFromReader(conn, int(binary.BigEndian.Uint16(prefix[:])))
+		if err != nil || len(buffer.Buf) < 2 {
+			return
+		}
+		if isResponse(buffer.Buf) {
+			continue
+		}
+
+		resp, _ := s.resolve(buffer, false)
+		if err := WriteTCP(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+// handleQuery answers the query of n bytes at the start of buffer.
+func (s *Server) handleQuery(conn net.PacketConn, addr net.Addr, buffer *BytePacketBuffer, n int) {
+	defer PutBuffer(buffer)
+
+	limited := s.RateLimit != nil && !s.limiter.allow(clientIP(addr), *s.RateLimit, time.Now())
+	if limited && s.RateLimit.Drop {
+		return
+	}
+
+	// The rest of the buffer holds zeros or an earlier query, not part of
+	// this one.
+	query := *buffer
+	query.Buf = buffer.Buf[:n]
+	resp, maxSize := s.resolve(&query, limited)
+
+	out := GetBuffer()
+	if maxSize > len(out.Buf) {
+		PutBuffer(out)
+		out = NewBytePacketBufferSize(maxSize)
+	}
+	defer PutBuffer(out)
+
+	if _, err := resp.WriteTruncated(out, maxSize); err != nil {
+		return
+	}
+	conn.WriteTo(out.Buf[:out.Pos], addr)
+}
+
+// isResponse reports whether msg has the QR bit set. Responses are dropped
+// unanswered and never forwarded, or a spoofed one could make two servers
+// answer each other forever.
+func isResponse(msg []byte) bool {
+	return len(msg) > 2 && msg[2]&0x80 != 0
+}
+
+func clientIP(addr net.Addr) string {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.IP.String()
+	}
+	return addr.String()
+}
+
+// resolve builds the response for the query in buffer, along with the
+// largest response size the client accepts. A rate limited query only gets
+// an empty truncated response.
+func (s *Server) resolve(buffer *BytePacketBuffer, limited bool) (*DnsPacket, int) {
+	req, err := FromBuffer2DnsPacket(buffer)
+	if err != nil {
+		// The query can't be parsed, but the ID is still echoed so the
+		// client can match up the error.
+		req = NewDnsPacket()
+		req.Header.ID = binary.BigEndian.Uint16(buffer.Buf[:2])
+		return ErrorResponse(req, FORMERR), req.maxResponseSize()
+	}
+	return s.answer(req, limited), req.maxResponseSize()
+}
+
+// answer builds the response for the parsed query req.
+func (s *Server) answer(req *DnsPacket, limited bool) *DnsPacket {
+	if limited {
+		resp := ErrorResponse(req, NOERROR)
+		resp.Header.TruncatedMessage = true
+		return resp
+	}
+
+	// A query without a question, as sent by some health checks, has
+	// nothing to answer or forward.
+	if len(req.Questions) == 0 {
+		return ErrorResponse(req, FORMERR)
+	}
+	q := req.Questions[0]
+
+	if s.isBlocked(q.Name) {
+		return s.blockedResponse(req)
+	}
+
+	if zone := s.findZone(q.Name); zone != nil {
+		return zone.answer(req)
+	}
+
+	if s.Cache != nil {
+		if cached, ok := s.Cache.Get(req); ok {
+			return s.forwardedResponse(req, cached)
+		}
+	}
+
+	upstream, err := s.forward(req)
+	if err != nil {
+		// An expired answer is better than none while upstream is down.
+		if s.Cache != nil {
+			if cached, _, ok := s.Cache.GetAllowStale(req); ok {
+				return s.forwardedResponse(req, cached)
+			}
+		}
+		return ErrorResponse(req, SERVFAIL)
+	}
+
+	if s.Cache != nil && !upstream.Header.TruncatedMessage {
+		s.Cache.Put(req, upstream)
+	}
+	return s.forwardedResponse(req, upstream)
+}
+
+// forwardedResponse builds the response to req from the response upstream
+// sent to the forwarded query. The OPT record of upstream was meant for us,
+// not the client, so it is dropped. A client that sent an OPT record gets
+// our own instead, with its DO bit and the upper bits of the rcode upstream
+// returned.
+func (s *Server) forwardedResponse(req, upstream *DnsPacket) *DnsPacket {
+	resp := ErrorResponse(req, upstream.Header.Rescode)
+	resp.Header.SetResponseFlags()
+	resp.Header.AuthedData = s.TrustUpstreamAD && upstream.Header.AuthedData
+	resp.Answers = upstream.Answers
+	resp.Authorities = upstream.Authorities
+	for _, rec := range upstream.Resources {
+		if rec.Type != OPT {
+			resp.Resources = append(resp.Resources, rec)
+		}
+	}
+
+	if opt := req.OPT(); opt != nil {
+		flags := opt.TTL & doBit
+		if upstreamOPT := upstream.OPT(); upstreamOPT != nil {
+			flags |= upstreamOPT.TTL & 0xFF000000
+		}
+		resp.Resources = append(resp.Resources, NewOPTDnsRecord(defaultEDNSPayload, flags))
+	}
+	return resp
+}
+
+// findZone returns the most specific zone containing name, or nil if name
+// is in none of them.
+func (s *Server) findZone(name string) *Zone {
+	var found *Zone
+	for _, zone := range s.Zones {
+		if InZone(name, zone.Origin) && (found == nil || len(zone.Origin) > len(found.Origin)) {
+			found = zone
+		}
+	}
+	return found
+}
+
+// isBlocked reports whether name or any of its parent domains is on the
+// blocklist.
+func (s *Server) isBlocked(name string) bool {
+	blocked := s.blockedNames()
+	if len(blocked) == 0 {
+		return false
+	}
+
+	name, ok := canonicalName(name)
+	if !ok {
+		return false
+	}
+	if blocked[name] {
+		return true
+	}
+
+	for name = parentName(name); name != ""; name = parentName(name) {
+		if blocked[name] || blocked["*."+name] {
+			return true
+		}
+	}
+	return false
+}
+
+// blockedNames returns the set of Blocklist entries in canonical form, so
+// they compare equal to canonical query names. It is built on first use.
+func (s *Server) blockedNames() map[string]bool {
+	s.blockOnce.Do(func() {
+		s.blocked = make(map[string]bool, len(s.Blocklist))
+		for name, block := range s.Blocklist {
+			if key, ok := canonicalName(name); block && ok {
+				s.blocked[key] = true
+			}
+		}
+	})
+	return s.blocked
+}
+
+func (s *Server) blockedResponse(req *DnsPacket) *DnsPacket {
+	resp := ErrorResponse(req, NOERROR)
+	resp.Header.SetResponseFlags()
+	if s.BlockWithNXDOMAIN {
+		resp.Header.Rescode = NXDOMAIN
+		return resp
+	}
+
+	q := req.Questions[0]
+	switch q.Type {
+	case A:
+		resp.Answers = append(resp.Answers, NewADnsRecord(q.Name, net.IPv4zero, blockedTTL))
+	case AAAA:
+		resp.Answers = append(resp.Answers, NewAAAADnsRecord(q.Name, net.IPv6zero, blockedTTL))
+	}
+	return resp
+}
+
+// forward sends the questions of req to the upstream resolver. The CD bit
+// of req is passed on, so a client doing its own validation gets the data
+// even if the upstream fails to validate it. So are the payload size and
+// DO bit of its OPT record, and a query without one is forwarded without
+// one. A truncated response is fetched again over TCP, so clients on TCP
+// get the full response.
+func (s *Server) forward(req *DnsPacket) (*DnsPacket, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	up := NewDnsPacket()
+	up.Header.ID = newQueryID()
+	up.Header.RecursionDesired = true
+	up.Header.CheckingDisabled = req.Header.CheckingDisabled
+	for _, q := range req.Questions {
+		up.AddQuestion(q)
+	}
+	if opt := req.OPT(); opt != nil {
+		WithEDNS(opt.PayloadSize)(up)
+		up.OPT().TTL |= opt.TTL & doBit
+	}
+
+	resp, err := exchangeUDP(ctx, s.Upstream, up)
+	if err != nil || !resp.Header.TruncatedMessage {
+		return resp, err
+	}
+	return exchangeTCP(ctx, "tcp", s.Upstream, up)
+}
+
+// ErrorResponse builds a response to req with the given rescode. It echoes
+// the ID, the RD and CD bits and the questions of req and carries no
+// records.
+func ErrorResponse(req *DnsPacket, code ResultCode) *DnsPacket {
+	resp := NewDnsPacket()
+	resp.Header.ID = req.Header.ID
+	resp.Header.Opcode = req.Header.Opcode
+	resp.Header.RecursionDesired = req.Header.RecursionDesired
+	resp.Header.CheckingDisabled = req.Header.CheckingDisabled
+	resp.Header.Response = true
+	resp.Header.Rescode = code
+
+	for _, q := range req.Questions {
+		resp.AddQuestion(q.Clone())
+	}
+	return resp
+}
@@ -0,0 +1,405 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startServer serves s on a local UDP port and returns its address.
+func startServer(t *testing.T, s *Server) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go s.Serve(conn)
+	return conn.LocalAddr().String()
+}
+
+// closedPort returns a local UDP address nothing listens on.
+func closedPort(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	return addr
+}
+
+// exchangeRaw sends msg to the UDP server at addr and returns the reply.
+func exchangeRaw(t *testing.T, addr string, msg []byte) *DnsPacket {
+	t.Helper()
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, maxMessageSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := Unpack(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// lookup queries the server at addr over UDP.
+func lookup(t *testing.T, addr, name string, qtype RecordType, opts ...QueryOption) *DnsPacket {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := Lookup(ctx, addr, name, qtype, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestErrorResponse(t *testing.T) {
+	req := NewQuery("www.example.com", A)
+	req.Header.CheckingDisabled = true
+	resp := ErrorResponse(req, SERVFAIL)
+
+	h := resp.Header
+	if h.ID != req.Header.ID || !h.Response || h.Rescode != SERVFAIL || !h.RecursionDesired || !h.CheckingDisabled {
+		t.Errorf("got header %+v", h)
+	}
+	if len(resp.Questions) != 1 || !resp.Questions[0].Equal(req.Questions[0]) {
+		t.Errorf("got questions %v", resp.Questions)
+	}
+	if len(resp.Answers)+len(resp.Authorities)+len(resp.Resources) != 0 {
+		t.Errorf("error response carries records:\n%v", resp)
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	addr := startServer(t, &Server{Upstream: closedPort(t)})
+
+	// A query that can't be parsed gets FORMERR with its ID echoed.
+	resp := exchangeRaw(t, addr, []byte{0xAB, 0xCD, 0x01, 0x00, 0x00, 0x05})
+	if resp.Header.ID != 0xABCD || resp.Header.Rescode != FORMERR {
+		t.Errorf("garbage query got\n%v", resp)
+	}
+
+	// An upstream that can't be reached makes it SERVFAIL.
+	resp = lookup(t, addr, "www.example.com", A)
+	if resp.Header.Rescode != SERVFAIL || len(resp.Answers) != 0 {
+		t.Errorf("query with upstream down got\n%v", resp)
+	}
+}
+
+// upstreamServer answers every A query with 192.0.2.1.
+func upstreamServer(t *testing.T) string {
+	return serveUDP(t, func(req *DnsPacket) *DnsPacket {
+		resp := answerA(req, net.IPv4(192, 0, 2, 1))
+		resp.Header.RecursionAvailable = true
+		return resp
+	})
+}
+
+func TestServerBlocklist(t *testing.T) {
+	s := &Server{
+		Upstream: upstreamServer(t),
+		Blocklist: map[string]bool{
+			"Ads.Example.com.":    true,
+			"*.track.example.com": true,
+		},
+	}
+	addr := startServer(t, s)
+
+	for _, tt := range []struct {
+		name    string
+		qtype   RecordType
+		blocked bool
+		want    net.IP
+	}{
+		{"ads.example.com", A, true, net.IPv4zero},
+		{"x.Ads.Example.COM", A, true, net.IPv4zero},
+		{"ads.example.com", AAAA, true, net.IPv6zero},
+		{"a.b.track.example.com", A, true, net.IPv4zero},
+		{"track.example.com", A, false, net.IPv4(192, 0, 2, 1)},
+		{"www.example.com", A, false, net.IPv4(192, 0, 2, 1)},
+		{"notads.example.com", A, false, net.IPv4(192, 0, 2, 1)},
+	} {
+		resp := lookup(t, addr, tt.name, tt.qtype)
+		if resp.Header.Rescode != NOERROR || len(resp.Answers) != 1 || !resp.Answers[0].Addr.Equal(tt.want) {
+			t.Errorf("%s %s got\n%v", tt.name, tt.qtype, resp)
+		}
+	}
+
+	addr = startServer(t, &Server{
+		Upstream:          s.Upstream,
+		Blocklist:         s.Blocklist,
+		BlockWithNXDOMAIN: true,
+	})
+	if resp := lookup(t, addr, "ads.example.com", A); resp.Header.Rescode != NXDOMAIN || !resp.Header.RecursionAvailable || len(resp.Answers) != 0 {
+		t.Errorf("blocked query with BlockWithNXDOMAIN got\n%v", resp)
+	}
+	if resp := lookup(t, addr, "mx.ads.example.com", MX); resp.Header.Rescode != NXDOMAIN {
+		t.Errorf("blocked MX query with BlockWithNXDOMAIN got\n%v", resp)
+	}
+}
+
+func TestServerADAndCD(t *testing.T) {
+	var mu sync.Mutex
+	var upstreamCD []bool
+	upstream := serveUDP(t, func(req *DnsPacket) *DnsPacket {
+		mu.Lock()
+		upstreamCD = append(upstreamCD, req.Header.CheckingDisabled)
+		mu.Unlock()
+		resp := answerA(req, net.IPv4(192, 0, 2, 1))
+		resp.Header.RecursionAvailable = true
+		resp.Header.AuthedData = true
+		return resp
+	})
+	checkingDisabled := func(p *DnsPacket) { p.Header.CheckingDisabled = true }
+
+	addr := startServer(t, &Server{Upstream: upstream})
+	if resp := lookup(t, addr, "example.com", A); resp.Header.AuthedData {
+		t.Error("forwarded response kept the AD bit of upstream")
+	}
+	if resp := lookup(t, addr, "example.com", A, checkingDisabled); resp.Header.AuthedData || !resp.Header.CheckingDisabled {
+		t.Errorf("forwarded response with CD has flags %q", resp.Header.FlagsString())
+	}
+
+	trusting := startServer(t, &Server{Upstream: upstream, TrustUpstreamAD: true})
+	if resp := lookup(t, trusting, "example.com", A); !resp.Header.AuthedData {
+		t.Error("server trusting upstream cleared the AD bit")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []bool{false, true, false}; !slices.Equal(upstreamCD, want) {
+		t.Errorf("upstream got queries with CD %v, want %v", upstreamCD, want)
+	}
+}
+
+func TestServerForwardsEDNS(t *testing.T) {
+	var mu sync.Mutex
+	var upstreamOPT []*DnsRecord
+	upstream := serveUDP(t, func(req *DnsPacket) *DnsPacket {
+		mu.Lock()
+		upstreamOPT = append(upstreamOPT, req.OPT())
+		mu.Unlock()
+		// The upstream answers with an OPT record of its own even if
+		// it got none, which must not reach the client.
+		resp := answerA(req, net.IPv4(192, 0, 2, 1))
+		resp.Resources = append(resp.Resources, NewOPTDnsRecord(4096, 0))
+		return resp
+	})
+
+	addr := startServer(t, &Server{Upstream: upstream})
+	if resp := lookup(t, addr, "example.com", A); resp.OPT() != nil {
+		t.Errorf("response to a query without EDNS has the OPT record %v", resp.OPT())
+	}
+	resp := lookup(t, addr, "example.com", A, WithEDNS(4096), WithDNSSEC())
+	if opt := resp.OPT(); opt == nil || opt.PayloadSize != defaultEDNSPayload || opt.TTL&doBit == 0 {
+		t.Errorf("response to a query with EDNS has the OPT record %v", opt)
+	}
+	if n := len(resp.Resources); n != 1 {
+		t.Errorf("response to a query with EDNS has %d additional records, want 1", n)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(upstreamOPT) != 2 {
+		t.Fatalf("upstream got the OPT records %v", upstreamOPT)
+	}
+	if opt := upstreamOPT[0]; opt != nil {
+		t.Errorf("query without EDNS was forwarded with %v", opt)
+	}
+	if opt := upstreamOPT[1]; opt == nil || opt.PayloadSize != 4096 || opt.TTL&doBit == 0 {
+		t.Errorf("query with EDNS was forwarded with %v", opt)
+	}
+}
+
+func TestServerCache(t *testing.T) {
+	var upstream countingServer
+	cache := &Cache{MaxEntries: 2}
+	addr := startServer(t, &Server{Upstream: serveUDP(t, upstream.handle), Cache: cache})
+	// ageEntry makes the cached response for name d older. The lock keeps
+	// the race detector from flagging it against the serving goroutine.
+	ageEntry := func(name string, d time.Duration) {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		age(t, cache, name, d)
+	}
+
+	lookup(t, addr, "www.example.com", A)
+	lookup(t, addr, "www.example.com", A)
+	if n := len(upstream.queries()); n != 1 {
+		t.Errorf("two identical queries reached upstream %d times, want once", n)
+	}
+
+	ageEntry("www.example.com", 100*time.Second)
+	if resp := lookup(t, addr, "www.example.com", A); len(resp.Answers) != 1 || resp.Answers[0].TTL != 200 {
+		t.Errorf("cached response is\n%v\nwant a TTL of 200", resp)
+	}
+	ageEntry("www.example.com", 300*time.Second)
+	lookup(t, addr, "www.example.com", A)
+	if n := len(upstream.queries()); n != 2 {
+		t.Errorf("query after the TTL expired left %d upstream queries, want 2", n)
+	}
+
+	// With room for two entries, a third name evicts the least recently
+	// used one.
+	lookup(t, addr, "a.example.com", A)
+	lookup(t, addr, "www.example.com", A)
+	lookup(t, addr, "b.example.com", A)
+	lookup(t, addr, "www.example.com", A)
+	lookup(t, addr, "a.example.com", A)
+	var names []string
+	for _, req := range upstream.queries() {
+		names = append(names, req.Questions[0].Name)
+	}
+	want := []string{"www.example.com", "www.example.com", "a.example.com", "b.example.com", "a.example.com"}
+	if !slices.Equal(names, want) {
+		t.Errorf("upstream got queries for %v, want %v", names, want)
+	}
+}
+
+func TestServerNoQuestion(t *testing.T) {
+	header := []byte{0x12, 0x34, 0x01, 0x00, 0, 0, 0, 0, 0, 0, 0, 0}
+	p, err := Unpack(header)
+	if err != nil {
+		t.Fatalf("parsing a query without questions returned %v", err)
+	}
+	if p.Header.ID != 0x1234 || len(p.Questions) != 0 {
+		t.Errorf("query without questions read as\n%v", p)
+	}
+
+	var upstream countingServer
+	addr := startServer(t, &Server{Upstream: serveUDP(t, upstream.handle)})
+	resp := exchangeRaw(t, addr, header)
+	if resp.Header.ID != 0x1234 || resp.Header.Rescode != FORMERR || len(resp.Questions) != 0 {
+		t.Errorf("query without questions got\n%v", resp)
+	}
+	if n := len(upstream.queries()); n != 0 {
+		t.Errorf("query without questions was forwarded %d times", n)
+	}
+}
+
+func TestServerDropsResponses(t *testing.T) {
+	var upstream countingServer
+	addr := startServerBoth(t, &Server{Upstream: serveUDP(t, upstream.handle)})
+
+	reflected := ErrorResponse(NewQuery("www.example.com", A), NOERROR)
+	reflected.Header.ID = 0x1234
+	msg, err := reflected.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := NewQuery("www.example.com", A)
+	query.Header.ID = 0x5678
+
+	// The first reply over either transport is the one to the query sent
+	// after the response.
+	udp, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	udp.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := udp.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	queryMsg, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := udp.Write(queryMsg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, maxMessageSize)
+	n, err := udp.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := Unpack(buf[:n]); err != nil || resp.Header.ID != 0x5678 {
+		t.Errorf("first reply over UDP is\n%v, %v", resp, err)
+	}
+
+	tcp, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	tcp.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := WriteTCP(tcp, reflected); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteTCP(tcp, query); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := ReadTCP(tcp); err != nil || resp.Header.ID != 0x5678 {
+		t.Errorf("first reply over TCP is\n%v, %v", resp, err)
+	}
+
+	if n := len(upstream.queries()); n != 2 {
+		t.Errorf("upstream got %d queries, want only the 2 real ones", n)
+	}
+}
+
+// startServerBoth serves s on a local port over both UDP and TCP, as
+// ListenAndServe does, and returns its address.
+func startServerBoth(t *testing.T, s *Server) string {
+	t.Helper()
+	addr := startServer(t, s)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.ServeTCP(l)
+	return addr
+}
+
+func TestServerTruncatedRetryTCP(t *testing.T) {
+	z := NewZone("example.com")
+	for i := range 40 {
+		z.Add(NewADnsRecord("big.example.com", net.IPv4(192, 0, 2, byte(i)), 300))
+	}
+	addr := startServerBoth(t, &Server{Zones: []*Zone{z}})
+
+	udp := lookup(t, addr, "big.example.com", A)
+	if !udp.Header.TruncatedMessage || len(udp.Answers) >= 40 {
+		t.Errorf("UDP response has TC %v and %d answers, want it truncated", udp.Header.TruncatedMessage, len(udp.Answers))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tcp, err := LookupTCP(ctx, addr, "big.example.com", A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tcp.Header.TruncatedMessage || len(tcp.Answers) != 40 {
+		t.Errorf("TCP response has TC %v and %d answers, want all 40", tcp.Header.TruncatedMessage, len(tcp.Answers))
+	}
+
+	// A forwarded response that upstream truncates is fetched again over
+	// TCP, so the client on TCP gets all of it.
+	upstream := startServerBoth(t, &Server{Zones: []*Zone{z}})
+	forwarder := startServerBoth(t, &Server{Upstream: upstream})
+	tcp, err = LookupTCP(ctx, forwarder, "big.example.com", A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tcp.Header.TruncatedMessage || len(tcp.Answers) != 40 {
+		t.Errorf("forwarded TCP response has TC %v and %d answers, want all 40", tcp.Header.TruncatedMessage, len(tcp.Answers))
+	}
+}
@@ -0,0 +1,229 @@
+package dns
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SvcParamKey identifies a parameter of an SVCB or HTTPS record, see RFC
+// 9460.
+type SvcParamKey uint16
+
+const (
+	SvcMandatory     SvcParamKey = 0
+	SvcALPN          SvcParamKey = 1
+	SvcNoDefaultALPN SvcParamKey = 2
+	SvcPort          SvcParamKey = 3
+	SvcIPv4Hint      SvcParamKey = 4
+	SvcECH           SvcParamKey = 5
+	SvcIPv6Hint      SvcParamKey = 6
+)
+
+var svcParamKeyNames = map[SvcParamKey]string{
+	SvcMandatory:     "mandatory",
+	SvcALPN:          "alpn",
+	SvcNoDefaultALPN: "no-default-alpn",
+	SvcPort:          "port",
+	SvcIPv4Hint:      "ipv4hint",
+	SvcECH:           "ech",
+	SvcIPv6Hint:      "ipv6hint",
+}
+
+func (k SvcParamKey) String() string {
+	if name, ok := svcParamKeyNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("key%d", uint16(k))
+}
+
+// SvcParam is a parameter of an SVCB or HTTPS record. Value holds the data
+// in wire format, as built by the constructors below.
+type SvcParam struct {
+	Key   SvcParamKey
+	Value []byte
+}
+
+// ALPNParam returns the alpn parameter listing the protocol IDs, like "h2"
+// and "h3", supported by the service.
+func ALPNParam(protocols ...string) SvcParam {
+	var value []byte
+	for _, proto := range protocols {
+		value = append(value, byte(len(proto)))
+		value = append(value, proto...)
+	}
+	return SvcParam{Key: SvcALPN, Value: value}
+}
+
+// PortParam returns the port parameter.
+func PortParam(port uint16) SvcParam {
+	return SvcParam{Key: SvcPort, Value: binary.BigEndian.AppendUint16(nil, port)}
+}
+
+// IPv4HintParam returns the ipv4hint parameter. Addresses that are not IPv4
+// are skipped.
+func IPv4HintParam(addrs ...net.IP) SvcParam {
+	var value []byte
+	for _, addr := range addrs {
+		if ip := addr.To4(); ip != nil {
+			value = append(value, ip...)
+		}
+	}
+	return SvcParam{Key: SvcIPv4Hint, Value: value}
+}
+
+// IPv6HintParam returns the ipv6hint parameter. Addresses that are not IPv6
+// are skipped.
+func IPv6HintParam(addrs ...net.IP) SvcParam {
+	var value []byte
+	for _, addr := range addrs {
+		if ip := addr.To16(); ip != nil && addr.To4() == nil {
+			value = append(value, ip...)
+		}
+	}
+	return SvcParam{Key: SvcIPv6Hint, Value: value}
+}
+
+// ALPN returns the protocol IDs of an alpn parameter.
+func (p SvcParam) ALPN() ([]string, error) {
+	var protocols []string
+	for value := p.Value; len(value) > 0; {
+		n := int(value[0])
+		if n == 0 || 1+n > len(value) {
+			return nil, errors.New("malformed alpn parameter")
+		}
+		protocols = append(protocols, string(value[1:1+n]))
+		value = value[1+n:]
+	}
+	return protocols, nil
+}
+
+// Addrs returns the addresses of an ipv4hint or ipv6hint parameter.
+func (p SvcParam) Addrs() ([]net.IP, error) {
+	size := net.IPv4len
+	if p.Key == SvcIPv6Hint {
+		size = net.IPv6len
+	}
+	if len(p.Value)%size != 0 {
+		return nil, fmt.Errorf("malformed %s parameter", p.Key)
+	}
+
+	var addrs []net.IP
+	for i := 0; i < len(p.Value); i += size {
+		addrs = append(addrs, append(net.IP(nil), p.Value[i:i+size]...))
+	}
+	return addrs, nil
+}
+
+// String renders the parameter in presentation format, like
+// alpn="h2,h3". Values that can't be decoded are shown quoted as they are.
+func (p SvcParam) String() string {
+	var value string
+	switch p.Key {
+	case SvcNoDefaultALPN:
+		if len(p.Value) == 0 {
+			return p.Key.String()
+		}
+	case SvcALPN:
+		if protocols, err := p.ALPN(); err == nil {
+			value = strconv.Quote(strings.Join(protocols, ","))
+		}
+	case SvcPort:
+		if len(p.Value) == 2 {
+			value = strconv.Itoa(int(binary.BigEndian.Uint16(p.Value)))
+		}
+	case SvcIPv4Hint, SvcIPv6Hint:
+		if addrs, err := p.Addrs(); err == nil {
+			hints := make([]string, len(addrs))
+			for i, addr := range addrs {
+				hints[i] = addr.String()
+			}
+			value = strings.Join(hints, ",")
+		}
+	case SvcMandatory:
+		if len(p.Value)%2 == 0 {
+			keys := make([]string, 0, len(p.Value)/2)
+			for i := 0; i < len(p.Value); i += 2 {
+				keys = append(keys, SvcParamKey(binary.BigEndian.Uint16(p.Value[i:])).String())
+			}
+			value = strings.Join(keys, ",")
+		}
+	case SvcECH:
+		value = base64.StdEncoding.EncodeToString(p.Value)
+	}
+
+	if value == "" {
+		value = strconv.Quote(string(p.Value))
+	}
+	return p.Key.String() + "=" + value
+}
+
+func cloneSvcParams(params []SvcParam) []SvcParam {
+	if params == nil {
+		return nil
+	}
+	clone := make([]SvcParam, len(params))
+	for i, p := range params {
+		clone[i] = SvcParam{Key: p.Key, Value: append([]byte(nil), p.Value...)}
+	}
+	return clone
+}
+
+func svcParamEqual(a, b SvcParam) bool {
+	return a.Key == b.Key && string(a.Value) == string(b.Value)
+}
+
+// readSvcParams reads the key-length-value triples that make up the rest of
+// the record data, which ends at end.
+func readSvcParams(buffer *BytePacketBuffer, end int) ([]SvcParam, error) {
+	var params []SvcParam
+	for int(buffer.Pos) < end {
+		key, err := buffer.Read2Bytes()
+		if err != nil {
+			return nil, err
+		}
+		length, err := buffer.Read2Bytes()
+		if err != nil {
+			return nil, err
+		}
+		if int(buffer.Pos)+int(length) > end {
+			return nil, fmt.Errorf("parameter %s exceeds the record data", SvcParamKey(key))
+		}
+
+		value, err := buffer.GetRangeCopy(buffer.Pos, length)
+		if err != nil {
+			return nil, err
+		}
+		if err := buffer.Step(length); err != nil {
+			return nil, err
+		}
+		params = append(params, SvcParam{Key: SvcParamKey(key), Value: value})
+	}
+	return params, nil
+}
+
+// writeSvcParams writes params in the order given. RFC 9460 requires them
+// to be sorted by key.
+func writeSvcParams(buffer *BytePacketBuffer, params []SvcParam) error {
+	for _, p := range params {
+		if len(p.Value) > 0xFFFF {
+			return fmt.Errorf("parameter %s is too long", p.Key)
+		}
+		if err := buffer.Write2Byte(uint16(p.Key)); err != nil {
+			return err
+		}
+		if err := buffer.Write2Byte(uint16(len(p.Value))); err != nil {
+			return err
+		}
+		for _, b := range p.Value {
+			if err := buffer.Write1Byte(b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
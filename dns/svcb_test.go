@@ -0,0 +1,72 @@
+package dns
+
+import (
+	"bytes"
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestHTTPSRoundTrip(t *testing.T) {
+	hint := net.IPv4(192, 0, 2, 1)
+	p := NewDnsPacket()
+	p.Header.Response = true
+	p.AddQuestion(NewDnsQuestion("example.com", HTTPS))
+	p.Answers = append(p.Answers,
+		NewHTTPSDnsRecord("example.com", 1, "", []SvcParam{ALPNParam("h2", "h3"), IPv4HintParam(hint)}, 300),
+		NewSVCBDnsRecord("_8443._foo.example.com", 2, "svc.example.com", []SvcParam{PortParam(8443)}, 300),
+	)
+
+	msg, err := p.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Priority 1, the root as target, then alpn and ipv4hint.
+	rdata := []byte("\x00\x01\x00" + "\x00\x01\x00\x06\x02h2\x02h3" + "\x00\x04\x00\x04\xc0\x00\x02\x01")
+	if !bytes.Contains(msg, append([]byte{0, byte(len(rdata))}, rdata...)) {
+		t.Errorf("HTTPS record data %x not found in %x", rdata, msg)
+	}
+	// The target name of an SVCB record is never compressed.
+	if !bytes.Contains(msg, []byte("\x03svc\x07example\x03com\x00")) {
+		t.Errorf("SVCB target compressed in %x", msg)
+	}
+
+	parsed, err := Unpack(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Equal(p) {
+		t.Fatalf("round trip changed the packet to\n%v", parsed)
+	}
+
+	https := parsed.Answers[0]
+	if https.Type != HTTPS || https.Priority != 1 || https.Host != "" || len(https.Params) != 2 {
+		t.Fatalf("HTTPS record read as %+v", https)
+	}
+	if alpn, err := https.Params[0].ALPN(); err != nil || !slices.Equal(alpn, []string{"h2", "h3"}) {
+		t.Errorf("alpn is %q, %v", alpn, err)
+	}
+	if addrs, err := https.Params[1].Addrs(); err != nil || len(addrs) != 1 || !addrs[0].Equal(hint) {
+		t.Errorf("ipv4hint is %v, %v", addrs, err)
+	}
+	if s := https.String(); s != `example.com. 300 IN HTTPS 1 . alpn="h2,h3" ipv4hint=192.0.2.1` {
+		t.Errorf("String() = %q", s)
+	}
+}
+
+func TestReadSvcParamsMalformed(t *testing.T) {
+	// The port parameter claims 4 bytes, but the data ends after 2.
+	data := []byte("\x00\x01\x00\x00\x03\x00\x04\x01\xbb")
+	if rec, err := ReadDnsRecord(rawRecord(64, uint16(len(data)), data)); err == nil {
+		t.Errorf("malformed SVCB record read as %v", rec)
+	}
+
+	for _, p := range []SvcParam{{Key: SvcALPN, Value: []byte("\x05h2")}, {Key: SvcALPN, Value: []byte{0}}} {
+		if _, err := p.ALPN(); err == nil {
+			t.Errorf("malformed alpn %x decoded", p.Value)
+		}
+	}
+	if _, err := (SvcParam{Key: SvcIPv6Hint, Value: make([]byte, 5)}).Addrs(); err == nil {
+		t.Error("malformed ipv6hint decoded")
+	}
+}
@@ -0,0 +1,67 @@
+package dns
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+)
+
+// WriteTCP writes packet to w using the TCP framing, where every message is
+// prefixed with its length as a 2 byte integer.
+func WriteTCP(w io.Writer, packet *DnsPacket) error {
+	// Unlike over UDP, a message may use all of the 16 bit length.
+	buffer := NewBytePacketBufferSize(maxMessageSize)
+	if _, err := packet.Write(buffer); err != nil {
+		return err
+	}
+
+	msg := make([]byte, 2+buffer.Pos)
+	binary.BigEndian.PutUint16(msg, buffer.Pos)
+	copy(msg[2:], buffer.Buf[:buffer.Pos])
+
+	_, err := w.Write(msg)
+	return err
+}
+
+// ReadTCP reads a single length prefixed message from r.
+func ReadTCP(r io.Reader) (*DnsPacket, error) {
+	var prefix [2]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+
+	buffer, err := NewBytePacketBufferFromReader(r, int(binary.BigEndian.Uint16(prefix[:])))
+	if err != nil {
+		return nil, err
+	}
+
+	return FromBuffer2DnsPacket(buffer)
+}
+
+// ReadAuto reads a single message from conn that may or may not use the TCP
+// framing, for listeners that accept both. It does one Read, so conn should
+// deliver a whole message at once, as packet connections always do. If the
+// first 2 bytes equal the number of bytes following them and those parse as
+// a message, they are taken as the length prefix. Otherwise all bytes are
+// parsed as a bare message.
+//
+// The heuristic has limits. A framed message split across reads, or several
+// framed messages arriving in one read, are parsed as a bare message and
+// fail. A bare message whose ID happens to equal its length minus 2 is
+// tried as framed first, but is still read correctly unless the rest also
+// parses.
+func ReadAuto(conn net.Conn) (*DnsPacket, error) {
+	buf := make([]byte, 2+maxMessageSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	data := buf[:n]
+
+	if n >= 2 && int(binary.BigEndian.Uint16(data)) == n-2 {
+		if packet, err := Unpack(data[2:]); err == nil {
+			return packet, nil
+		}
+	}
+	return Unpack(data)
+}
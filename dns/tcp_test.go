@@ -0,0 +1,58 @@
+package dns
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// readAuto writes msg in a single write to one end of a pipe and reads it
+// with ReadAuto from the other.
+func readAuto(t *testing.T, msg []byte) (*DnsPacket, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write(msg)
+	return ReadAuto(server)
+}
+
+func TestReadAuto(t *testing.T) {
+	query := NewQuery("example.com", A)
+	query.Header.ID = 6666
+	bare, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var framed bytes.Buffer
+	if err := WriteTCP(&framed, query); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		msg  []byte
+		id   uint16
+	}{
+		{"bare", bare, 6666},
+		{"framed", framed.Bytes(), 6666},
+		// The ID of a bare message looks like a length prefix, but the
+		// rest doesn't parse as a message.
+		{"bare with length as ID", append([]byte{0, byte(len(bare) - 2)}, bare[2:]...), uint16(len(bare) - 2)},
+	} {
+		p, err := readAuto(t, tt.msg)
+		if err != nil {
+			t.Errorf("%s: ReadAuto returned %v", tt.name, err)
+			continue
+		}
+		if p.Header.ID != tt.id || len(p.Questions) != 1 || p.Questions[0].Name != "example.com" {
+			t.Errorf("%s: ReadAuto read\n%v", tt.name, p)
+		}
+	}
+
+	// Two framed messages in one read are neither framed nor bare.
+	twice := append(bytes.Clone(framed.Bytes()), framed.Bytes()...)
+	if p, err := readAuto(t, twice); err == nil {
+		t.Errorf("two framed messages read as\n%v", p)
+	}
+}
@@ -0,0 +1,133 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Transport sends a query to a server and returns its response. It lets the
+// lookups of a StubResolver run over any network, or none at all, like a
+// fake returning canned responses in tests.
+type Transport interface {
+	Exchange(ctx context.Context, req *DnsPacket) (*DnsPacket, error)
+}
+
+// UDPTransport sends queries to Server, given as "host:port", over UDP, as
+// Lookup does.
+type UDPTransport struct {
+	Server string
+}
+
+func (t UDPTransport) Exchange(ctx context.Context, req *DnsPacket) (*DnsPacket, error) {
+	return exchangeUDP(ctx, t.Server, req)
+}
+
+// TCPTransport sends queries to Server, given as "host:port", over TCP, as
+// LookupTCP does.
+type TCPTransport struct {
+	Server string
+}
+
+func (t TCPTransport) Exchange(ctx context.Context, req *DnsPacket) (*DnsPacket, error) {
+	return exchangeTCP(ctx, "tcp", t.Server, req)
+}
+
+// CoalescingTransport passes queries on to Transport, but lets concurrent
+// identical queries share a single exchange. Queries are only identical if
+// they differ in nothing but their ID, so the class, the header bits like
+// RD and CD, and the EDNS flags and options all have to match. Questions
+// with an uppercase letter are never shared, as their case is likely
+// randomized (DNS-0x20) and has to be echoed for each of them. The callers
+// waiting for an exchange all get a copy of its response, or its error, so
+// they fail together if the context of the first one is cancelled. It is
+// safe for concurrent use.
+type CoalescingTransport struct {
+	Transport Transport
+
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is an exchange in progress for a CoalescingTransport.
+type flight struct {
+	done chan struct{}
+	resp *DnsPacket
+	err  error
+}
+
+func (t *CoalescingTransport) Exchange(ctx context.Context, req *DnsPacket) (*DnsPacket, error) {
+	key, ok := coalescingKey(req)
+	if !ok {
+		return t.Transport.Exchange(ctx, req)
+	}
+
+	t.mu.Lock()
+	f, ok := t.flights[key]
+	if ok {
+		t.mu.Unlock()
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	} else {
+		f = &flight{done: make(chan struct{})}
+		if t.flights == nil {
+			t.flights = map[string]*flight{}
+		}
+		t.flights[key] = f
+		t.mu.Unlock()
+
+		f.resp, f.err = t.Transport.Exchange(ctx, req)
+
+		t.mu.Lock()
+		delete(t.flights, key)
+		t.mu.Unlock()
+		close(f.done)
+	}
+
+	if f.err != nil {
+		return nil, f.err
+	}
+	resp := f.resp.Clone()
+	resp.Header.ID = req.Header.ID
+	return resp, nil
+}
+
+// coalescingKey returns the key under which req shares an exchange, which
+// is its wire form with the ID cleared. It reports false for queries that
+// must not be shared.
+func coalescingKey(req *DnsPacket) (string, bool) {
+	if len(req.Questions) == 0 {
+		return "", false
+	}
+	for _, q := range req.Questions {
+		if strings.ToLower(q.Name) != q.Name {
+			return "", false
+		}
+	}
+
+	req = req.Clone()
+	req.Header.ID = 0
+	msg, err := req.Pack()
+	if err != nil {
+		return "", false
+	}
+	return string(msg), true
+}
+
+// StubResolver sends recursive queries to a single upstream through
+// Transport.
+type StubResolver struct {
+	Transport Transport
+}
+
+// Lookup sends a recursive query for qname and returns the response.
+func (r StubResolver) Lookup(ctx context.Context, qname string, qtype RecordType, opts ...QueryOption) (*DnsPacket, error) {
+	if r.Transport == nil {
+		return nil, fmt.Errorf("no transport to look up %s", qname)
+	}
+	return r.Transport.Exchange(ctx, NewQuery(qname, qtype, opts...))
+}
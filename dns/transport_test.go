@@ -0,0 +1,199 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeTransport answers queries with answer, counting them.
+type fakeTransport struct {
+	calls  atomic.Int32
+	answer func(req *DnsPacket) (*DnsPacket, error)
+}
+
+func (t *fakeTransport) Exchange(ctx context.Context, req *DnsPacket) (*DnsPacket, error) {
+	t.calls.Add(1)
+	return t.answer(req)
+}
+
+// answerA returns a response to req with an A record of addr for each
+// question.
+func answerA(req *DnsPacket, addr net.IP) *DnsPacket {
+	resp := ErrorResponse(req, NOERROR)
+	for _, q := range req.Questions {
+		resp.Answers = append(resp.Answers, NewADnsRecord(q.Name, addr, 300))
+	}
+	return resp
+}
+
+// exchangeConcurrently sends reqs through a CoalescingTransport at the same
+// time and returns how often its upstream was queried.
+func exchangeConcurrently(t *testing.T, reqs ...*DnsPacket) int32 {
+	t.Helper()
+	release := make(chan struct{})
+	upstream := &fakeTransport{answer: func(req *DnsPacket) (*DnsPacket, error) {
+		<-release
+		return answerA(req, net.IPv4(192, 0, 2, 1)), nil
+	}}
+	ct := &CoalescingTransport{Transport: upstream}
+
+	var wg sync.WaitGroup
+	for _, req := range reqs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := ct.Exchange(context.Background(), req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if resp.Header.ID != req.Header.ID || len(resp.Answers) != 1 || resp.Answers[0].Domain != req.Questions[0].Name {
+				t.Errorf("query %v got response\n%v", req.Questions[0], resp)
+			}
+		}()
+	}
+	// Give every query the time to join the exchange of the first one.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	return upstream.calls.Load()
+}
+
+func TestCoalescingTransportSharesExchange(t *testing.T) {
+	reqs := make([]*DnsPacket, 20)
+	for i := range reqs {
+		reqs[i] = NewQuery("www.example.com", A)
+	}
+	if calls := exchangeConcurrently(t, reqs...); calls != 1 {
+		t.Errorf("upstream was queried %d times, want 1", calls)
+	}
+}
+
+func TestCoalescingTransportKeepsDistinctQueries(t *testing.T) {
+	query := func(edit func(req *DnsPacket)) *DnsPacket {
+		req := NewQuery("www.example.com", A)
+		edit(req)
+		return req
+	}
+	mixedCase := query(func(req *DnsPacket) { req.Questions[0].Name = "wWw.ExAmPlE.cOm" })
+
+	tests := []struct {
+		name          string
+		first, second *DnsPacket
+	}{
+		{"class", NewQuery("www.example.com", A), query(func(req *DnsPacket) { req.Questions[0].Class = ClassCH })},
+		{"CD bit", NewQuery("www.example.com", A), query(func(req *DnsPacket) { req.Header.CheckingDisabled = true })},
+		{"RD bit", NewQuery("www.example.com", A), query(func(req *DnsPacket) { req.Header.RecursionDesired = false })},
+		{"DO bit", NewQuery("www.example.com", A), NewQuery("www.example.com", A, WithDNSSEC())},
+		{"EDNS option", NewQuery("www.example.com", A), NewQuery("www.example.com", A, WithNSID())},
+		// Randomized case is never shared, not even when it happens to be
+		// the same.
+		{"0x20", mixedCase, mixedCase.Clone()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if calls := exchangeConcurrently(t, tt.first, tt.second); calls != 2 {
+				t.Errorf("upstream was queried %d times, want 2", calls)
+			}
+		})
+	}
+}
+
+// scriptedTransport records the queries sent through it and answers them
+// with the responses of script in turn.
+type scriptedTransport struct {
+	script []func(req *DnsPacket) *DnsPacket
+	reqs   []*DnsPacket
+}
+
+func (t *scriptedTransport) Exchange(ctx context.Context, req *DnsPacket) (*DnsPacket, error) {
+	if len(t.reqs) == len(t.script) {
+		return nil, errors.New("no more scripted responses")
+	}
+	t.reqs = append(t.reqs, req)
+	return t.script[len(t.reqs)-1](req), nil
+}
+
+func TestStubResolverScripted(t *testing.T) {
+	cname := func(req *DnsPacket) *DnsPacket {
+		resp := ErrorResponse(req, NOERROR)
+		resp.Answers = append(resp.Answers, NewCNameDnsRecord("www.example.com", "cdn.example.net", 300))
+		return resp
+	}
+	address := func(req *DnsPacket) *DnsPacket {
+		return answerA(req, net.IPv4(192, 0, 2, 1))
+	}
+	mx := func(req *DnsPacket) *DnsPacket {
+		resp := ErrorResponse(req, NOERROR)
+		resp.Answers = append(resp.Answers, NewMXDnsRecord("example.com", "mail.example.com", 10, 300))
+		return resp
+	}
+
+	transport := &scriptedTransport{script: []func(*DnsPacket) *DnsPacket{cname, address, mx}}
+	r := StubResolver{Transport: transport}
+	ctx := context.Background()
+
+	// The server stops at the CNAME, so its target takes a second query.
+	records, err := r.LookupFollowCNAME(ctx, "www.example.com", A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Domain != "cdn.example.net" {
+		t.Errorf("LookupFollowCNAME returned %v", records)
+	}
+	hosts, err := r.LookupMX(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 1 || hosts[0].Host != "mail.example.com" {
+		t.Errorf("LookupMX returned %v", hosts)
+	}
+
+	want := []string{"www.example.com. IN A", "cdn.example.net. IN A", "example.com. IN MX"}
+	if len(transport.reqs) != len(want) {
+		t.Fatalf("sent %d queries, want %d", len(transport.reqs), len(want))
+	}
+	for i, req := range transport.reqs {
+		if q := req.Questions[0].String(); q != want[i] || !req.Header.RecursionDesired {
+			t.Errorf("query %d asked %q, want %q", i, q, want[i])
+		}
+	}
+
+	if _, err := (StubResolver{}).Lookup(ctx, "example.com", A); err == nil {
+		t.Error("lookup without a transport succeeded")
+	}
+}
+
+func TestNetworkTransports(t *testing.T) {
+	udp := serveUDP(t, func(req *DnsPacket) *DnsPacket {
+		return answerA(req, net.IPv4(192, 0, 2, 1))
+	})
+	tcp := serveTCP(t, func(conn net.Conn) {
+		req, err := ReadTCP(conn)
+		if err != nil {
+			return
+		}
+		WriteTCP(conn, answerA(req, net.IPv4(192, 0, 2, 2)))
+	})
+
+	for _, tt := range []struct {
+		transport Transport
+		want      net.IP
+	}{
+		{UDPTransport{Server: udp}, net.IPv4(192, 0, 2, 1)},
+		{TCPTransport{Server: tcp}, net.IPv4(192, 0, 2, 2)},
+	} {
+		resp, err := StubResolver{Transport: tt.transport}.Lookup(context.Background(), "example.com", A)
+		if err != nil {
+			t.Fatalf("%T: %v", tt.transport, err)
+		}
+		if len(resp.Answers) != 1 || !resp.Answers[0].Addr.Equal(tt.want) {
+			t.Errorf("%T got\n%v", tt.transport, resp)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package dns
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"slices"
+	"time"
+)
+
+// Algorithms supported by SignTSIG and VerifyTSIG.
+const (
+	HmacSHA1   = "hmac-sha1."
+	HmacSHA256 = "hmac-sha256."
+	HmacSHA512 = "hmac-sha512."
+)
+
+// tsigFudge is how many seconds a signature stays valid before and after
+// the time it was made.
+const tsigFudge = 300
+
+var (
+	ErrBadKey       = errors.New("tsig: bad key")
+	ErrBadSignature = errors.New("tsig: bad signature")
+	ErrBadTime      = errors.New("tsig: signature time outside of fudge")
+)
+
+// tsigData holds the RDATA of a TSIG record.
+type tsigData struct {
+	algorithm  string
+	timeSigned uint64 // 48 bits
+	fudge      uint16
+	mac        []byte
+	originalID uint16
+	error      uint16
+	other      []byte
+}
+
+func tsigHash(alg string) (func() hash.Hash, error) {
+	switch CanonicalName(alg) {
+	case "hmac-sha1":
+		return sha1.New, nil
+	case "hmac-sha256":
+		return sha256.New, nil
+	case "hmac-sha512":
+		return sha512.New, nil
+	default:
+		return nil, fmt.Errorf("tsig: unsupported algorithm %q", alg)
+	}
+}
+
+// SignTSIG signs p following RFC 8945 and returns the signed message,
+// ready to be sent. secret is the base64 encoded key shared with the server
+// under keyName, and alg one of the Hmac algorithms. The TSIG record is also
+// appended to the additional section of p, replacing an earlier one, but
+// the signature covers the returned bytes: p written again with other
+// compression settings or names doesn't verify.
+func SignTSIG(p *DnsPacket, keyName, secret, alg string) ([]byte, error) {
+	return signTSIG(p, keyName, secret, alg, time.Now())
+}
+
+func signTSIG(p *DnsPacket, keyName, secret, alg string, now time.Time) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, fmt.Errorf("tsig: decoding secret: %w", err)
+	}
+	newHash, err := tsigHash(alg)
+	if err != nil {
+		return nil, err
+	}
+
+	p.Resources = slices.DeleteFunc(p.Resources, func(rec *DnsRecord) bool {
+		return rec.Type == TSIG
+	})
+
+	msg, err := p.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tsigData{
+		algorithm:  alg,
+		timeSigned: uint64(now.Unix()),
+		fudge:      tsigFudge,
+		originalID: p.Header.ID,
+	}
+	t.mac, err = tsigMAC(newHash, key, msg, keyName, t)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := t.pack()
+	if err != nil {
+		return nil, err
+	}
+	rec := &DnsRecord{
+		Type:   TSIG,
+		Domain: keyName,
+		Class:  ClassANY,
+		Raw:    raw,
+	}
+
+	// The record goes after the bytes that were signed, whatever fits of
+	// the largest message.
+	buffer := NewBytePacketBufferSize(maxMessageSize - len(msg))
+	if _, err := rec.Write(buffer); err != nil {
+		return nil, err
+	}
+	msg = append(msg, buffer.Buf[:buffer.Pos]...)
+	binary.BigEndian.PutUint16(msg[10:], binary.BigEndian.Uint16(msg[10:])+1)
+
+	p.Resources = append(p.Resources, rec)
+	return msg, nil
+}
+
+// VerifyTSIG checks the TSIG record ending msg, which has to be signed with
+// the base64 encoded secret shared under keyName, using alg. A record
+// naming another key or algorithm fails with ErrBadKey. It works on the
+// message as received, since the signature covers its exact bytes.
+func VerifyTSIG(msg []byte, keyName, secret, alg string) error {
+	return verifyTSIG(msg, keyName, secret, alg, time.Now())
+}
+
+func verifyTSIG(msg []byte, keyName, secret, alg string, now time.Time) error {
+	key, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return fmt.Errorf("tsig: decoding secret: %w", err)
+	}
+	newHash, err := tsigHash(alg)
+	if err != nil {
+		return err
+	}
+
+	buffer := NewBytePacketBufferSize(len(msg))
+	buffer.SetBuffer(msg)
+
+	header := NewDnsHeader()
+	if err := header.Read(buffer); err != nil {
+		return err
+	}
+	for i := 0; i < int(header.Questions); i++ {
+		if err := NewDnsQuestion("", UNKNOWN).Read(buffer); err != nil {
+			return err
+		}
+	}
+
+	// The TSIG record has to be the very last one.
+	var start uint16
+	var rec *DnsRecord
+	records := int(header.Answers) + int(header.AuthoritativeEntries) + int(header.ResourceEntries)
+	for i := 0; i < records; i++ {
+		start = buffer.Pos
+		rec, err = ReadDnsRecord(buffer)
+		if err != nil {
+			return err
+		}
+	}
+	if header.ResourceEntries == 0 || rec.Type != TSIG {
+		return errors.New("tsig: message is not signed")
+	}
+	if !sameName(rec.Domain, keyName) {
+		return fmt.Errorf("%w: unknown key %q", ErrBadKey, rec.Domain)
+	}
+
+	t, err := unpackTSIG(rec.Raw)
+	if err != nil {
+		return err
+	}
+	if !sameName(t.algorithm, alg) {
+		return fmt.Errorf("%w: signed with %s, want %s", ErrBadKey, t.algorithm, alg)
+	}
+
+	// The signature was made before the TSIG record was added, and with the
+	// original ID in case a forwarder changed it.
+	unsigned := append([]byte(nil), msg[:start]...)
+	binary.BigEndian.PutUint16(unsigned[0:], t.originalID)
+	binary.BigEndian.PutUint16(unsigned[10:], header.ResourceEntries-1)
+
+	mac, err := tsigMAC(newHash, key, unsigned, rec.Domain, t)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(mac, t.mac) {
+		return ErrBadSignature
+	}
+
+	signed := int64(t.timeSigned)
+	if now.Unix() < signed-int64(t.fudge) || now.Unix() > signed+int64(t.fudge) {
+		return ErrBadTime
+	}
+	return nil
+}
+
+// tsigMAC computes the MAC over msg followed by the TSIG variables, which
+// are the fields of the TSIG record without the MAC itself.
+func tsigMAC(newHash func() hash.Hash, key, msg []byte, keyName string, t *tsigData) ([]byte, error) {
+	buffer := NewBytePacketBufferSize(maxMessageSize)
+	buffer.Compress = false
+
+	canonicalKey, ok := canonicalName(keyName)
+	if !ok {
+		return nil, fmt.Errorf("tsig: invalid key name %q", keyName)
+	}
+	algorithm, ok := canonicalName(t.algorithm)
+	if !ok {
+		return nil, fmt.Errorf("tsig: invalid algorithm %q", t.algorithm)
+	}
+
+	if err := buffer.WriteQName(canonicalKey); err != nil {
+		return nil, err
+	}
+	if err := buffer.Write2Byte(uint16(ClassANY)); err != nil {
+		return nil, err
+	}
+	if err := buffer.Write4Byte(0); err != nil {
+		return nil, err
+	}
+	if err := buffer.WriteQName(algorithm); err != nil {
+		return nil, err
+	}
+	if err := t.writeTime(buffer); err != nil {
+		return nil, err
+	}
+	if err := buffer.Write2Byte(t.error); err != nil {
+		return nil, err
+	}
+	if err := t.writeOther(buffer); err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(newHash, key)
+	mac.Write(msg)
+	mac.Write(buffer.Buf[:buffer.Pos])
+	return mac.Sum(nil), nil
+}
+
+func (t *tsigData) writeTime(buffer *BytePacketBuffer) error {
+	if err := buffer.Write2Byte(uint16(t.timeSigned >> 32)); err != nil {
+		return err
+	}
+	if err := buffer.Write4Byte(uint32(t.timeSigned)); err != nil {
+		return err
+	}
+	return buffer.Write2Byte(t.fudge)
+}
+
+func (t *tsigData) writeOther(buffer *BytePacketBuffer) error {
+	if err := buffer.Write2Byte(uint16(len(t.other))); err != nil {
+		return err
+	}
+	for _, b := range t.other {
+		if err := buffer.Write1Byte(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pack returns the RDATA of the TSIG record.
+func (t *tsigData) pack() ([]byte, error) {
+	buffer := NewBytePacketBufferSize(maxMessageSize)
+	buffer.Compress = false
+
+	if err := buffer.WriteQName(t.algorithm); err != nil {
+		return nil, err
+	}
+	if err := t.writeTime(buffer); err != nil {
+		return nil, err
+	}
+	if err := buffer.Write2Byte(uint16(len(t.mac))); err != nil {
+		return nil, err
+	}
+	for _, b := range t.mac {
+		if err := buffer.Write1Byte(b); err != nil {
+			return nil, err
+		}
+	}
+	if err := buffer.Write2Byte(t.originalID); err != nil {
+		return nil, err
+	}
+	if err := buffer.Write2Byte(t.error); err != nil {
+		return nil, err
+	}
+	if err := t.writeOther(buffer); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), buffer.Buf[:buffer.Pos]...), nil
+}
+
+func unpackTSIG(raw []byte) (*tsigData, error) {
+	buffer := NewBytePacketBufferSize(len(raw))
+	buffer.SetBuffer(raw)
+
+	var t tsigData
+	var err error
+	if t.algorithm, err = buffer.ReadQName(); err != nil {
+		return nil, err
+	}
+
+	timeHigh, err := buffer.Read2Bytes()
+	if err != nil {
+		return nil, err
+	}
+	timeLow, err := buffer.Read4Bytes()
+	if err != nil {
+		return nil, err
+	}
+	t.timeSigned = uint64(timeHigh)<<32 | uint64(timeLow)
+
+	if t.fudge, err = buffer.Read2Bytes(); err != nil {
+		return nil, err
+	}
+
+	macSize, err := buffer.Read2Bytes()
+	if err != nil {
+		return nil, err
+	}
+	if t.mac, err = buffer.GetRangeCopy(buffer.Pos, macSize); err != nil {
+		return nil, err
+	}
+	if err := buffer.Step(macSize); err != nil {
+		return nil, err
+	}
+
+	if t.originalID, err = buffer.Read2Bytes(); err != nil {
+		return nil, err
+	}
+	if t.error, err = buffer.Read2Bytes(); err != nil {
+		return nil, err
+	}
+
+	otherLen, err := buffer.Read2Bytes()
+	if err != nil {
+		return nil, err
+	}
+	if t.other, err = buffer.GetRangeCopy(buffer.Pos, otherLen); err != nil {
+		return nil, err
+	}
+	if err := buffer.Step(otherLen); err != nil {
+		return nil, err
+	}
+
+	if int(buffer.Pos) != len(raw) {
+		return nil, errors.New("tsig: trailing data in record")
+	}
+	return &t, nil
+}
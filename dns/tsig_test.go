@@ -0,0 +1,182 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"net"
+	"testing"
+	"time"
+)
+
+// testTSIGSecret is "secret key for tests" in base64.
+const testTSIGSecret = "c2VjcmV0IGtleSBmb3IgdGVzdHM="
+
+// tsigQuery returns a fixed query for example.com.
+func tsigQuery() *DnsPacket {
+	p := NewDnsPacket()
+	p.Header.ID = 0x1234
+	p.Header.RecursionDesired = true
+	p.AddQuestion(NewDnsQuestion("example.com", A))
+	return p
+}
+
+func mustHash(t *testing.T, alg string) func() hash.Hash {
+	t.Helper()
+	newHash, err := tsigHash(alg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newHash
+}
+
+func TestTSIGKnownMAC(t *testing.T) {
+	msg, err := tsigQuery().Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	td := &tsigData{
+		algorithm:  HmacSHA256,
+		timeSigned: 1700000000,
+		fudge:      300,
+		originalID: 0x1234,
+	}
+
+	// Computed independently over the message followed by the TSIG
+	// variables of RFC 8945, section 4.3.3.
+	want := "b913c75810c9157ac8ecd64bb28bcef8a99d6b2e1db599506336f7c7f75e78bd"
+	mac, err := tsigMAC(mustHash(t, HmacSHA256), []byte("secret key for tests"), msg, "tsig-key", td)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(mac); got != want {
+		t.Fatalf("MAC is %s, want %s", got, want)
+	}
+
+	// A message carrying that MAC is accepted, but for its time, long
+	// past the fudge.
+	td.mac = mac
+	raw, err := td.pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := tsigQuery()
+	signed.Resources = append(signed.Resources, &DnsRecord{Type: TSIG, Domain: "tsig-key", Class: ClassANY, Raw: raw})
+	signedMsg, err := signed.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyTSIG(signedMsg, "tsig-key", testTSIGSecret, HmacSHA256); !errors.Is(err, ErrBadTime) {
+		t.Errorf("verifying an old signature returned %v, want %v", err, ErrBadTime)
+	}
+}
+
+func TestTSIGKnownMessage(t *testing.T) {
+	// The query followed by the TSIG record of RFC 8945, section 4.2,
+	// carrying the MAC above.
+	want := "123401000001000000000001076578616d706c6503636f6d0000010001" +
+		"08747369672d6b65790000fa00ff00000000003d" +
+		"0b686d61632d7368613235360000006553f100012c0020" +
+		"b913c75810c9157ac8ecd64bb28bcef8a99d6b2e1db599506336f7c7f75e78bd" +
+		"123400000000"
+	signedAt := time.Unix(1700000000, 0)
+	p := tsigQuery()
+	msg, err := signTSIG(p, "tsig-key", testTSIGSecret, HmacSHA256, signedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(msg); got != want {
+		t.Fatalf("signed message is\n%s, want\n%s", got, want)
+	}
+	if again, err := p.Pack(); err != nil || !bytes.Equal(again, msg) {
+		t.Errorf("packing the signed packet returned %x, %v", again, err)
+	}
+
+	for _, tt := range []struct {
+		now  time.Time
+		want error
+	}{
+		{signedAt, nil},
+		{signedAt.Add(-tsigFudge * time.Second), nil},
+		{signedAt.Add(tsigFudge * time.Second), nil},
+		{signedAt.Add((tsigFudge + 1) * time.Second), ErrBadTime},
+		{signedAt.Add(-(tsigFudge + 1) * time.Second), ErrBadTime},
+	} {
+		if err := verifyTSIG(msg, "tsig-key", testTSIGSecret, HmacSHA256, tt.now); !errors.Is(err, tt.want) {
+			t.Errorf("verifying at %v returned %v, want %v", tt.now.Sub(signedAt), err, tt.want)
+		}
+	}
+}
+
+func TestTSIGSignVerify(t *testing.T) {
+	for _, alg := range []string{HmacSHA1, HmacSHA256, HmacSHA512} {
+		p := NewUpdate("example.com")
+		p.AddRR(NewADnsRecord("www.example.com", net.IPv4(10, 0, 0, 1), 300))
+		if _, err := SignTSIG(p.DnsPacket, "tsig-key", testTSIGSecret, alg); err != nil {
+			t.Fatal(err)
+		}
+		// Signing again replaces the signature.
+		msg, err := SignTSIG(p.DnsPacket, "tsig-key", testTSIGSecret, alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(p.Resources) != 1 {
+			t.Fatalf("signed twice with %s, got %d additional records", alg, len(p.Resources))
+		}
+
+		// The signature covers the compressed names, so the packet
+		// written without compression doesn't verify.
+		buffer := NewBytePacketBufferSize(maxMessageSize)
+		buffer.Compress = false
+		n, err := p.Write(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyTSIG(buffer.Buf[:n], "tsig-key", testTSIGSecret, alg); !errors.Is(err, ErrBadSignature) {
+			t.Errorf("verifying %s written uncompressed returned %v", alg, err)
+		}
+
+		if err := VerifyTSIG(msg, "TSIG-Key.", testTSIGSecret, alg); err != nil {
+			t.Errorf("verifying %s: %v", alg, err)
+		}
+
+		// A forwarder may change the ID, which the signature doesn't cover.
+		changedID := append([]byte(nil), msg...)
+		changedID[0] ^= 0xFF
+		if err := VerifyTSIG(changedID, "tsig-key", testTSIGSecret, alg); err != nil {
+			t.Errorf("verifying %s with a new ID: %v", alg, err)
+		}
+
+		tampered := append([]byte(nil), msg...)
+		tampered[headerLen+1] ^= 0x20
+		if err := VerifyTSIG(tampered, "tsig-key", testTSIGSecret, alg); !errors.Is(err, ErrBadSignature) {
+			t.Errorf("verifying a tampered %s message returned %v", alg, err)
+		}
+		if err := VerifyTSIG(msg, "tsig-key", "b3RoZXIga2V5", alg); !errors.Is(err, ErrBadSignature) {
+			t.Errorf("verifying %s with another secret returned %v", alg, err)
+		}
+		if err := VerifyTSIG(msg, "other-key", testTSIGSecret, alg); !errors.Is(err, ErrBadKey) {
+			t.Errorf("verifying %s with another key name returned %v", alg, err)
+		}
+		// The algorithm named by the record is not trusted.
+		other := HmacSHA256
+		if alg == other {
+			other = HmacSHA512
+		}
+		if err := VerifyTSIG(msg, "tsig-key", testTSIGSecret, other); !errors.Is(err, ErrBadKey) {
+			t.Errorf("verifying %s as %s returned %v", alg, other, err)
+		}
+	}
+
+	msg, err := tsigQuery().Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyTSIG(msg, "tsig-key", testTSIGSecret, HmacSHA256); err == nil {
+		t.Error("unsigned message verified")
+	}
+	if _, err := SignTSIG(tsigQuery(), "tsig-key", testTSIGSecret, "hmac-md5."); err == nil {
+		t.Error("signed with an unsupported algorithm")
+	}
+}
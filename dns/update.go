@@ -0,0 +1,62 @@
+package dns
+
+// Update is a dynamic update message as defined by RFC 2136. It reuses the
+// sections of a regular packet: the question names the zone to update,
+// the answers hold the prerequisites and the authorities the changes.
+type Update struct {
+	*DnsPacket
+}
+
+// NewUpdate starts an empty update of zone.
+func NewUpdate(zone string) *Update {
+	packet := NewDnsPacket()
+	packet.Header.ID = newQueryID()
+	packet.Header.Opcode = OpcodeUpdate
+	packet.AddQuestion(NewDnsQuestion(zone, SOA))
+	return &Update{packet}
+}
+
+// AddRR adds rr to the zone.
+func (u *Update) AddRR(rr *DnsRecord) {
+	rr = rr.Clone()
+	rr.Class = ClassIN
+	u.Authorities = append(u.Authorities, rr)
+}
+
+// DeleteRR deletes the record of the zone matching the name, type and data
+// of rr.
+func (u *Update) DeleteRR(rr *DnsRecord) {
+	rr = rr.Clone()
+	rr.Class = ClassNONE
+	rr.TTL = 0
+	u.Authorities = append(u.Authorities, rr)
+}
+
+// DeleteRRset deletes all records of type typ at name.
+func (u *Update) DeleteRRset(name string, typ RecordType) {
+	u.Authorities = append(u.Authorities, &DnsRecord{
+		Type:   typ,
+		Domain: name,
+		Class:  ClassANY,
+	})
+}
+
+// DeleteName deletes all records at name.
+func (u *Update) DeleteName(name string) {
+	u.Authorities = append(u.Authorities, &DnsRecord{
+		Type:   UNKNOWN,
+		Domain: name,
+		QType:  RecordTypeToNum(ANY),
+		Class:  ClassANY,
+	})
+}
+
+// RequireName makes the update conditional on name having any records.
+func (u *Update) RequireName(name string) {
+	u.Answers = append(u.Answers, &DnsRecord{
+		Type:   UNKNOWN,
+		Domain: name,
+		QType:  RecordTypeToNum(ANY),
+		Class:  ClassANY,
+	})
+}
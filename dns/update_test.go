@@ -0,0 +1,95 @@
+package dns
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestUpdateLayout(t *testing.T) {
+	u := NewUpdate("example.com")
+	u.Header.ID = 0xBEEF
+	u.RequireName("example.com")
+	u.AddRR(NewADnsRecord("www.example.com", net.IPv4(10, 0, 0, 1), 300))
+	u.DeleteRR(NewADnsRecord("old.example.com", net.IPv4(10, 0, 0, 2), 300))
+	u.DeleteRRset("www.example.com", AAAA)
+	u.DeleteName("gone.example.com")
+
+	msg, err := u.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The opcode sits in bits 3 to 6 of the third byte, and the counts are
+	// ZOCOUNT, PRCOUNT, UPCOUNT and ADCOUNT.
+	if op := msg[2] >> 3 & 0x0F; op != 5 {
+		t.Errorf("opcode on the wire is %d, want 5", op)
+	}
+	counts := []uint16{1, 1, 4, 0}
+	for i, want := range counts {
+		if got := binary.BigEndian.Uint16(msg[4+2*i:]); got != want {
+			t.Errorf("count %d is %d, want %d", i, got, want)
+		}
+	}
+	// The zone section holds the zone with type SOA and class IN.
+	zone := "\x07example\x03com\x00\x00\x06\x00\x01"
+	if got := string(msg[headerLen : headerLen+len(zone)]); got != zone {
+		t.Errorf("zone section is %q, want %q", got, zone)
+	}
+
+	parsed, err := Unpack(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Header.Opcode != OpcodeUpdate {
+		t.Errorf("parsed opcode %s", parsed.Header.Opcode)
+	}
+
+	prereq := parsed.Answers[0]
+	if prereq.Class != ClassANY || prereq.TTL != 0 || prereq.DataLen != 0 || prereq.QType != RecordTypeToNum(ANY) {
+		t.Errorf("name in use prerequisite is %+v", prereq)
+	}
+
+	for i, want := range []struct {
+		class Class
+		typ   uint16
+		ttl   uint32
+	}{
+		{ClassIN, RecordTypeToNum(A), 300},
+		{ClassNONE, RecordTypeToNum(A), 0},
+		{ClassANY, RecordTypeToNum(AAAA), 0},
+		{ClassANY, RecordTypeToNum(ANY), 0},
+	} {
+		rr := parsed.Authorities[i]
+		typ := rr.QType
+		if rr.Type != UNKNOWN {
+			typ = RecordTypeToNum(rr.Type)
+		}
+		if rr.Class != want.class || typ != want.typ || rr.TTL != want.ttl {
+			t.Errorf("update %d is %v, want class %s, type %d and TTL %d", i, rr, want.class, want.typ, want.ttl)
+		}
+	}
+	if add := parsed.Authorities[0]; !add.Addr.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("added record has address %v", add.Addr)
+	}
+}
+
+func TestReadOPTWithPayloadSize255(t *testing.T) {
+	// The payload size takes the place of the class, so it reads like
+	// ClassANY, and an OPT record without options has no data, like the
+	// records of an update.
+	p := NewQuery("example.com", A)
+	p.Resources = append(p.Resources, NewOPTDnsRecord(uint16(ClassANY), 0))
+	msg, err := p.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := Unpack(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opt := parsed.OPT(); opt == nil || opt.PayloadSize != uint16(ClassANY) {
+		t.Errorf("OPT record read as %v", opt)
+	}
+}
@@ -0,0 +1,127 @@
+package dns
+
+import (
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Strategy decides how an UpstreamSet picks the next upstream.
+type Strategy int
+
+const (
+	// RoundRobin picks the upstreams in turn.
+	RoundRobin Strategy = iota
+	// WeightedRandom picks upstreams at random, proportional to their
+	// weight.
+	WeightedRandom
+)
+
+// defaultCooldown is how long an upstream is skipped after a failure.
+const defaultCooldown = 30 * time.Second
+
+type Upstream struct {
+	Addr string
+	// Weight is only used by WeightedRandom. Upstreams with a weight of 0
+	// or less count as 1.
+	Weight int
+}
+
+type upstreamState struct {
+	Upstream
+	unhealthyUntil time.Time
+}
+
+// UpstreamSet spreads queries over several upstream servers. Upstreams that
+// failed are skipped until their cooldown has passed. It is safe for
+// concurrent use.
+type UpstreamSet struct {
+	Strategy Strategy
+	// Cooldown is how long an upstream marked unhealthy is skipped.
+	Cooldown time.Duration
+
+	mu        sync.Mutex
+	upstreams []*upstreamState
+	next      int
+}
+
+func NewUpstreamSet(strategy Strategy, upstreams ...Upstream) *UpstreamSet {
+	s := &UpstreamSet{
+		Strategy: strategy,
+		Cooldown: defaultCooldown,
+	}
+	for _, u := range upstreams {
+		s.upstreams = append(s.upstreams, &upstreamState{Upstream: u})
+	}
+	return s
+}
+
+// Next returns the address of the upstream to use for the next query. If
+// every upstream is unhealthy, they are all considered again rather than
+// failing outright.
+func (s *UpstreamSet) Next() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.upstreams) == 0 {
+		return "", errors.New("no upstreams configured")
+	}
+
+	now := time.Now()
+	var healthy []*upstreamState
+	for _, u := range s.upstreams {
+		if !now.Before(u.unhealthyUntil) {
+			healthy = append(healthy, u)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = s.upstreams
+	}
+
+	if s.Strategy == WeightedRandom {
+		total := 0
+		for _, u := range healthy {
+			total += weight(u.Weight)
+		}
+		n := rand.IntN(total)
+		for _, u := range healthy {
+			n -= weight(u.Weight)
+			if n < 0 {
+				return u.Addr, nil
+			}
+		}
+	}
+
+	// Walk the full list from the last position so the order stays stable
+	// while upstreams drop out and come back.
+	for {
+		u := s.upstreams[s.next%len(s.upstreams)]
+		s.next = (s.next + 1) % len(s.upstreams)
+		for _, h := range healthy {
+			if h == u {
+				return u.Addr, nil
+			}
+		}
+	}
+}
+
+// MarkUnhealthy skips the upstream with address addr for the cooldown
+// period.
+func (s *UpstreamSet) MarkUnhealthy(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.upstreams {
+		if u.Addr == addr {
+			u.unhealthyUntil = time.Now().Add(s.Cooldown)
+		}
+	}
+}
+
+func weight(w int) int {
+	if w <= 0 {
+		return 1
+	}
+	return w
+}
@@ -0,0 +1,98 @@
+package dns
+
+import (
+	"net"
+	"slices"
+	"testing"
+)
+
+// picks returns the next n upstreams picked by s.
+func picks(t *testing.T, s *UpstreamSet, n int) []string {
+	t.Helper()
+	var addrs []string
+	for range n {
+		addr, err := s.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+func TestUpstreamSetRoundRobin(t *testing.T) {
+	s := NewUpstreamSet(RoundRobin, Upstream{Addr: "a"}, Upstream{Addr: "b"}, Upstream{Addr: "c"})
+	want := []string{"a", "b", "c", "a", "b", "c", "a"}
+	if got := picks(t, s, 7); !slices.Equal(got, want) {
+		t.Errorf("picked %v, want %v", got, want)
+	}
+
+	if _, err := NewUpstreamSet(RoundRobin).Next(); err == nil {
+		t.Error("empty set picked an upstream")
+	}
+}
+
+func TestUpstreamSetSkipsUnhealthy(t *testing.T) {
+	s := NewUpstreamSet(RoundRobin, Upstream{Addr: "a"}, Upstream{Addr: "b"}, Upstream{Addr: "c"})
+	s.MarkUnhealthy("b")
+	want := []string{"a", "c", "a", "c"}
+	if got := picks(t, s, 4); !slices.Equal(got, want) {
+		t.Errorf("picked %v with b unhealthy, want %v", got, want)
+	}
+
+	// With every upstream unhealthy, they are all used again.
+	s.MarkUnhealthy("a")
+	s.MarkUnhealthy("c")
+	want = []string{"a", "b", "c"}
+	if got := picks(t, s, 3); !slices.Equal(got, want) {
+		t.Errorf("picked %v with all unhealthy, want %v", got, want)
+	}
+
+	// Once the cooldown has passed, b is back.
+	s = NewUpstreamSet(RoundRobin, Upstream{Addr: "a"}, Upstream{Addr: "b"})
+	s.Cooldown = 0
+	s.MarkUnhealthy("b")
+	want = []string{"a", "b"}
+	if got := picks(t, s, 2); !slices.Equal(got, want) {
+		t.Errorf("picked %v after the cooldown, want %v", got, want)
+	}
+}
+
+func TestUpstreamSetWeightedRandom(t *testing.T) {
+	s := NewUpstreamSet(WeightedRandom, Upstream{Addr: "a", Weight: 3}, Upstream{Addr: "b", Weight: 1})
+	s.MarkUnhealthy("a")
+	for _, addr := range picks(t, s, 20) {
+		if addr != "b" {
+			t.Fatalf("picked unhealthy upstream %s", addr)
+		}
+	}
+}
+
+func TestClientMarksFailedUpstream(t *testing.T) {
+	failing := serveUDP(t, func(req *DnsPacket) *DnsPacket {
+		return ErrorResponse(req, SERVFAIL)
+	})
+	working := serveUDP(t, func(req *DnsPacket) *DnsPacket {
+		return answerA(req, net.IPv4(192, 0, 2, 1))
+	})
+
+	c := NewUpstreamClient(NewUpstreamSet(RoundRobin, Upstream{Addr: failing}, Upstream{Addr: working}))
+	defer c.Close()
+
+	resp, err := c.Query("example.com", A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Rescode != SERVFAIL {
+		t.Fatalf("first query got %s, want SERVFAIL", resp.Header.Rescode)
+	}
+	for range 3 {
+		resp, err := c.Query("example.com", A)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Header.Rescode != NOERROR {
+			t.Errorf("query went to the failed upstream, got %s", resp.Header.Rescode)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package dns
+
+// Zone holds the records of a zone that a Server answers for
+// authoritatively.
+type Zone struct {
+	Origin string
+
+	records map[string][]*DnsRecord
+
+	// nodes holds every name that exists in the zone: the owner names
+	// and all their ancestors up to the origin, which exist even without
+	// records of their own.
+	nodes map[string]bool
+}
+
+func NewZone(origin string) *Zone {
+	z := &Zone{
+		Origin:  origin,
+		records: map[string][]*DnsRecord{},
+		nodes:   map[string]bool{},
+	}
+	if key, ok := canonicalName(origin); ok {
+		z.nodes[key] = true
+	}
+	return z
+}
+
+// Add adds records to the zone. Owner names starting with a "*" label are
+// wildcards, matching names that do not exist otherwise. Records whose owner
+// is not a valid name are left out, as they could never be served.
+func (z *Zone) Add(records ...*DnsRecord) {
+	for _, rec := range records {
+		key, ok := canonicalName(rec.Domain)
+		if !ok {
+			continue
+		}
+		z.records[key] = append(z.records[key], rec)
+
+		for name := key; !z.nodes[name] && InZone(name, z.Origin); name = parentName(name) {
+			z.nodes[name] = true
+		}
+	}
+}
+
+// SOA returns the SOA record at the origin of the zone, or nil if there is
+// none.
+func (z *Zone) SOA() *DnsRecord {
+	origin, ok := canonicalName(z.Origin)
+	if !ok {
+		return nil
+	}
+	for _, rec := range z.records[origin] {
+		if rec.Type == SOA {
+			return rec
+		}
+	}
+	return nil
+}
+
+// lookup returns the records owned by name and whether it exists. A name
+// that does not exist is matched by the wildcard of its closest encloser,
+// the nearest ancestor that exists, as RFC 4592 describes. So a wildcard
+// never covers names below an existing name other than its parent, even if
+// that name has no records. Records matched by a wildcard are copied with
+// their owner name set to name.
+func (z *Zone) lookup(name string) ([]*DnsRecord, bool) {
+	key, ok := canonicalName(name)
+	if !ok {
+		return nil, false
+	}
+	if z.nodes[key] {
+		return z.records[key], true
+	}
+
+	encloser := parentName(key)
+	for !z.nodes[encloser] {
+		if encloser == "" || !InZone(encloser, z.Origin) {
+			return nil, false
+		}
+		encloser = parentName(encloser)
+	}
+
+	wildcard, ok := z.records[CanonicalName("*."+encloser)]
+	if !ok {
+		return nil, false
+	}
+
+	records := make([]*DnsRecord, 0, len(wildcard))
+	for _, rec := range wildcard {
+		rec = rec.Clone()
+		rec.Domain = name
+		records = append(records, rec)
+	}
+	return records, true
+}
+
+// answer builds the authoritative response to req. Names that do not exist
+// get NXDOMAIN and names without records of the asked type get an empty
+// answer, both with the SOA in the authority section. Answers with NS
+// records carry the addresses of in-zone name servers as glue.
+func (z *Zone) answer(req *DnsPacket) *DnsPacket {
+	resp := ErrorResponse(req, NOERROR)
+	resp.Header.AuthoritativeAnswer = true
+
+	q := req.Questions[0]
+	records, ok := z.lookup(q.Name)
+	if !ok {
+		resp.Header.Rescode = NXDOMAIN
+		z.addSOA(resp)
+		return resp
+	}
+
+	var cname *DnsRecord
+	for _, rec := range records {
+		if rec.Type == q.Type {
+			resp.Answers = append(resp.Answers, rec)
+		} else if rec.Type == CNAME {
+			cname = rec
+		}
+	}
+	if len(resp.Answers) == 0 && cname != nil {
+		resp.Answers = append(resp.Answers, cname)
+	}
+
+	if len(resp.Answers) == 0 {
+		z.addSOA(resp)
+		return resp
+	}
+
+	for _, rec := range resp.Answers {
+		if rec.Type == NS && InZone(rec.Host, z.Origin) {
+			z.addGlue(resp, rec.Host)
+		}
+	}
+	return resp
+}
+
+func (z *Zone) addSOA(resp *DnsPacket) {
+	if soa := z.SOA(); soa != nil {
+		resp.Authorities = append(resp.Authorities, soa)
+	}
+}
+
+func (z *Zone) addGlue(resp *DnsPacket, host string) {
+	key, ok := canonicalName(host)
+	if !ok {
+		return
+	}
+	for _, rec := range z.records[key] {
+		if rec.Type == A || rec.Type == AAAA {
+			resp.Resources = append(resp.Resources, rec)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const testZone = `
+example.com.       3600 IN SOA ns1.example.com. admin.example.com. 1 7200 900 1209600 300
+example.com.       3600 IN NS  ns1.example.com.
+ns1.example.com.   3600 IN A   192.0.2.53
+www.example.com.   300  IN A   192.0.2.1
+*.apps.example.com. 300 IN A   192.0.2.2
+host.apps.example.com. 300 IN TXT "not a wildcard"
+`
+
+// loadZone parses the records of text, one per line, into a zone.
+func loadZone(t *testing.T, origin, text string) *Zone {
+	t.Helper()
+	z := NewZone(origin)
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		rec, err := ParseRecord(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.Add(rec)
+	}
+	return z
+}
+
+func TestServerZone(t *testing.T) {
+	addr := startServer(t, &Server{
+		Upstream: closedPort(t),
+		Zones:    []*Zone{loadZone(t, "example.com", testZone)},
+	})
+
+	for _, tt := range []struct {
+		name    string
+		qtype   RecordType
+		rcode   ResultCode
+		answer  net.IP
+		soa     bool
+		glue    bool
+		answers int
+	}{
+		{name: "www.example.com", qtype: A, answer: net.IPv4(192, 0, 2, 1), answers: 1},
+		{name: "WWW.Example.com", qtype: A, answer: net.IPv4(192, 0, 2, 1), answers: 1},
+		{name: "a.apps.example.com", qtype: A, answer: net.IPv4(192, 0, 2, 2), answers: 1},
+		{name: "x.y.apps.example.com", qtype: A, answer: net.IPv4(192, 0, 2, 2), answers: 1},
+		// An existing name isn't covered by the wildcard.
+		{name: "host.apps.example.com", qtype: A, soa: true},
+		{name: "www.example.com", qtype: AAAA, soa: true},
+		{name: "missing.example.com", qtype: A, rcode: NXDOMAIN, soa: true},
+		{name: "example.com", qtype: NS, glue: true, answers: 1},
+	} {
+		resp := lookup(t, addr, tt.name, tt.qtype)
+		if !resp.Header.AuthoritativeAnswer || resp.Header.Rescode != tt.rcode || len(resp.Answers) != tt.answers {
+			t.Errorf("%s %s got\n%v", tt.name, tt.qtype, resp)
+			continue
+		}
+		if tt.answer != nil && (!resp.Answers[0].Addr.Equal(tt.answer) || !sameName(resp.Answers[0].Domain, tt.name)) {
+			t.Errorf("%s %s answered with %v", tt.name, tt.qtype, resp.Answers[0])
+		}
+		if hasSOA := len(resp.Authorities) == 1 && resp.Authorities[0].Type == SOA; hasSOA != tt.soa {
+			t.Errorf("%s %s has authorities %v", tt.name, tt.qtype, resp.Authorities)
+		}
+		if hasGlue := len(resp.Resources) == 1 && resp.Resources[0].Addr.Equal(net.IPv4(192, 0, 2, 53)); hasGlue != tt.glue {
+			t.Errorf("%s %s has additional records %v", tt.name, tt.qtype, resp.Resources)
+		}
+	}
+
+	// Names outside the zones are forwarded, to an upstream that is down.
+	if resp := lookup(t, addr, "example.org", A); resp.Header.AuthoritativeAnswer || resp.Header.Rescode != SERVFAIL {
+		t.Errorf("query outside the zone got\n%v", resp)
+	}
+}
+
+func TestZoneWildcard(t *testing.T) {
+	z := loadZone(t, "example.com", `
+example.com.          3600 IN SOA ns1.example.com. admin.example.com. 1 7200 900 1209600 300
+*.example.com.        300  IN A   192.0.2.1
+*.example.com.        300  IN MX  10 mail.example.com.
+host.sub.example.com. 300  IN A   192.0.2.2
+`)
+
+	for _, tt := range []struct {
+		name    string
+		records int
+		ok      bool
+	}{
+		{"foo.example.com", 2, true},
+		{"a.b.example.com", 2, true},
+		{"*.example.com", 2, true},
+		// The apex exists, so the wildcard below it doesn't apply.
+		{"example.com", 1, true},
+		// sub exists without records of its own, so it blocks the wildcard
+		// for it and for the names below it.
+		{"sub.example.com", 0, true},
+		{"other.sub.example.com", 0, false},
+		{"host.sub.example.com", 1, true},
+		{"foo.example.org", 0, false},
+	} {
+		records, ok := z.lookup(tt.name)
+		if len(records) != tt.records || ok != tt.ok {
+			t.Errorf("lookup(%q) = %v, %v, want %d records, %v", tt.name, records, ok, tt.records, tt.ok)
+			continue
+		}
+		for _, rec := range records {
+			if rec.Domain != tt.name {
+				t.Errorf("lookup(%q) returned a record owned by %q", tt.name, rec.Domain)
+			}
+		}
+	}
+
+	// Synthesized records are copies.
+	records, _ := z.lookup("foo.example.com")
+	records[0].TTL = 1
+	if again, _ := z.lookup("bar.example.com"); again[0].TTL != 300 {
+		t.Error("changing a synthesized record changed the wildcard")
+	}
+}
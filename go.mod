@@ -1,3 +1,7 @@
 module github.com/Ysoding/go-dns
 
 go 1.22.3
+
+require golang.org/x/net v0.25.0
+
+require golang.org/x/text v0.15.0 // indirect
@@ -1,80 +1,123 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/Ysoding/go-dns/dns"
 )
 
-func main() {
-	qname := "google.com"
-	qtype := dns.A
+const usage = "usage: go-dns [-tcp] [-timeout d] [-short] [@server] <name> [type]"
 
-	server := "8.8.8.8:53"
+type options struct {
+	server  string
+	name    string
+	qtype   dns.RecordType
+	tcp     bool
+	timeout time.Duration
+	short   bool
+}
 
-	socket, err := net.ListenPacket("udp", "0.0.0.0:9999")
-	if err != nil {
-		fmt.Println("Error binding UDP socket:", err)
-		os.Exit(1)
+// parseArgs parses the command line in the form
+//
+//	go-dns [flags] [@server] <name> [type]
+//
+// The server defaults to 8.8.8.8:53 and the type to A.
+func parseArgs(args []string) (*options, error) {
+	opts := &options{
+		server: "8.8.8.8:53",
+		qtype:  dns.A,
 	}
-	defer socket.Close()
 
-	packet := dns.NewDnsPacket()
-	packet.Header.ID = 6666
-	packet.Header.Questions = 1
-	packet.Header.RecursionDesired = true
-	packet.Questions = append(packet.Questions, dns.NewDnsQuestion(qname, qtype))
+	fs := flag.NewFlagSet("go-dns", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.BoolVar(&opts.tcp, "tcp", false, "query over TCP")
+	fs.DurationVar(&opts.timeout, "timeout", 5*time.Second, "query timeout")
+	fs.BoolVar(&opts.short, "short", false, "only print the data of the answer records")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
 
-	reqBuffer := dns.NewBytePacketBuffer()
-	err = packet.Write(reqBuffer)
-	if err != nil {
-		fmt.Println("Error writing DNS packet:", err)
-		os.Exit(1)
+	rest := fs.Args()
+	if len(rest) > 0 && strings.HasPrefix(rest[0], "@") {
+		opts.server = rest[0][1:]
+		if _, _, err := net.SplitHostPort(opts.server); err != nil {
+			opts.server = net.JoinHostPort(opts.server, "53")
+		}
+		rest = rest[1:]
+	}
+
+	switch len(rest) {
+	case 2:
+		qtype, err := dns.ParseRecordType(rest[1])
+		if err != nil {
+			return nil, err
+		}
+		opts.qtype = qtype
+		fallthrough
+	case 1:
+		opts.name = rest[0]
+	default:
+		return nil, errors.New(usage)
 	}
 
-	// Send the packet to the server
-	serverAddr, err := net.ResolveUDPAddr("udp", server)
+	return opts, nil
+}
+
+func lookupUDP(opts *options) (*dns.DnsPacket, error) {
+	addr, err := net.ResolveUDPAddr("udp", opts.server)
 	if err != nil {
-		fmt.Println("Error resolving server address:", err)
-		os.Exit(1)
+		return nil, err
 	}
 
-	_, err = socket.WriteTo(reqBuffer.Buf[:reqBuffer.Pos], serverAddr)
+	conn, err := net.ListenPacket("udp", ":0")
 	if err != nil {
-		fmt.Println("Error sending DNS packet:", err)
-		os.Exit(1)
+		return nil, err
 	}
+	defer conn.Close()
 
-	respBuffer := dns.NewBytePacketBuffer()
-	socket.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return dns.Exchange(conn, addr, dns.NewQuery(opts.name, opts.qtype), opts.timeout)
+}
 
-	_, _, err = socket.ReadFrom(respBuffer.Buf[:])
-	if err != nil {
-		fmt.Println("Error receiving DNS response:", err)
-		os.Exit(1)
+// printShort writes the data of every answer in resp on a line of its own,
+// like dig +short: the address for A records, the name for CNAME records.
+func printShort(w io.Writer, resp *dns.DnsPacket) {
+	for _, rec := range resp.Answers {
+		fmt.Fprintln(w, rec.Data())
 	}
+}
 
-	resPacket, err := dns.FromBuffer2DnsPacket(respBuffer)
+func main() {
+	opts, err := parseArgs(os.Args[1:])
 	if err != nil {
-		fmt.Println("Error parsing DNS response:", err)
-		os.Exit(1)
+		fmt.Println(err)
+		os.Exit(2)
 	}
 
-	fmt.Printf("%#v\n", resPacket.Header)
+	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+	defer cancel()
 
-	for _, q := range resPacket.Questions {
-		fmt.Printf("%#v\n", q)
-	}
-	for _, rec := range resPacket.Answers {
-		fmt.Printf("%#v\n", rec)
+	var resp *dns.DnsPacket
+	if opts.tcp {
+		resp, err = dns.LookupTCP(ctx, opts.server, opts.name, opts.qtype)
+	} else {
+		resp, err = lookupUDP(opts)
 	}
-	for _, rec := range resPacket.Authorities {
-		fmt.Printf("%#v\n", rec)
+	if err != nil {
+		fmt.Println("Error looking up", opts.name+":", err)
+		os.Exit(1)
 	}
-	for _, rec := range resPacket.Resources {
-		fmt.Printf("%#v\n", rec)
+
+	if opts.short {
+		printShort(os.Stdout, resp)
+		return
 	}
+	fmt.Print(resp)
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Ysoding/go-dns/dns"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want options
+	}{
+		{[]string{"example.com"}, options{server: "8.8.8.8:53", name: "example.com", qtype: dns.A, timeout: 5 * time.Second}},
+		{[]string{"@1.1.1.1", "example.com", "MX"}, options{server: "1.1.1.1:53", name: "example.com", qtype: dns.MX, timeout: 5 * time.Second}},
+		{[]string{"@127.0.0.1:5353", "example.com", "aaaa"}, options{server: "127.0.0.1:5353", name: "example.com", qtype: dns.AAAA, timeout: 5 * time.Second}},
+		{[]string{"@::1", "example.com", "TXT"}, options{server: "[::1]:53", name: "example.com", qtype: dns.TXT, timeout: 5 * time.Second}},
+		{[]string{"-tcp", "-short", "-timeout", "2s", "example.com", "NS"}, options{server: "8.8.8.8:53", name: "example.com", qtype: dns.NS, tcp: true, short: true, timeout: 2 * time.Second}},
+		{[]string{"www.example.com", "CNAME"}, options{server: "8.8.8.8:53", name: "www.example.com", qtype: dns.CNAME, timeout: 5 * time.Second}},
+	}
+	for _, tt := range tests {
+		got, err := parseArgs(tt.args)
+		if err != nil {
+			t.Errorf("parseArgs(%q): %v", tt.args, err)
+			continue
+		}
+		if *got != tt.want {
+			t.Errorf("parseArgs(%q) = %+v, want %+v", tt.args, *got, tt.want)
+		}
+	}
+
+	for _, args := range [][]string{
+		{},
+		{"@8.8.8.8"},
+		{"example.com", "BOGUS"},
+		{"example.com", "A", "extra"},
+		{"-timeout", "soon", "example.com"},
+	} {
+		if got, err := parseArgs(args); err == nil {
+			t.Errorf("parseArgs(%q) = %+v, want an error", args, *got)
+		}
+	}
+}
+
+func TestPrintShort(t *testing.T) {
+	resp := dns.ErrorResponse(dns.NewQuery("www.example.com", dns.A), dns.NOERROR)
+	resp.Answers = append(resp.Answers,
+		&dns.DnsRecord{Type: dns.CNAME, Domain: "www.example.com", TTL: 300, Host: "example.com"},
+		dns.NewADnsRecord("example.com", net.IPv4(192, 0, 2, 1), 300),
+		&dns.DnsRecord{Type: dns.MX, Domain: "example.com", TTL: 300, Priority: 10, Host: "mail.example.com"},
+	)
+
+	var out strings.Builder
+	printShort(&out, resp)
+	want := "example.com.\n192.0.2.1\n10 mail.example.com.\n"
+	if out.String() != want {
+		t.Errorf("printShort wrote %q, want %q", out.String(), want)
+	}
+}